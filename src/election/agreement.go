@@ -0,0 +1,340 @@
+package election
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+type ExchangeVotersArgs struct {
+	ElectionId string
+	Index      int
+	Voters     []int64
+	Ballots    []SignedBallot // the signed ballots we hold of those voters
+	Choice     *VoterChoice   // our choice of common voters, once we made it
+}
+
+//
+// The common voters a counter chose, and the threshold counters
+// (index+1) it chose them from
+//
+type VoterChoice struct {
+	Voters   []int64
+	Counters []int
+}
+
+type ExchangeVotersReply struct {
+	Success bool
+}
+
+//
+// Sorted list of the voter ids in votes
+//
+func voterIds(votes map[int64][]int64) []int64 {
+	ids := make([]int64, 0, len(votes))
+	for id := range votes {
+		ids = append(ids, id)
+	}
+
+	return sortVoters(ids)
+}
+
+func sortVoters(ids []int64) []int64 {
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+//
+// Voters present in every one of the (sorted) voter sets
+//
+func intersectVoters(voterSets map[int][]int64) []int64 {
+	seen := make(map[int64]int)
+	for _, voters := range voterSets {
+		for _, id := range voters {
+			seen[id]++
+		}
+	}
+
+	common := make([]int64, 0)
+	for id, n := range seen {
+		if n == len(voterSets) {
+			common = append(common, id)
+		}
+	}
+
+	return sortVoters(common)
+}
+
+//
+// Key identifying a (sorted) voter set, so that totals over
+// the same voters can be grouped together
+//
+func voterSetKey(voters []int64) string {
+	var b strings.Builder
+	for _, id := range voters {
+		fmt.Fprintf(&b, "%d,", id)
+	}
+	return b.String()
+}
+
+//
+// Key identifying the totals over a voter set in a refresh epoch
+//
+func totalsKey(voters []int64, epoch int) string {
+	return fmt.Sprintf("%d:%s", epoch, voterSetKey(voters))
+}
+
+//
+// Stop taking votes into account, and start agreeing on a
+// common voter set with the rest of the committee
+//
+func (vc *electionCounter) closeVoting() {
+	vc.phase = VotingClosed
+	vc.voterSets[vc.me+1] = voterIds(vc.votes)
+
+	go vc.sendVoterSet()
+	go vc.exchangeDeadline()
+
+	vc.checkVoterSets()
+}
+
+//
+// Stop waiting for the voter sets of every counter once
+// the exchange deadline has passed
+//
+func (vc *electionCounter) exchangeDeadline() {
+	time.Sleep(vc.deadlines.Exchange)
+
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+
+	vc.exchangeExpired = true
+	vc.checkVoterSets()
+	vc.persist()
+}
+
+//
+// Send our voter set to the other vote counters
+//
+func (vc *electionCounter) sendVoterSet() {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+
+	for !vc.killed() && len(vc.voterSetSuccess) < len(vc.committeeMembers)-1 {
+		for i := 0; i < len(vc.committeeMembers); i++ {
+			if i != vc.me && !vc.voterSetSuccess[i] && !vc.peerDead(i) {
+				go func(counter int, args ExchangeVotersArgs) {
+					reply := ExchangeVotersReply{}
+					vc.sendExchangeVoters(counter, &args, &reply)
+				}(i, ExchangeVotersArgs{vc.registry.ElectionId, vc.me + 1, vc.voterSets[vc.me+1], vc.ownBallots(), vc.ownChoice()})
+			}
+		}
+
+		vc.mu.Unlock()
+		time.Sleep(time.Duration(receiveTotalsTimeout) * time.Millisecond)
+		vc.mu.Lock()
+	}
+}
+
+//
+// Our choice of common voters, if we made it
+//
+func (vc *electionCounter) ownChoice() *VoterChoice {
+	choice, ok := vc.choices[vc.me+1]
+	if !ok {
+		return nil
+	}
+	return &choice
+}
+
+//
+// The signed ballots of our voters, in voter set order. Shares we
+// got by resharing come without one.
+//
+func (vc *electionCounter) ownBallots() []SignedBallot {
+	ballots := make([]SignedBallot, 0, len(vc.voterSets[vc.me+1]))
+	for _, id := range vc.voterSets[vc.me+1] {
+		if ballot, ok := vc.ballots[id]; ok {
+			ballots = append(ballots, ballot)
+		}
+	}
+	return ballots
+}
+
+func (vc *electionCounter) sendExchangeVoters(counter int, args *ExchangeVotersArgs, reply *ExchangeVotersReply) {
+	ok := vc.committeeMembers[counter].CallContext(vc.ctx, "VoteCounter.ExchangeVoters", args, reply) == nil
+
+	if ok && reply.Success {
+		vc.mu.Lock()
+		// a late reply from before we chose doesn't carry our choice
+		if args.Choice != nil || vc.ownChoice() == nil {
+			vc.voterSetSuccess[counter] = true
+		}
+		vc.mu.Unlock()
+	}
+}
+
+//
+//	Get the voter set of other vote counters, and their choice of
+//	common voters once they made it
+//
+func (vc *electionCounter) ExchangeVoters(args *ExchangeVotersArgs, reply *ExchangeVotersReply) {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+
+	if args.Index < 1 || args.Index > len(vc.committeeMembers) || args.Index == vc.me+1 {
+		reply.Success = false
+		return
+	}
+
+	for i := range args.Ballots {
+		vc.checkExchangedBallot(&args.Ballots[i])
+	}
+	if vc.phase <= VotingClosed {
+		vc.voterSets[args.Index] = args.Voters
+	} else {
+		vc.adoptVoterSet(args.Index, args.Voters)
+	}
+	// a counter only ever makes one choice
+	if _, ok := vc.choices[args.Index]; !ok && args.Choice != nil {
+		vc.choices[args.Index] = *args.Choice
+	}
+	vc.checkVoterSets()
+	vc.checkChoices()
+
+	vc.persist()
+	reply.Success = true
+}
+
+//
+// Choose the common voters once the voters of every counter that
+// isn't dead are known, or once the exchange deadline has passed,
+// as long as at least threshold of them are. Voters that
+// equivocated are left out, and of the rest, the threshold
+// counters that share the most voters are chosen.
+//
+// Counters that chose from different voter sets, say because one
+// came after the deadline of some of them, make different choices.
+// Totals over two voter sets would give away the votes of the
+// voters in one but not the other, so nobody adds up any until
+// the common voters are agreed on (see checkChoices).
+//
+func (vc *electionCounter) checkVoterSets() {
+	if vc.phase != VotingClosed {
+		return
+	}
+
+	missing := 0
+	for i := range vc.committeeMembers {
+		if _, ok := vc.voterSets[i+1]; !ok && !vc.peerDead(i) {
+			missing++
+		}
+	}
+
+	if len(vc.voterSets) >= vc.threshold && (missing == 0 || vc.exchangeExpired) {
+		voterSets := vc.dropEquivocators(vc.voterSets)
+		counters, voters := chooseCounters(voterSets, vc.threshold)
+		vc.choices[vc.me+1] = VoterChoice{voters, counters}
+		vc.phase = ExchangingTotals
+		vc.startTotalsDeadline()
+
+		// our voter set again, with our choice
+		vc.voterSetSuccess = make(map[int]bool)
+		go vc.sendVoterSet()
+
+		vc.checkChoices()
+	}
+}
+
+//
+// Agree on the common voters once more than half of the committee
+// chose them. Every counter makes a single choice, so no two voter
+// sets can both be agreed on, and the totals over the agreed voters
+// are the only ones ever sent. Every counter that holds them is
+// expected to add them up, so that bad totals can be told apart
+// from the others, and if we are one of them we add up the shares
+// of those voters only. Until more than half of the committee
+// makes the same choice, there is no agreement, and no result.
+//
+// A counter that lost its state, and was replaced, may choose
+// again, differently.
+//
+func (vc *electionCounter) checkChoices() {
+	if vc.phase != ExchangingTotals || vc.commonVoters != nil {
+		return
+	}
+
+	chosen := make(map[string]int)
+	for _, choice := range vc.choices {
+		chosen[voterSetKey(choice.Voters)]++
+	}
+
+	indices := make([]int, 0, len(vc.choices))
+	for index := range vc.choices {
+		indices = append(indices, index)
+	}
+	sort.Ints(indices)
+	// ours first, then by index, for the counters to report
+	if _, ok := vc.choices[vc.me+1]; ok {
+		indices = append([]int{vc.me + 1}, indices...)
+	}
+
+	for _, index := range indices {
+		choice := vc.choices[index]
+		if chosen[voterSetKey(choice.Voters)] > len(vc.committeeMembers)/2 {
+			vc.agree(choice)
+			return
+		}
+	}
+}
+
+//
+// Take the common voters to be the ones chosen, and add them up if
+// we hold all of them
+//
+func (vc *electionCounter) agree(choice VoterChoice) {
+	vc.commonVoters = append(make([]int64, 0, len(choice.Voters)), choice.Voters...)
+	vc.chosenCounters = choice.Counters
+	vc.commonCounters = coveringCounters(vc.voterSets, vc.commonVoters)
+
+	for index := range vc.earlyTotals {
+		args := vc.earlyTotals[index]
+		vc.takeTotal(&args)
+	}
+	vc.earlyTotals = make(map[int]CountTotalArgs)
+	vc.checkResult()
+
+	for _, index := range vc.commonCounters {
+		if index == vc.me+1 {
+			vc.addCommonVotes()
+		}
+	}
+}
+
+//
+// Take the voter set of a counter that came after we chose the
+// common voters. Only a counter's own voter set is taken, from
+// its own messages: sets it passed on for others would be nobody's
+// word but its own. Once the common voters are agreed on, the
+// counter is expected to add them up if it holds them all.
+//
+func (vc *electionCounter) adoptVoterSet(index int, voters []int64) {
+	if _, ok := vc.voterSets[index]; ok {
+		return
+	}
+	if voters == nil {
+		// gob drops empty slices
+		voters = make([]int64, 0)
+	}
+	vc.voterSets[index] = voters
+
+	if vc.commonVoters != nil {
+		vc.commonCounters = coveringCounters(vc.voterSets, vc.commonVoters)
+		for _, vt := range vc.totalCounts {
+			if voterSetKey(vt.Voters) == voterSetKey(vc.commonVoters) {
+				vt.Counters = vc.commonCounters
+			}
+		}
+	}
+}
@@ -0,0 +1,416 @@
+package election
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"6.824/labgob"
+	"6.824/labrpc"
+)
+
+//
+// Elections multiplexed over one committee. A VoteCounter is one
+// seat of the committee: it holds the seat's key, its view of the
+// other counters, and any number of elections, each with its own
+// registry, candidates, threshold, deadlines and phase. Every RPC
+// names the election it is for, and is handed to that election's
+// electionCounter (see votecounter.go), so that ballots, voter
+// sets and totals of different elections never mix.
+//
+// Elections are created and closed on every counter of the
+// committee by whoever runs it, like ReplaceCounter, and RPCs for
+// an election a counter doesn't know yet fail with
+// ErrUnknownElection, which the senders retry.
+//
+
+type VoteCounter struct {
+	mu     sync.Mutex
+	dead   int32              // set by Kill()
+	ctx    context.Context    // of our RPCs, done once killed
+	cancel context.CancelFunc // called by Kill()
+
+	committeeMembers []Endpoint
+	me               int
+	key              *ecdh.PrivateKey  // opens the shares sealed for us
+	counterKeys      []*ecdh.PublicKey // every counter's public key
+	persister        Persister
+
+	health    map[int]*PeerHealth         // our view of the other counters
+	elections map[string]*electionCounter // by election id
+}
+
+//
+// What a counter knows of one of its elections
+//
+type ElectionStatus struct {
+	ElectionId string
+	Candidates []string
+	Threshold  int
+	Voters     int // registered voters, or those on the roll once agreed
+	Ballots    int // ballots we hold
+	Phase      Phase
+	Epoch      int
+	Done       bool
+	Result     Result
+}
+
+//
+// main/votecounter.go calls this function.
+//
+func MakeVoteCounter(committeeMembers []Endpoint, me int, key *ecdh.PrivateKey, counterKeys []*ecdh.PublicKey, persister Persister) *VoteCounter {
+	vc := &VoteCounter{}
+	vc.ctx, vc.cancel = context.WithCancel(context.Background())
+
+	vc.committeeMembers = committeeMembers
+	if sp, ok := persister.(*seatPersister); ok {
+		// a seat's counter sends nothing its replicas may lose
+		vc.committeeMembers = sp.memberEnds(committeeMembers)
+	}
+	vc.me = me
+	vc.key = key
+	vc.counterKeys = append([]*ecdh.PublicKey(nil), counterKeys...)
+	vc.persister = persister
+
+	vc.health = make(map[int]*PeerHealth)
+	for i := range committeeMembers {
+		if i != me {
+			vc.health[i] = &PeerHealth{Alive, time.Now(), time.Now()}
+		}
+	}
+	vc.elections = make(map[string]*electionCounter)
+
+	vc.readPersist()
+	for _, el := range vc.elections {
+		el.resume()
+	}
+	go vc.heartbeatLoop()
+
+	return vc
+}
+
+func (vc *VoteCounter) readPersist() bool {
+	data := vc.persister.readPersistState()
+
+	if data == nil || len(data) < 1 { // bootstrap without any state?
+		return false
+	}
+
+	r := bytes.NewBuffer(data)
+	d := labgob.NewDecoder(r)
+	var counterKeys [][]byte
+	var electionIds []string
+
+	if d.Decode(&counterKeys) != nil || d.Decode(&electionIds) != nil {
+		panic("Error decoding persist data")
+	}
+
+	for i, key := range counterKeys {
+		// including the keys of counters that have been replaced
+		if public, err := ecdh.X25519().NewPublicKey(key); err == nil && i < len(vc.counterKeys) {
+			vc.counterKeys[i] = public
+		}
+	}
+	for range electionIds {
+		el := makeElectionCounter(vc, MakeRegistry(""), nil, 0, Deadlines{})
+		if !el.decode(d) {
+			panic("Error decoding persist data")
+		}
+		vc.elections[el.registry.ElectionId] = el
+	}
+
+	return true
+}
+
+func (vc *VoteCounter) persist() {
+	w := new(bytes.Buffer)
+	e := labgob.NewEncoder(w)
+	counterKeys := make([][]byte, len(vc.counterKeys))
+	for i, key := range vc.counterKeys {
+		counterKeys[i] = key.Bytes()
+	}
+	e.Encode(counterKeys)
+	electionIds := vc.electionIds()
+	e.Encode(electionIds)
+	for _, id := range electionIds {
+		vc.elections[id].encode(e)
+	}
+	data := w.Bytes()
+	vc.persister.writePersistState(data)
+}
+
+func (vc *VoteCounter) electionIds() []string {
+	ids := make([]string, 0, len(vc.elections))
+	for id := range vc.elections {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+//
+// Start counting the election of the registry's voters, with
+// its voting open until deadlines.Voting from now or, if it has a
+// registration window, taking more voters until
+// deadlines.Registration from now. Every counter of the committee
+// must be given the same election.
+//
+func (vc *VoteCounter) CreateElection(registry *Registry, candidates []string, threshold int, deadlines Deadlines) Err {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+
+	if _, ok := vc.elections[registry.ElectionId]; ok {
+		return ErrElectionExists
+	}
+
+	el := makeElectionCounter(vc, registry.copy(), append([]string(nil), candidates...), threshold, deadlines)
+	vc.elections[registry.ElectionId] = el
+	vc.persist()
+	el.resume()
+
+	return OK
+}
+
+//
+// Close the voting of an election before its deadline
+//
+func (vc *VoteCounter) CloseElection(electionId string) Err {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+
+	el, ok := vc.elections[electionId]
+	if !ok {
+		return ErrUnknownElection
+	}
+	if el.recovering {
+		return ErrRecovering
+	}
+
+	if el.phase == VotingOpen {
+		el.closeVoting()
+		vc.persist()
+	}
+	return OK
+}
+
+//
+// Close the registration of an election before its deadline
+//
+func (vc *VoteCounter) CloseRegistration(electionId string) Err {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+
+	el, ok := vc.elections[electionId]
+	if !ok {
+		return ErrUnknownElection
+	}
+
+	if el.phase == Registering {
+		el.closeRegistration()
+		vc.persist()
+	}
+	return OK
+}
+
+//
+// Returns the ids of our elections, sorted
+//
+func (vc *VoteCounter) Elections() []string {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+
+	return vc.electionIds()
+}
+
+//
+// Returns what we know of an election, if we have it
+//
+func (vc *VoteCounter) QueryElection(electionId string) (ElectionStatus, bool) {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+
+	el, ok := vc.elections[electionId]
+	if !ok {
+		return ElectionStatus{}, false
+	}
+
+	status := ElectionStatus{}
+	status.ElectionId = electionId
+	status.Candidates = append([]string(nil), el.candidates...)
+	status.Threshold = el.threshold
+	status.Voters = el.nVoters
+	status.Ballots = len(el.votes)
+	status.Phase = el.phase
+	status.Epoch = el.epoch
+	status.Result = Result{Winner: NoWinner}
+	if el.result != nil {
+		status.Done = true
+		status.Result = *el.result
+		status.Result.Tally = append([]int64(nil), el.result.Tally...)
+		status.Result.Chosen = append([]int(nil), el.result.Chosen...)
+		status.Result.Counters = append([]int(nil), el.result.Counters...)
+		status.Result.Faulty = append([]int(nil), el.result.Faulty...)
+	}
+
+	return status, true
+}
+
+func (vc *VoteCounter) election(electionId string) (*electionCounter, bool) {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+
+	el, ok := vc.elections[electionId]
+	return el, ok
+}
+
+func (vc *VoteCounter) Register(args *RegisterArgs, reply *RegisterReply) {
+	el, ok := vc.election(args.ElectionId)
+	if !ok {
+		reply.Success = false
+		reply.Err = ErrUnknownElection
+		return
+	}
+	el.Register(args, reply)
+}
+
+func (vc *VoteCounter) ExchangeRoll(caller labrpc.Caller, args *ExchangeRollArgs, reply *ExchangeRollReply) {
+	el, ok := vc.election(args.ElectionId)
+	if !ok || !callerIs(caller, args.Index-1) {
+		reply.Success = false
+		return
+	}
+	el.ExchangeRoll(args, reply)
+}
+
+func (vc *VoteCounter) CountVote(args *CountVoteArgs, reply *CountVoteReply) {
+	el, ok := vc.election(args.ElectionId)
+	if !ok {
+		reply.Success = false
+		reply.Err = ErrUnknownElection
+		return
+	}
+	el.CountVote(args, reply)
+}
+
+func (vc *VoteCounter) CountTotal(caller labrpc.Caller, args *CountTotalArgs, reply *CountTotalReply) {
+	el, ok := vc.election(args.ElectionId)
+	if !ok || !callerIs(caller, args.Index-1) {
+		reply.Success = false
+		return
+	}
+	el.CountTotal(args, reply)
+}
+
+func (vc *VoteCounter) GetResult(args *GetResultArgs, reply *GetResultReply) {
+	el, ok := vc.election(args.ElectionId)
+	if !ok {
+		reply.Done = false
+		return
+	}
+	el.GetResult(args, reply)
+}
+
+func (vc *VoteCounter) ExchangeVoters(caller labrpc.Caller, args *ExchangeVotersArgs, reply *ExchangeVotersReply) {
+	el, ok := vc.election(args.ElectionId)
+	if !ok || !callerIs(caller, args.Index-1) {
+		reply.Success = false
+		return
+	}
+	el.ExchangeVoters(args, reply)
+}
+
+func (vc *VoteCounter) ReportEquivocation(args *ReportEquivocationArgs, reply *ReportEquivocationReply) {
+	el, ok := vc.election(args.ElectionId)
+	if !ok {
+		reply.Success = false
+		return
+	}
+	el.ReportEquivocation(args, reply)
+}
+
+func (vc *VoteCounter) Refresh(caller labrpc.Caller, args *RefreshArgs, reply *RefreshReply) {
+	el, ok := vc.election(args.ElectionId)
+	if !ok || !callerIs(caller, args.Dealer-1) {
+		reply.Success = false
+		return
+	}
+	el.Refresh(args, reply)
+}
+
+func (vc *VoteCounter) FixDealers(caller labrpc.Caller, args *FixDealersArgs, reply *FixDealersReply) {
+	el, ok := vc.election(args.ElectionId)
+	if !ok || !callerIs(caller, args.Index-1) {
+		reply.Success = false
+		return
+	}
+	el.FixDealers(args, reply)
+}
+
+func (vc *VoteCounter) Reshare(caller labrpc.Caller, args *ReshareArgs, reply *ReshareReply) {
+	if !callerIs(caller, args.Index-1) {
+		reply.Success = false
+		reply.Err = ErrUnauthorized
+		return
+	}
+	el, ok := vc.election(args.ElectionId)
+	if !ok {
+		reply.Success = false
+		reply.Err = ErrUnknownElection
+		return
+	}
+	el.Reshare(args, reply)
+}
+
+//
+// Tell this counter that counter has been replaced, and that
+// the replacement's public key is key
+//
+func (vc *VoteCounter) ReplaceCounter(counter int, key *ecdh.PublicKey) {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+
+	vc.counterKeys[counter] = key
+	for _, el := range vc.elections {
+		el.replaceCounter(counter)
+	}
+
+	vc.persist()
+}
+
+//
+// Rebuild our shares of every election from the rest of the
+// committee, as the replacement of a counter that was lost with
+// all of its state. The elections must have been created again.
+//
+func (vc *VoteCounter) Recover() {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+
+	for _, el := range vc.elections {
+		el.recover()
+	}
+
+	vc.persist()
+}
+
+//
+// the tester doesn't halt goroutines created after each test,
+// but it does call the Kill() method. The use of atomic avoids the
+// need for a lock. Our RPCs in flight are canceled.
+//
+func (vc *VoteCounter) Kill() {
+	atomic.StoreInt32(&vc.dead, 1)
+	vc.cancel()
+}
+
+//
+// Check whether Kill() has been called.
+//
+func (vc *VoteCounter) killed() bool {
+	z := atomic.LoadInt32(&vc.dead)
+	return z == 1
+}
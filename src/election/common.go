@@ -0,0 +1,44 @@
+package election
+
+import (
+	"context"
+)
+
+const (
+	OK              = "OK"
+	ErrVotingClosed = "ErrVotingClosed"
+	ErrInvalidShare = "ErrInvalidShare"
+	ErrInvalidProof = "ErrInvalidProof"
+	ErrInvalidVote  = "ErrInvalidVote"
+
+	ErrUnknownVoter     = "ErrUnknownVoter"
+	ErrInvalidSignature = "ErrInvalidSignature"
+	ErrConflictingShare = "ErrConflictingShare"
+
+	ErrRecovering   = "ErrRecovering"
+	ErrNotReady     = "ErrNotReady"
+	ErrUnauthorized = "ErrUnauthorized"
+
+	ErrUnknownElection = "ErrUnknownElection"
+	ErrElectionExists  = "ErrElectionExists"
+
+	ErrRegistrationClosed = "ErrRegistrationClosed"
+	ErrAlreadyRegistered  = "ErrAlreadyRegistered"
+	ErrNotEligible        = "ErrNotEligible"
+
+	ErrUnknownMethod = "ErrUnknownMethod"
+	ErrInvalidArgs   = "ErrInvalidArgs"
+)
+
+type Err string
+
+//
+// A committee member, as seen by voters and the other counters:
+// a *labrpc.ClientEnd to a vote counter, or a *SeatEnd to the
+// replicas of a seat. Voters and counters make their calls with
+// CallContext, so that Kill() cancels those in flight.
+//
+type Endpoint interface {
+	Call(svcMeth string, args interface{}, reply interface{}) bool
+	CallContext(ctx context.Context, svcMeth string, args interface{}, reply interface{}) error
+}
@@ -5,13 +5,18 @@ import (
 	"fmt"
 	"math/big"
 	"math/rand"
+	"os"
 	"runtime"
+	"strconv"
 	"sync"
 	"testing"
+	"time"
 
+	"crypto/ecdh"
 	crand "crypto/rand"
 
 	"6.824/labrpc"
+	"6.824/raft"
 )
 
 var ncpu_once sync.Once
@@ -23,37 +28,63 @@ func makeSeed() int64 {
 	return x
 }
 
-func randstring(n int) string {
+// the seed of a test's network, and of its random choices, from
+// $LABRPC_SEED to replay a failed test, or a fresh one. the end
+// names, election id and voter ids come from the seed too, so the
+// network drops, delays and reorders the same requests again, as
+// long as each end sends them in the same order; the rest of the
+// test still runs in real time.
+func makeNetwork(t *testing.T) (*labrpc.Network, *rand.Rand) {
+	seed, err := strconv.ParseInt(os.Getenv("LABRPC_SEED"), 10, 64)
+	if err != nil {
+		seed = makeSeed()
+	}
+
+	t.Cleanup(func() {
+		if t.Failed() {
+			t.Logf("network seed %v, replay with LABRPC_SEED=%v", seed, seed)
+		}
+	})
+
+	return labrpc.MakeSeededNetwork(seed), rand.New(rand.NewSource(seed))
+}
+
+func randstring(r *rand.Rand, n int) string {
 	b := make([]byte, 2*n)
-	crand.Read(b)
+	r.Read(b)
 	s := base64.URLEncoding.EncodeToString(b)
 	return s[0:n]
 }
 
-type VoterPersister struct {
-	mu         sync.Mutex
-	voteShares []byte
+// a voter id, like nrand(0) but from r
+func randVoterId(r *rand.Rand) int64 {
+	return r.Int63n(int64(1) << 62)
 }
 
-func (vp *VoterPersister) readPersistState() []byte {
+type MemPersister struct {
+	mu    sync.Mutex
+	state []byte
+}
+
+func (vp *MemPersister) readPersistState() []byte {
 	vp.mu.Lock()
 	defer vp.mu.Unlock()
 
-	return vp.voteShares
+	return vp.state
 }
 
-func (vp *VoterPersister) writePersistState(data []byte) {
+func (vp *MemPersister) writePersistState(data []byte) {
 	vp.mu.Lock()
 	defer vp.mu.Unlock()
 
-	vp.voteShares = data
+	vp.state = data
 }
 
-func (vp *VoterPersister) copy() *VoterPersister {
+func (vp *MemPersister) copy() *MemPersister {
 	vp.mu.Lock()
 	defer vp.mu.Unlock()
-	np := &VoterPersister{}
-	np.voteShares = vp.voteShares
+	np := &MemPersister{}
+	np.state = vp.state
 	return np
 }
 
@@ -61,9 +92,15 @@ type config struct {
 	mu               sync.Mutex
 	t                *testing.T
 	net              *labrpc.Network
+	rand             *rand.Rand // the test's random choices, seeded like net
 	nCounters        int
 	nVoters          int
 	threshold        int
+	candidates       []string
+	registry         *Registry
+	counterKeys      []*ecdh.PrivateKey
+	credentials      []Credential
+	deadlines        Deadlines
 	counters         []*VoteCounter
 	voters           []*Voter
 	votes            []int
@@ -71,10 +108,18 @@ type config struct {
 	voterConnected   []bool
 	counterEndnames  [][]string // the port file names each sends to
 	voterEndnames    [][]string
-	saved            []*VoterPersister
+	saved            []*MemPersister
+	counterSaved     []*MemPersister
 }
 
-func makeConfig(t *testing.T, nCounters, nVoters, threshold int, votes []int, unreliable bool) *config {
+// candidates of a yes/no referendum, so that a vote of 1 means "Yes"
+var referendum = []string{"No", "Yes"}
+
+func makeConfig(t *testing.T, nCounters, nVoters, threshold int, candidates []string, votes []int, unreliable bool) *config {
+	return makeConfigDeadlines(t, nCounters, nVoters, threshold, candidates, votes, unreliable, DefaultDeadlines())
+}
+
+func makeConfigDeadlines(t *testing.T, nCounters, nVoters, threshold int, candidates []string, votes []int, unreliable bool, deadlines Deadlines) *config {
 	ncpu_once.Do(func() {
 		if runtime.NumCPU() < 2 {
 			fmt.Printf("warning: only one CPU, which may conceal locking bugs\n")
@@ -85,10 +130,29 @@ func makeConfig(t *testing.T, nCounters, nVoters, threshold int, votes []int, un
 
 	cfg := &config{}
 	cfg.t = t
-	cfg.net = labrpc.MakeNetwork()
+	cfg.net, cfg.rand = makeNetwork(t)
 	cfg.nCounters = nCounters
 	cfg.nVoters = nVoters
 	cfg.threshold = threshold
+	cfg.candidates = candidates
+	cfg.deadlines = deadlines
+	cfg.registry = MakeRegistry(randstring(cfg.rand, 8))
+	cfg.counterKeys = make([]*ecdh.PrivateKey, cfg.nCounters)
+	for i := 0; i < cfg.nCounters; i++ {
+		key, err := ecdh.X25519().GenerateKey(crand.Reader)
+		if err != nil {
+			t.Fatalf("counter %v key: %v", i, err)
+		}
+		cfg.counterKeys[i] = key
+	}
+	cfg.credentials = make([]Credential, cfg.nVoters)
+	for i := 0; i < cfg.nVoters; i++ {
+		credential, err := cfg.registry.Enroll(randVoterId(cfg.rand))
+		if err != nil {
+			t.Fatalf("enroll voter %v: %v", i, err)
+		}
+		cfg.credentials[i] = credential
+	}
 	cfg.counters = make([]*VoteCounter, cfg.nCounters)
 	cfg.voters = make([]*Voter, cfg.nVoters)
 	cfg.votes = votes
@@ -96,7 +160,8 @@ func makeConfig(t *testing.T, nCounters, nVoters, threshold int, votes []int, un
 	cfg.voterConnected = make([]bool, cfg.nVoters)
 	cfg.counterEndnames = make([][]string, cfg.nCounters)
 	cfg.voterEndnames = make([][]string, cfg.nVoters)
-	cfg.saved = make([]*VoterPersister, cfg.nVoters)
+	cfg.saved = make([]*MemPersister, cfg.nVoters)
+	cfg.counterSaved = make([]*MemPersister, cfg.nCounters)
 
 	cfg.setunreliable(unreliable)
 
@@ -119,6 +184,23 @@ func makeConfig(t *testing.T, nCounters, nVoters, threshold int, votes []int, un
 	return cfg
 }
 
+// a credential that none of the counters know about
+func unregisteredCredential(t *testing.T) Credential {
+	credential, err := MakeRegistry("unregistered").Enroll(nrand(0))
+	if err != nil {
+		t.Fatalf("enroll voter: %v", err)
+	}
+	return credential
+}
+
+func (cfg *config) counterPublicKeys() []*ecdh.PublicKey {
+	keys := make([]*ecdh.PublicKey, cfg.nCounters)
+	for i, key := range cfg.counterKeys {
+		keys[i] = key.PublicKey()
+	}
+	return keys
+}
+
 func (cfg *config) startVoting() {
 	for i := 0; i < cfg.nVoters; i++ {
 		if cfg.voters[i] != nil {
@@ -140,17 +222,32 @@ func (cfg *config) startCounter(i int) {
 	// so that old crashed instance's ClientEnds can't send.
 	cfg.counterEndnames[i] = make([]string, cfg.nCounters)
 	for j := 0; j < cfg.nCounters; j++ {
-		cfg.counterEndnames[i][j] = randstring(20)
+		cfg.counterEndnames[i][j] = randstring(cfg.rand, 20)
 	}
 
 	// a fresh set of ClientEnds.
-	ends := make([]*labrpc.ClientEnd, cfg.nCounters)
+	ends := make([]Endpoint, cfg.nCounters)
 	for j := 0; j < cfg.nCounters; j++ {
 		ends[j] = cfg.net.MakeEnd(cfg.counterEndnames[i][j])
 		cfg.net.Connect(cfg.counterEndnames[i][j], j)
+		cfg.net.SetOwner(cfg.counterEndnames[i][j], i)
+	}
+
+	cfg.mu.Lock()
+
+	// a fresh persister, so old instance doesn't overwrite
+	// new instance's persisted state.
+	if cfg.counterSaved[i] != nil {
+		cfg.counterSaved[i] = cfg.counterSaved[i].copy()
+	} else {
+		cfg.counterSaved[i] = &MemPersister{}
 	}
 
-	vc := MakeVoteCounter(ends, i, cfg.nVoters, cfg.threshold)
+	cfg.mu.Unlock()
+
+	vc := MakeVoteCounter(ends, i, cfg.counterKeys[i], cfg.counterPublicKeys(), cfg.counterSaved[i])
+	// a restarted counter already has the election
+	vc.CreateElection(cfg.registry, cfg.candidates, cfg.threshold, cfg.deadlines)
 
 	cfg.mu.Lock()
 	cfg.counters[i] = vc
@@ -162,6 +259,75 @@ func (cfg *config) startCounter(i int) {
 	cfg.net.AddServer(i, srv)
 }
 
+// counter i's state of the test's election.
+func (cfg *config) election(i int) *electionCounter {
+	cfg.mu.Lock()
+	vc := cfg.counters[i]
+	cfg.mu.Unlock()
+
+	el, _ := vc.election(cfg.registry.ElectionId)
+	return el
+}
+
+// counter i's common voters, once it agreed on them.
+func (cfg *config) commonVoters(i int) []int64 {
+	for iters := 0; iters < 100; iters++ {
+		el := cfg.election(i)
+		el.mu.Lock()
+		voters := el.commonVoters
+		el.mu.Unlock()
+		if voters != nil {
+			return voters
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	cfg.t.Fatalf("expecting counter %v to agree on the common voters", i)
+	return nil
+}
+
+// another election on the same committee, with voters of its
+// own, who are connected to every counter but don't vote yet.
+// If the election has a registration window, the voters aren't
+// enrolled, and must register themselves.
+func (cfg *config) makeElection(candidates []string, votes []int, deadlines Deadlines) (*Registry, []*Voter) {
+	registry := MakeRegistry(randstring(cfg.rand, 8))
+	credentials := make([]Credential, len(votes))
+	for i := range votes {
+		var credential Credential
+		var err error
+		if deadlines.Registration > 0 {
+			credential, err = MakeCredential(registry.ElectionId, randVoterId(cfg.rand))
+			registry.Allow(credential.VoterId)
+		} else {
+			credential, err = registry.Enroll(randVoterId(cfg.rand))
+		}
+		if err != nil {
+			cfg.t.Fatalf("enroll voter %v: %v", i, err)
+		}
+		credentials[i] = credential
+	}
+
+	for i := 0; i < cfg.nCounters; i++ {
+		if err := cfg.counters[i].CreateElection(registry, candidates, cfg.threshold, deadlines); err != OK {
+			cfg.t.Fatalf("counter %v can't create election %v: %v", i, registry.ElectionId, err)
+		}
+	}
+
+	voters := make([]*Voter, len(votes))
+	for i := range votes {
+		ends := make([]Endpoint, cfg.nCounters)
+		for j := 0; j < cfg.nCounters; j++ {
+			endname := randstring(cfg.rand, 20)
+			ends[j] = cfg.net.MakeEnd(endname)
+			cfg.net.Connect(endname, j)
+			cfg.net.Enable(endname, true)
+		}
+		voters[i] = MakeVoter(ends, cfg.counterPublicKeys(), credentials[i], candidates, votes[i], cfg.threshold, &MemPersister{})
+	}
+
+	return registry, voters
+}
+
 func (cfg *config) crashCounter(i int) {
 	cfg.disconnectCounter(i)
 	cfg.net.DeleteServer(i) // disable client connections to the server.
@@ -169,6 +335,14 @@ func (cfg *config) crashCounter(i int) {
 	cfg.mu.Lock()
 	defer cfg.mu.Unlock()
 
+	// a fresh persister, in case old instance
+	// continues to update the Persister.
+	// but copy old persister's content so that we always
+	// pass Make() the last persisted state.
+	if cfg.counterSaved[i] != nil {
+		cfg.counterSaved[i] = cfg.counterSaved[i].copy()
+	}
+
 	vc := cfg.counters[i]
 	if vc != nil {
 		cfg.mu.Unlock()
@@ -178,6 +352,38 @@ func (cfg *config) crashCounter(i int) {
 	}
 }
 
+// lose counter i for good, state and key, and start a
+// replacement that rebuilds its shares from the others.
+func (cfg *config) replaceCounter(i int) {
+	cfg.startReplacement(i)
+	cfg.counters[i].Recover()
+}
+
+// start counter i afresh, with a new key that the others are
+// told about, but don't have it recover yet.
+func (cfg *config) startReplacement(i int) {
+	cfg.crashCounter(i)
+
+	key, err := ecdh.X25519().GenerateKey(crand.Reader)
+	if err != nil {
+		cfg.t.Fatalf("counter %v key: %v", i, err)
+	}
+
+	cfg.mu.Lock()
+	cfg.counterSaved[i] = nil
+	cfg.counterKeys[i] = key
+	cfg.mu.Unlock()
+
+	for j := 0; j < cfg.nCounters; j++ {
+		if j != i && cfg.counters[j] != nil {
+			cfg.counters[j].ReplaceCounter(i, key.PublicKey())
+		}
+	}
+
+	cfg.startCounter(i)
+	cfg.connectCounter(i)
+}
+
 func (cfg *config) startVoter(i int) {
 	cfg.crashVoter(i)
 
@@ -185,14 +391,15 @@ func (cfg *config) startVoter(i int) {
 	// so that old crashed instance's ClientEnds can't send.
 	cfg.voterEndnames[i] = make([]string, cfg.nCounters)
 	for j := 0; j < cfg.nCounters; j++ {
-		cfg.voterEndnames[i][j] = randstring(20)
+		cfg.voterEndnames[i][j] = randstring(cfg.rand, 20)
 	}
 
 	// a fresh set of ClientEnds.
-	ends := make([]*labrpc.ClientEnd, cfg.nCounters)
+	ends := make([]Endpoint, cfg.nCounters)
 	for j := 0; j < cfg.nCounters; j++ {
 		ends[j] = cfg.net.MakeEnd(cfg.voterEndnames[i][j])
 		cfg.net.Connect(cfg.voterEndnames[i][j], j)
+		cfg.net.SetOwner(cfg.voterEndnames[i][j], voterNode(i))
 	}
 
 	cfg.mu.Lock()
@@ -200,12 +407,12 @@ func (cfg *config) startVoter(i int) {
 	if cfg.saved[i] != nil {
 		cfg.saved[i] = cfg.saved[i].copy()
 	} else {
-		cfg.saved[i] = &VoterPersister{}
+		cfg.saved[i] = &MemPersister{}
 	}
 
 	cfg.mu.Unlock()
 
-	vt := MakeVoter(ends, cfg.votes[i], cfg.threshold, cfg.saved[i])
+	vt := MakeVoter(ends, cfg.counterPublicKeys(), cfg.credentials[i], cfg.candidates, cfg.votes[i], cfg.threshold, cfg.saved[i])
 
 	cfg.mu.Lock()
 	cfg.voters[i] = vt
@@ -321,6 +528,18 @@ func (cfg *config) disconnectVoter(i int) {
 	}
 }
 
+// cut the link from voter i to counter j only, until
+// cfg.net.Heal().
+func (cfg *config) disconnectVoterFrom(i, j int) {
+	cfg.net.Cut(voterNode(i), j)
+}
+
+// voter i's node on the net, for cfg.net.Partition(); counter
+// i's is i, its servername.
+func voterNode(i int) string {
+	return fmt.Sprintf("voter-%v", i)
+}
+
 func (cfg *config) setunreliable(unrel bool) {
 	cfg.net.Reliable(!unrel)
 }
@@ -339,3 +558,191 @@ func (cfg *config) cleanup() {
 
 	cfg.net.Cleanup()
 }
+
+// a committee of replicated seats, each run by nReplicas
+// replicas that share the seat's key.
+type seatConfig struct {
+	mu          sync.Mutex
+	t           *testing.T
+	net         *labrpc.Network
+	rand        *rand.Rand // end names and ids, seeded like net
+	nSeats      int
+	nReplicas   int
+	nVoters     int
+	threshold   int
+	candidates  []string
+	registry    *Registry
+	seatKeys    []*ecdh.PrivateKey
+	credentials []Credential
+	deadlines   Deadlines
+	votes       []int
+	replicas    [][]*SeatReplica
+	raftSaved   [][]*raft.Persister
+	voters      []*Voter
+}
+
+func makeSeatConfig(t *testing.T, nSeats, nReplicas, nVoters, threshold int, candidates []string, votes []int, deadlines Deadlines) *seatConfig {
+	cfg := &seatConfig{}
+	cfg.t = t
+	cfg.net, cfg.rand = makeNetwork(t)
+	cfg.nSeats = nSeats
+	cfg.nReplicas = nReplicas
+	cfg.nVoters = nVoters
+	cfg.threshold = threshold
+	cfg.candidates = candidates
+	cfg.deadlines = deadlines
+	cfg.votes = votes
+	cfg.registry = MakeRegistry(cfg.randstring(8))
+	cfg.seatKeys = make([]*ecdh.PrivateKey, nSeats)
+	for s := 0; s < nSeats; s++ {
+		key, err := ecdh.X25519().GenerateKey(crand.Reader)
+		if err != nil {
+			t.Fatalf("seat %v key: %v", s, err)
+		}
+		cfg.seatKeys[s] = key
+	}
+	cfg.credentials = make([]Credential, nVoters)
+	for i := 0; i < nVoters; i++ {
+		credential, err := cfg.registry.Enroll(randVoterId(cfg.rand))
+		if err != nil {
+			t.Fatalf("enroll voter %v: %v", i, err)
+		}
+		cfg.credentials[i] = credential
+	}
+
+	cfg.replicas = make([][]*SeatReplica, nSeats)
+	cfg.raftSaved = make([][]*raft.Persister, nSeats)
+	for s := 0; s < nSeats; s++ {
+		cfg.replicas[s] = make([]*SeatReplica, nReplicas)
+		cfg.raftSaved[s] = make([]*raft.Persister, nReplicas)
+		for r := 0; r < nReplicas; r++ {
+			cfg.startReplica(s, r)
+		}
+	}
+
+	cfg.voters = make([]*Voter, nVoters)
+	for i := 0; i < nVoters; i++ {
+		cfg.voters[i] = MakeVoter(cfg.seatEnds(voterNode(i)), cfg.seatPublicKeys(), cfg.credentials[i], candidates, votes[i], threshold, &MemPersister{})
+	}
+
+	return cfg
+}
+
+// a random string from the seed. seat ends are also made
+// whenever a replica starts running its seat's counter.
+func (cfg *seatConfig) randstring(n int) string {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+
+	return randstring(cfg.rand, n)
+}
+
+func replicaName(s, r int) string {
+	return fmt.Sprintf("seat-%v-%v", s, r)
+}
+
+func (cfg *seatConfig) seatPublicKeys() []*ecdh.PublicKey {
+	keys := make([]*ecdh.PublicKey, cfg.nSeats)
+	for s, key := range cfg.seatKeys {
+		keys[s] = key.PublicKey()
+	}
+	return keys
+}
+
+// a fresh SeatEnd to every seat, for owner, e.g. seat s's counter.
+func (cfg *seatConfig) seatEnds(owner interface{}) []Endpoint {
+	ends := make([]Endpoint, cfg.nSeats)
+	for s := 0; s < cfg.nSeats; s++ {
+		replicas := make([]*labrpc.ClientEnd, cfg.nReplicas)
+		for r := 0; r < cfg.nReplicas; r++ {
+			endname := cfg.randstring(20)
+			replicas[r] = cfg.net.MakeEnd(endname)
+			cfg.net.Connect(endname, replicaName(s, r))
+			cfg.net.Enable(endname, true)
+			cfg.net.SetOwner(endname, owner)
+		}
+		ends[s] = MakeSeatEnd(replicas)
+	}
+	return ends
+}
+
+func (cfg *seatConfig) startReplica(s, r int) {
+	cfg.crashReplica(s, r)
+
+	peers := make([]*labrpc.ClientEnd, cfg.nReplicas)
+	for j := 0; j < cfg.nReplicas; j++ {
+		endname := cfg.randstring(20)
+		peers[j] = cfg.net.MakeEnd(endname)
+		cfg.net.Connect(endname, replicaName(s, j))
+		cfg.net.Enable(endname, true)
+	}
+
+	cfg.mu.Lock()
+	if cfg.raftSaved[s][r] != nil {
+		cfg.raftSaved[s][r] = cfg.raftSaved[s][r].Copy()
+	} else {
+		cfg.raftSaved[s][r] = raft.MakePersister()
+	}
+	persister := cfg.raftSaved[s][r]
+	cfg.mu.Unlock()
+
+	sr := MakeSeatReplica(peers, r, persister, func(p Persister) *VoteCounter {
+		vc := MakeVoteCounter(cfg.seatEnds(s), s, cfg.seatKeys[s], cfg.seatPublicKeys(), p)
+		vc.CreateElection(cfg.registry, cfg.candidates, cfg.threshold, cfg.deadlines)
+		return vc
+	})
+
+	cfg.mu.Lock()
+	cfg.replicas[s][r] = sr
+	cfg.mu.Unlock()
+
+	srv := labrpc.MakeServer()
+	srv.AddService(labrpc.MakeService(sr.rf))
+	srv.AddService(labrpc.MakeService(sr))
+	cfg.net.AddServer(replicaName(s, r), srv)
+}
+
+// stop replica r of seat s, along with its disk.
+func (cfg *seatConfig) crashReplica(s, r int) {
+	cfg.net.DeleteServer(replicaName(s, r))
+
+	cfg.mu.Lock()
+	sr := cfg.replicas[s][r]
+	cfg.replicas[s][r] = nil
+	cfg.raftSaved[s][r] = nil
+	cfg.mu.Unlock()
+
+	if sr != nil {
+		sr.Kill()
+	}
+}
+
+// the replica that runs seat s's counter, if any.
+func (cfg *seatConfig) leader(s int) (int, *VoteCounter) {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+
+	for r, sr := range cfg.replicas[s] {
+		if sr != nil {
+			if vc, ok := sr.Counter(); ok {
+				return r, vc
+			}
+		}
+	}
+	return -1, nil
+}
+
+func (cfg *seatConfig) cleanup() {
+	for s := range cfg.replicas {
+		for _, sr := range cfg.replicas[s] {
+			if sr != nil {
+				sr.Kill()
+			}
+		}
+	}
+	for _, vt := range cfg.voters {
+		vt.Kill()
+	}
+
+	cfg.net.Cleanup()
+}
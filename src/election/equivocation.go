@@ -0,0 +1,165 @@
+package election
+
+import (
+	"reflect"
+	"time"
+)
+
+//
+// A voter that signs two ballots with different commitments has
+// tried to cast two different votes. Both signed ballots are the
+// evidence, which any counter can check against the registry, so
+// the counter that catches it passes it on to the rest of the
+// committee, and every counter leaves that voter out of the common
+// voter set. Evidence that arrives after the voter sets have been
+// agreed on is kept, but no longer changes the tally.
+//
+// A voter that gives different counters different ballots is
+// caught when the counters exchange their voter sets, which carry
+// the signed ballots behind them. Nothing but a second signed
+// ballot counts against a voter, so a faulty counter can't get an
+// honest voter left out; ballots that don't check out are ignored.
+//
+
+type Equivocation struct {
+	First  SignedBallot
+	Second SignedBallot
+}
+
+type ReportEquivocationArgs struct {
+	ElectionId string
+	Evidence   Equivocation
+}
+
+type ReportEquivocationReply struct {
+	Success bool
+}
+
+//
+// Whether a ballot's commitments are the ones we already have for
+// the voter. Its (verified) shares then are the ones we were given
+// too, although refreshes may since have changed ours.
+//
+func (vc *electionCounter) sameBallot(id int64, commitments [][]int64) bool {
+	return reflect.DeepEqual(vc.commitments[id], commitments)
+}
+
+//
+// Whether the evidence shows that a registered voter signed two
+// ballots with different commitments
+//
+func (vc *electionCounter) validEquivocation(evidence *Equivocation) bool {
+	return evidence.First.VoterId == evidence.Second.VoterId &&
+		vc.registry.authenticate(&evidence.First) == OK &&
+		vc.registry.authenticate(&evidence.Second) == OK &&
+		commitmentDigest(evidence.First.Commitments) != commitmentDigest(evidence.Second.Commitments)
+}
+
+//
+// Record that a voter equivocated, and tell the other counters
+//
+func (vc *electionCounter) addEquivocation(evidence Equivocation) {
+	id := evidence.First.VoterId
+	if _, ok := vc.equivocations[id]; ok {
+		return
+	}
+
+	vc.equivocations[id] = evidence
+	go vc.sendEquivocation(id)
+}
+
+//
+// Send the evidence against a voter to the other vote counters
+//
+func (vc *electionCounter) sendEquivocation(id int64) {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+
+	if vc.reportSuccess[id] == nil {
+		vc.reportSuccess[id] = make(map[int]bool)
+	}
+
+	for !vc.killed() && len(vc.reportSuccess[id]) < len(vc.committeeMembers)-1 {
+		for i := 0; i < len(vc.committeeMembers); i++ {
+			if i != vc.me && !vc.reportSuccess[id][i] {
+				go func(counter int, evidence Equivocation) {
+					args := ReportEquivocationArgs{vc.registry.ElectionId, evidence}
+					reply := ReportEquivocationReply{}
+					vc.sendReportEquivocation(counter, &args, &reply)
+				}(i, vc.equivocations[id])
+			}
+		}
+
+		vc.mu.Unlock()
+		time.Sleep(time.Duration(receiveTotalsTimeout) * time.Millisecond)
+		vc.mu.Lock()
+	}
+}
+
+func (vc *electionCounter) sendReportEquivocation(counter int, args *ReportEquivocationArgs, reply *ReportEquivocationReply) {
+	ok := vc.committeeMembers[counter].CallContext(vc.ctx, "VoteCounter.ReportEquivocation", args, reply) == nil
+
+	if ok && reply.Success {
+		vc.mu.Lock()
+		vc.reportSuccess[args.Evidence.First.VoterId][counter] = true
+		vc.mu.Unlock()
+	}
+}
+
+//
+// Get the evidence against a voter from another vote counter
+//
+func (vc *electionCounter) ReportEquivocation(args *ReportEquivocationArgs, reply *ReportEquivocationReply) {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+
+	if !vc.validEquivocation(&args.Evidence) {
+		reply.Success = false
+		return
+	}
+
+	vc.addEquivocation(args.Evidence)
+	vc.persist()
+	reply.Success = true
+}
+
+//
+// Check a signed ballot from another counter's voter set against
+// the one we hold of the voter, or the first one another counter
+// sent us if we hold none
+//
+func (vc *electionCounter) checkExchangedBallot(ballot *SignedBallot) {
+	if vc.registry.authenticate(ballot) != OK {
+		return
+	}
+
+	first, ok := vc.ballots[ballot.VoterId]
+	if !ok {
+		first, ok = vc.exchanged[ballot.VoterId]
+	}
+	if !ok {
+		vc.exchanged[ballot.VoterId] = *ballot
+		return
+	}
+
+	evidence := Equivocation{first, *ballot}
+	if vc.validEquivocation(&evidence) {
+		vc.addEquivocation(evidence)
+	}
+}
+
+//
+// Leave the voters that equivocated out of every voter set
+//
+func (vc *electionCounter) dropEquivocators(voterSets map[int][]int64) map[int][]int64 {
+	honest := make(map[int][]int64)
+	for index, voters := range voterSets {
+		honest[index] = make([]int64, 0, len(voters))
+		for _, id := range voters {
+			if _, ok := vc.equivocations[id]; !ok {
+				honest[index] = append(honest[index], id)
+			}
+		}
+	}
+	return honest
+}
@@ -0,0 +1,177 @@
+package election
+
+import (
+	"time"
+
+	"6.824/labrpc"
+)
+
+//
+// Failure detection. Every counter sends a heartbeat to each of the
+// others every heartbeatInterval, and keeps a view of the committee:
+// a counter it hasn't heard from, by heartbeat or reply, for
+// suspectTimeout is suspected, and for deadTimeout is taken to be
+// dead. Hearing from it again makes it alive. The view is soft
+// state, and isn't persisted.
+//
+// The agreement on the voter sets and the result don't wait for
+// the voter sets and totals of dead counters, nor do refreshes wait
+// for their deals, and the send loops stop sending to them until
+// they are heard from again.
+//
+
+const heartbeatInterval int32 = 100
+const suspectTimeout int32 = 500
+const deadTimeout int32 = 1500
+
+type Liveness int
+
+const (
+	Alive     Liveness = iota // heard from recently
+	Suspected                 // missed a few heartbeats
+	Dead                      // silent for deadTimeout
+)
+
+func (l Liveness) String() string {
+	switch l {
+	case Alive:
+		return "Alive"
+	case Suspected:
+		return "Suspected"
+	case Dead:
+		return "Dead"
+	}
+	return "Unknown"
+}
+
+//
+// What a counter knows about one of its peers
+//
+type PeerHealth struct {
+	Status    Liveness
+	LastHeard time.Time // the last heartbeat or reply from the peer
+	Since     time.Time // when the peer got its status
+}
+
+type HeartbeatArgs struct {
+	Index int // the sender's index+1
+}
+
+type HeartbeatReply struct {
+	Success bool
+}
+
+//
+// Returns our view of every other counter's health, by counter
+//
+func (vc *VoteCounter) Health() map[int]PeerHealth {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+
+	health := make(map[int]PeerHealth)
+	for counter, h := range vc.health {
+		health[counter] = *h
+	}
+	return health
+}
+
+//
+// Whether we take the counter to be dead
+//
+func (vc *VoteCounter) peerDead(counter int) bool {
+	h, ok := vc.health[counter]
+	return ok && h.Status == Dead
+}
+
+//
+// Send heartbeats to the other counters, and age our view of them
+//
+func (vc *VoteCounter) heartbeatLoop() {
+	for !vc.killed() {
+		vc.mu.Lock()
+		vc.updateHealth(time.Now())
+		vc.mu.Unlock()
+
+		for i := 0; i < len(vc.committeeMembers); i++ {
+			if i != vc.me {
+				go vc.sendHeartbeat(i)
+			}
+		}
+
+		time.Sleep(time.Duration(heartbeatInterval) * time.Millisecond)
+	}
+}
+
+func (vc *VoteCounter) sendHeartbeat(counter int) {
+	args := HeartbeatArgs{vc.me + 1}
+	reply := HeartbeatReply{}
+	ok := vc.committeeMembers[counter].CallContext(vc.ctx, "VoteCounter.Heartbeat", &args, &reply) == nil
+
+	if ok && reply.Success {
+		vc.mu.Lock()
+		vc.heard(counter, time.Now())
+		vc.mu.Unlock()
+	}
+}
+
+//
+// Get a heartbeat from another counter
+//
+func (vc *VoteCounter) Heartbeat(caller labrpc.Caller, args *HeartbeatArgs, reply *HeartbeatReply) {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+
+	if args.Index < 1 || args.Index > len(vc.committeeMembers) || !callerIs(caller, args.Index-1) {
+		reply.Success = false
+		return
+	}
+
+	vc.heard(args.Index-1, time.Now())
+	reply.Success = true
+}
+
+func (vc *VoteCounter) heard(counter int, now time.Time) {
+	h, ok := vc.health[counter]
+	if !ok {
+		return
+	}
+
+	h.LastHeard = now
+	if h.Status != Alive {
+		h.Status = Alive
+		h.Since = now
+	}
+}
+
+//
+// Suspect, or give up on, the counters we haven't heard from in a
+// while, and stop waiting for the ones that died
+//
+func (vc *VoteCounter) updateHealth(now time.Time) {
+	died := false
+	for _, h := range vc.health {
+		silent := now.Sub(h.LastHeard)
+		status := Alive
+		if silent >= time.Duration(deadTimeout)*time.Millisecond {
+			status = Dead
+		} else if silent >= time.Duration(suspectTimeout)*time.Millisecond {
+			status = Suspected
+		}
+
+		if status != h.Status {
+			died = died || status == Dead
+			h.Status = status
+			h.Since = now
+		}
+	}
+
+	if died {
+		for _, el := range vc.elections {
+			el.checkRoll()
+			el.checkVoterSets()
+			el.checkResult()
+			el.applyRefreshes()
+		}
+		vc.persist()
+	}
+}
@@ -0,0 +1,73 @@
+package election
+
+import (
+	"fmt"
+
+	"6.824/labrpc"
+)
+
+//
+// Identities of the committee and the voters when they talk over
+// mutual TLS (see labrpc/tls.go and main/). Counter i holds a
+// certificate for counter-<i>, and a voter one for voter-<id>, all
+// from the same CA. Voters and counters only send shares to the
+// identity of the counter they mean, and a counter only takes the
+// RPCs that counters make to each other, like CountTotal, from one
+// of the committee's identities, so that no one else can pass for
+// a counter, e.g. to send made-up partial sums. Nor can one
+// counter pass for another: a counter's RPC to another names it by
+// its index, and must come from that counter's identity.
+//
+
+// the RPCs that only counters make
+var committeeRPCs = map[string]bool{
+	"VoteCounter.CountTotal":         true,
+	"VoteCounter.ExchangeVoters":     true,
+	"VoteCounter.ExchangeRoll":       true,
+	"VoteCounter.ReportEquivocation": true,
+	"VoteCounter.Refresh":            true,
+	"VoteCounter.FixDealers":         true,
+	"VoteCounter.Reshare":            true,
+	"VoteCounter.Heartbeat":          true,
+}
+
+func CounterIdentity(counter int) string {
+	return fmt.Sprintf("counter-%d", counter)
+}
+
+func VoterIdentity(voterId int64) string {
+	return fmt.Sprintf("voter-%d", voterId)
+}
+
+//
+// Whether an RPC from caller (see labrpc.Caller) may be from counter:
+// its certificate's identity over mutual TLS, or, on a test network,
+// the node that owns its end. A caller no one vouches for, as over
+// plain TCP, may be anyone.
+//
+func callerIs(caller labrpc.Caller, counter int) bool {
+	switch id := caller.(type) {
+	case nil:
+		return true
+	case int:
+		return id == counter
+	case string:
+		return id == CounterIdentity(counter)
+	}
+	return false
+}
+
+//
+// Decides who may call what on a counter of a committee of
+// nCounters, for labrpc.ListenTLS()
+//
+func CommitteeAuthorizer(nCounters int) labrpc.Authorizer {
+	counters := make(map[string]bool)
+	for i := 0; i < nCounters; i++ {
+		counters[CounterIdentity(i)] = true
+	}
+
+	return func(identity string, svcMeth string) bool {
+		return !committeeRPCs[svcMeth] || counters[identity]
+	}
+}
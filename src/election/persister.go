@@ -0,0 +1,54 @@
+package election
+
+import (
+	"log"
+	"os"
+	"sync"
+)
+
+//
+// A Persister that keeps its state in a file, for voters and
+// counters running as their own processes (see main/). The new
+// state is written to a temporary file and renamed over the old
+// one, so a crash leaves one or the other, never half of both.
+//
+type FilePersister struct {
+	mu   sync.Mutex
+	path string
+}
+
+func MakeFilePersister(path string) *FilePersister {
+	return &FilePersister{path: path}
+}
+
+func (fp *FilePersister) readPersistState() []byte {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+
+	data, err := os.ReadFile(fp.path)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+func (fp *FilePersister) writePersistState(data []byte) {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+
+	tmp := fp.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		log.Fatalf("FilePersister: %v\n", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		log.Fatalf("FilePersister: %v\n", err)
+	}
+	if err := f.Sync(); err != nil {
+		log.Fatalf("FilePersister: %v\n", err)
+	}
+	f.Close()
+	if err := os.Rename(tmp, fp.path); err != nil {
+		log.Fatalf("FilePersister: %v\n", err)
+	}
+}
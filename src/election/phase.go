@@ -0,0 +1,67 @@
+package election
+
+import (
+	"time"
+)
+
+//
+// Phases of an election, as seen by a vote counter:
+// Registering -> AgreeingRoll -> VotingOpen -> VotingClosed ->
+// ExchangingTotals -> ResultFinal. Elections without a registration
+// window start out VotingOpen.
+//
+type Phase int
+
+const (
+	Registering      Phase = iota // taking registrations from the voters
+	AgreeingRoll                  // exchanging rolls with the committee
+	VotingOpen                    // taking ballots from the voters
+	VotingClosed                  // exchanging voter sets with the committee
+	ExchangingTotals              // sharing partial sums of the common voters
+	ResultFinal                   // the result has been reconstructed
+)
+
+func (p Phase) String() string {
+	switch p {
+	case Registering:
+		return "Registering"
+	case AgreeingRoll:
+		return "AgreeingRoll"
+	case VotingOpen:
+		return "VotingOpen"
+	case VotingClosed:
+		return "VotingClosed"
+	case ExchangingTotals:
+		return "ExchangingTotals"
+	case ResultFinal:
+		return "ResultFinal"
+	}
+	return "Unknown"
+}
+
+//
+// How long each phase may last before the counter moves on
+//
+type Deadlines struct {
+	Registration time.Duration // registration closes this long after the election is created, none if 0
+	Voting       time.Duration // voting closes this long after it opens
+	Exchange     time.Duration // wait this long for every counter's roll and voter set
+	Refresh      time.Duration // refresh the shares this often while voting, never if 0
+}
+
+func DefaultDeadlines() Deadlines {
+	return Deadlines{
+		Voting:   time.Duration(votingTimeout) * time.Millisecond,
+		Exchange: time.Duration(exchangeTimeout) * time.Millisecond,
+	}
+}
+
+//
+// Returns the current phase of the election
+//
+func (vc *electionCounter) Phase() Phase {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+
+	return vc.phase
+}
@@ -0,0 +1,203 @@
+package election
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"math/big"
+)
+
+//
+// Non-interactive zero-knowledge proofs that a ballot is valid,
+// i.e. that the constant terms of the voter's polynomials form a
+// one-hot vector. For each candidate, C = g^v h^r is the commitment
+// to the constant term, and the voter proves that
+//
+// - v is 0 or 1: a disjunctive Chaum-Pedersen proof that it knows
+//   log_h C or log_h (C / g), without telling which one
+// - the v's add up to 1: a Schnorr proof that it knows
+//   log_h (prod C / g)
+//
+// Both are made non-interactive with Fiat-Shamir, hashing the
+// voter id and all of the commitments into every challenge.
+//
+
+type BitProof struct {
+	A0, A1 int64 // first messages of the v = 0 and v = 1 branches
+	E0, E1 int64 // challenges, E0 + E1 = hash
+	Z0, Z1 int64 // responses
+}
+
+type BallotProof struct {
+	Bits []BitProof // one per candidate
+	SumA int64      // first message of the sum proof
+	SumZ int64      // response of the sum proof
+}
+
+func randomExponent() *big.Int {
+	x, _ := rand.Int(rand.Reader, bigField)
+	return x
+}
+
+func mulP(a, b *big.Int) *big.Int {
+	x := new(big.Int).Mul(a, b)
+	return x.Mod(x, bigP)
+}
+
+func expP(base, exp *big.Int) *big.Int {
+	return new(big.Int).Exp(base, exp, bigP)
+}
+
+func invP(a *big.Int) *big.Int {
+	return new(big.Int).ModInverse(a, bigP)
+}
+
+//
+// Fiat-Shamir challenge: hash of the statement and the
+// prover's first messages, as an exponent mod field
+//
+func challenge(voterId int64, commitments [][]int64, values ...int64) *big.Int {
+	h := sha256.New()
+	buf := make([]byte, 8)
+	h.Write([]byte("distributed-evoting/ballot"))
+	binary.BigEndian.PutUint64(buf, uint64(voterId))
+	h.Write(buf)
+	for _, candidate := range commitments {
+		for _, c := range candidate {
+			binary.BigEndian.PutUint64(buf, uint64(c))
+			h.Write(buf)
+		}
+	}
+	for _, v := range values {
+		binary.BigEndian.PutUint64(buf, uint64(v))
+		h.Write(buf)
+	}
+
+	e := new(big.Int).SetBytes(h.Sum(nil))
+	return e.Mod(e, bigField)
+}
+
+//
+// Prove that the committed secrets (with openings r, so that
+// commitments[c][0] = g^secrets[c] h^r[c]) are a one-hot vector.
+// The proof only verifies if they really are.
+//
+func proveBallot(voterId int64, secrets, openings []int64, commitments [][]int64) BallotProof {
+	proof := BallotProof{}
+	proof.Bits = make([]BitProof, len(secrets))
+	gInv := invP(groupG)
+
+	for c := range secrets {
+		// statements: Y0 = h^r if v = 0, Y1 = h^r if v = 1
+		y := [2]*big.Int{big.NewInt(commitments[c][0]), nil}
+		y[1] = mulP(y[0], gInv)
+
+		known := 0
+		if secrets[c] == 1 {
+			known = 1
+		}
+		simulated := 1 - known
+
+		// simulate the branch we can't prove
+		var a, e, z [2]*big.Int
+		e[simulated] = randomExponent()
+		z[simulated] = randomExponent()
+		a[simulated] = mulP(expP(groupH, z[simulated]), invP(expP(y[simulated], e[simulated])))
+
+		// and commit for the one we can
+		w := randomExponent()
+		a[known] = expP(groupH, w)
+
+		hash := challenge(voterId, commitments, int64(c), a[0].Int64(), a[1].Int64())
+		e[known] = new(big.Int).Sub(hash, e[simulated])
+		e[known].Mod(e[known], bigField)
+		z[known] = new(big.Int).Mul(e[known], big.NewInt(openings[c]))
+		z[known].Add(z[known], w)
+		z[known].Mod(z[known], bigField)
+
+		proof.Bits[c] = BitProof{
+			a[0].Int64(), a[1].Int64(),
+			e[0].Int64(), e[1].Int64(),
+			z[0].Int64(), z[1].Int64(),
+		}
+	}
+
+	// prod C / g = h^(sum r)
+	sumR := big.NewInt(0)
+	for _, r := range openings {
+		sumR.Add(sumR, big.NewInt(r))
+	}
+	sumR.Mod(sumR, bigField)
+
+	w := randomExponent()
+	sumA := expP(groupH, w)
+	e := challenge(voterId, commitments, -1, sumA.Int64())
+	sumZ := new(big.Int).Mul(e, sumR)
+	sumZ.Add(sumZ, w)
+	sumZ.Mod(sumZ, bigField)
+
+	proof.SumA = sumA.Int64()
+	proof.SumZ = sumZ.Int64()
+
+	return proof
+}
+
+//
+// Whether x is in the order-field subgroup of Z_groupP*
+//
+func inGroup(x int64) bool {
+	if x <= 0 || x >= groupP {
+		return false
+	}
+	return expP(big.NewInt(x), bigField).Cmp(big.NewInt(1)) == 0
+}
+
+func inField(x int64) bool {
+	return x >= 0 && x < field
+}
+
+//
+// Check a ballot proof against the voter's commitments
+//
+func verifyBallot(voterId int64, commitments [][]int64, proof BallotProof) bool {
+	if len(proof.Bits) != len(commitments) || len(commitments) == 0 {
+		return false
+	}
+
+	gInv := invP(groupG)
+	product := big.NewInt(1)
+
+	for c, bit := range proof.Bits {
+		if len(commitments[c]) == 0 || !inGroup(commitments[c][0]) ||
+			!inGroup(bit.A0) || !inGroup(bit.A1) || !inField(bit.E0) ||
+			!inField(bit.E1) || !inField(bit.Z0) || !inField(bit.Z1) {
+			return false
+		}
+
+		y0 := big.NewInt(commitments[c][0])
+		y1 := mulP(y0, gInv)
+		product = mulP(product, y0)
+
+		// E0 + E1 must be the Fiat-Shamir challenge
+		hash := challenge(voterId, commitments, int64(c), bit.A0, bit.A1)
+		sum := big.NewInt(bit.E0 + bit.E1)
+		if sum.Mod(sum, bigField).Cmp(hash) != 0 {
+			return false
+		}
+
+		// h^Z = A Y^E on both branches
+		if expP(groupH, big.NewInt(bit.Z0)).Cmp(mulP(big.NewInt(bit.A0), expP(y0, big.NewInt(bit.E0)))) != 0 ||
+			expP(groupH, big.NewInt(bit.Z1)).Cmp(mulP(big.NewInt(bit.A1), expP(y1, big.NewInt(bit.E1)))) != 0 {
+			return false
+		}
+	}
+
+	if !inGroup(proof.SumA) || !inField(proof.SumZ) {
+		return false
+	}
+
+	y := mulP(product, gInv)
+	e := challenge(voterId, commitments, -1, proof.SumA)
+
+	return expP(groupH, big.NewInt(proof.SumZ)).Cmp(mulP(big.NewInt(proof.SumA), expP(y, e))) == 0
+}
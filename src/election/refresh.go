@@ -0,0 +1,553 @@
+package election
+
+import (
+	"crypto/rand"
+	"math/big"
+	"sort"
+	"time"
+)
+
+//
+// Proactive refresh of the shares. An election can stay open for
+// days, long enough for an attacker to break into threshold
+// counters one after the other. So every deadlines.Refresh, while
+// the voting is still going on, each counter deals a sharing of
+// zero for every voter it holds: random polynomials d and e with
+// d(0) = e(0) = 0, committed to as D_j = g^d_j h^e_j, so D_0 = 1.
+// Counter k gets (d(k), e(k)), sealed for it, and adds them to its
+// shares of the voter once the dealers of the next epoch are fixed
+// and it has their deals. The voter's polynomials get the sum of the
+// d's added, so the vote is unchanged, but shares from different
+// epochs no longer lie on the same polynomial, and shares stolen
+// before a refresh are useless after it.
+//
+// Every counter must add the same deals, so a crashed counter, whose
+// deal may have reached only some of us, can't just be left out by
+// whoever notices. The first counter we don't take to be dead fixes
+// the dealers of an epoch, once every counter it doesn't take to be
+// dead has dealt and at least threshold have, and sends them to the
+// others. A counter takes them only from a counter all of whose
+// predecessors it takes to be dead, and only the first ones it gets.
+//
+// The product of the D's is kept for every voter, so the refreshed
+// shares can still be checked against the voter's commitments times
+// it. Deals for a voter that hasn't reached us yet are added up, and
+// added to its shares when its ballot arrives, so that every counter
+// holding the voter applies the same deals.
+//
+// A counter that applies a new epoch after adding up its total
+// adds it up again, and totals are only ever combined with totals
+// from the same epoch.
+//
+// A counter's key stays the same from epoch to epoch, so shares
+// sealed for it would stay readable with a key stolen later on.
+// Of the ballots it opened, a counter keeps the signed ballot
+// without the sealed share (see SignedBallot), and deals are
+// dropped once applied. Ballots recorded off the wire, though,
+// can still be opened with the key of the counter they were for.
+//
+
+type RefreshArgs struct {
+	ElectionId  string
+	Epoch       int // the epoch this deal moves to
+	Dealer      int // index+1
+	Voters      []int64
+	Commitments [][][]int64   // Commitments[voter][candidate][coefficient]
+	Sealed      []SealedShare // each voter's sub-shares, sealed for the receiver
+}
+
+type RefreshReply struct {
+	Success bool
+}
+
+type FixDealersArgs struct {
+	ElectionId string
+	Epoch      int
+	Index      int   // the fixer's index+1
+	Dealers    []int // index+1, in order
+}
+
+type FixDealersReply struct {
+	Success bool
+}
+
+//
+// The sharings of zero added to a voter's shares so far: Share and
+// Blind until we hold the voter, and the product of their commitments
+//
+type zeroSum struct {
+	Share       []int64
+	Blind       []int64
+	Commitments [][]int64
+}
+
+//
+// Returns the refresh epoch of our shares
+//
+func (vc *electionCounter) Epoch() int {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+
+	return vc.epoch
+}
+
+//
+// Deal a refresh every deadlines.Refresh, until the voting closes
+//
+func (vc *electionCounter) refreshLoop() {
+	for !vc.killed() {
+		time.Sleep(vc.deadlines.Refresh)
+
+		vc.mu.Lock()
+		if vc.phase >= ExchangingTotals {
+			vc.mu.Unlock()
+			return
+		}
+		if !vc.recovering && vc.phase == VotingOpen {
+			vc.dealRefresh()
+		}
+		vc.mu.Unlock()
+	}
+}
+
+//
+// Deal sharings of zero for the next epoch to every counter,
+// unless we already have
+//
+func (vc *electionCounter) dealRefresh() {
+	epoch := vc.epoch + 1
+	if _, ok := vc.pendingDeals[epoch][vc.me+1]; ok {
+		return
+	}
+
+	nCandidates := len(vc.candidates)
+	n := len(vc.committeeMembers)
+	deals := make(map[int]RefreshArgs)
+	for i := 0; i < n; i++ {
+		deals[i] = RefreshArgs{vc.registry.ElectionId, epoch, vc.me + 1, []int64{}, [][][]int64{}, []SealedShare{}}
+	}
+
+	zero := big.NewInt(0)
+	for _, id := range voterIds(vc.votes) {
+		commitments := make([][]int64, nCandidates)
+		shares := make([][]int64, n)
+		blinds := make([][]int64, n)
+		for i := 0; i < n; i++ {
+			shares[i] = make([]int64, nCandidates)
+			blinds[i] = make([]int64, nCandidates)
+		}
+
+		for c := 0; c < nCandidates; c++ {
+			d, err1 := votingField.RandomPolynomial(zero, vc.threshold, rand.Reader)
+			e, err2 := votingField.RandomPolynomial(zero, vc.threshold, rand.Reader)
+			if err1 != nil || err2 != nil {
+				return
+			}
+
+			commitments[c] = make([]int64, vc.threshold)
+			for j := range commitments[c] {
+				commitments[c][j] = commit(d[j].Int64(), e[j].Int64())
+			}
+			for i := 0; i < n; i++ {
+				shares[i][c] = votingField.Eval(d, i+1).Int64()
+				blinds[i][c] = votingField.Eval(e, i+1).Int64()
+			}
+		}
+
+		for i := 0; i < n; i++ {
+			sealed, err := sealShare(vc.counterKeys[i], id, i+1, shares[i], blinds[i])
+			if err != nil {
+				return
+			}
+			deal := deals[i]
+			deal.Voters = append(deal.Voters, id)
+			deal.Commitments = append(deal.Commitments, commitments)
+			deal.Sealed = append(deal.Sealed, sealed)
+			deals[i] = deal
+		}
+	}
+
+	vc.addDeal(deals[vc.me])
+	delete(deals, vc.me)
+	vc.deals[epoch] = deals
+	vc.applyRefreshes()
+	vc.persist()
+
+	go vc.sendRefresh(epoch)
+}
+
+//
+// Send our deal for epoch to the counters that haven't taken it yet
+//
+func (vc *electionCounter) sendRefresh(epoch int) {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+
+	for !vc.killed() && len(vc.deals[epoch]) > 0 {
+		for counter, deal := range vc.deals[epoch] {
+			go func(counter int, args RefreshArgs) {
+				reply := RefreshReply{}
+				vc.sendRefreshDeal(counter, &args, &reply)
+			}(counter, deal)
+		}
+
+		vc.mu.Unlock()
+		time.Sleep(time.Duration(receiveTotalsTimeout) * time.Millisecond)
+		vc.mu.Lock()
+	}
+}
+
+func (vc *electionCounter) sendRefreshDeal(counter int, args *RefreshArgs, reply *RefreshReply) {
+	ok := vc.committeeMembers[counter].CallContext(vc.ctx, "VoteCounter.Refresh", args, reply) == nil
+
+	if ok && reply.Success {
+		vc.mu.Lock()
+		delete(vc.deals[args.Epoch], counter)
+		if len(vc.deals[args.Epoch]) == 0 {
+			delete(vc.deals, args.Epoch)
+		}
+		vc.mu.Unlock()
+	}
+}
+
+//
+// Get another counter's deal for an epoch
+//
+func (vc *electionCounter) Refresh(args *RefreshArgs, reply *RefreshReply) {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+
+	if args.Epoch <= vc.epoch {
+		// already applied, or superseded by our reshare
+		reply.Success = true
+		return
+	}
+
+	if !vc.validDeal(args) {
+		reply.Success = false
+		return
+	}
+
+	vc.addDeal(*args)
+	vc.applyRefreshes()
+	vc.persist()
+	reply.Success = true
+}
+
+//
+// Check that every voter's sub-shares in a deal for us open, and
+// lie on polynomials committed to with a zero constant term
+//
+func (vc *electionCounter) validDeal(args *RefreshArgs) bool {
+	nCandidates := len(vc.candidates)
+	if args.Dealer < 1 || args.Dealer > len(vc.committeeMembers) ||
+		len(args.Commitments) != len(args.Voters) || len(args.Sealed) != len(args.Voters) {
+		return false
+	}
+
+	for i, id := range args.Voters {
+		share, blind, ok := openShare(vc.key, id, vc.me+1, args.Sealed[i], nCandidates)
+		if !ok || !vc.validShares(share, blind, args.Commitments[i]) {
+			return false
+		}
+		for c := 0; c < nCandidates; c++ {
+			if args.Commitments[i][c][0] != 1 {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+//
+// Keep a deal until its epoch is applied. Only a dealer's first
+// deal for an epoch is kept.
+//
+func (vc *electionCounter) addDeal(deal RefreshArgs) {
+	if vc.pendingDeals[deal.Epoch] == nil {
+		vc.pendingDeals[deal.Epoch] = make(map[int]RefreshArgs)
+	}
+	if _, ok := vc.pendingDeals[deal.Epoch][deal.Dealer]; !ok {
+		vc.pendingDeals[deal.Epoch][deal.Dealer] = deal
+	}
+}
+
+//
+// Move on to the next epochs whose dealers are fixed and whose
+// deals are in, fixing the dealers ourselves if it's up to us, and
+// add our total up again if they changed our shares under it
+//
+func (vc *electionCounter) applyRefreshes() {
+	if vc.recovering {
+		// the deals wait for the shares we are rebuilding
+		return
+	}
+
+	_, hadTotal := vc.ownTotal()
+
+	applied := false
+	for {
+		epoch := vc.epoch + 1
+		if _, ok := vc.dealers[epoch]; !ok && vc.fixer() == vc.me && vc.allDealt(epoch) {
+			vc.fixDealers(epoch)
+		}
+
+		dealers, ok := vc.dealers[epoch]
+		if !ok || !vc.haveDeals(epoch, dealers) {
+			break
+		}
+		for _, dealer := range dealers {
+			vc.applyDeal(vc.pendingDeals[epoch][dealer])
+		}
+		delete(vc.pendingDeals, epoch)
+		delete(vc.dealers, epoch)
+		vc.epoch++
+		applied = true
+	}
+
+	if applied && hadTotal && vc.result == nil {
+		vc.submissionSuccess = make(map[int]bool)
+		vc.addCommonVotes()
+	}
+}
+
+//
+// The counter that fixes the dealers: the first one we don't take
+// to be dead, which may be us
+//
+func (vc *electionCounter) fixer() int {
+	for i := range vc.committeeMembers {
+		if !vc.peerDead(i) {
+			return i
+		}
+	}
+	return vc.me
+}
+
+//
+// Whether every counter we don't take to be dead has dealt for
+// epoch, and at least threshold have
+//
+func (vc *electionCounter) allDealt(epoch int) bool {
+	for i := range vc.committeeMembers {
+		if _, ok := vc.pendingDeals[epoch][i+1]; !ok && !vc.peerDead(i) {
+			return false
+		}
+	}
+	return len(vc.pendingDeals[epoch]) >= vc.threshold
+}
+
+func (vc *electionCounter) haveDeals(epoch int, dealers []int) bool {
+	for _, dealer := range dealers {
+		if _, ok := vc.pendingDeals[epoch][dealer]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+//
+// Fix the dealers of epoch to those whose deals we have, and send
+// them to the other counters
+//
+func (vc *electionCounter) fixDealers(epoch int) {
+	dealers := make([]int, 0, len(vc.pendingDeals[epoch]))
+	for dealer := range vc.pendingDeals[epoch] {
+		dealers = append(dealers, dealer)
+	}
+	sort.Ints(dealers)
+	vc.dealers[epoch] = dealers
+
+	fixes := make(map[int]FixDealersArgs)
+	for i := range vc.committeeMembers {
+		if i != vc.me {
+			fixes[i] = FixDealersArgs{vc.registry.ElectionId, epoch, vc.me + 1, dealers}
+		}
+	}
+	vc.fixes[epoch] = fixes
+
+	go vc.sendFixes(epoch)
+}
+
+//
+// Send our fix of epoch's dealers to the counters that haven't
+// taken it yet
+//
+func (vc *electionCounter) sendFixes(epoch int) {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+
+	for !vc.killed() && len(vc.fixes[epoch]) > 0 {
+		for counter, fix := range vc.fixes[epoch] {
+			go func(counter int, args FixDealersArgs) {
+				reply := FixDealersReply{}
+				vc.sendFix(counter, &args, &reply)
+			}(counter, fix)
+		}
+
+		vc.mu.Unlock()
+		time.Sleep(time.Duration(receiveTotalsTimeout) * time.Millisecond)
+		vc.mu.Lock()
+	}
+}
+
+func (vc *electionCounter) sendFix(counter int, args *FixDealersArgs, reply *FixDealersReply) {
+	ok := vc.committeeMembers[counter].CallContext(vc.ctx, "VoteCounter.FixDealers", args, reply) == nil
+
+	if ok && reply.Success {
+		vc.mu.Lock()
+		delete(vc.fixes[args.Epoch], counter)
+		if len(vc.fixes[args.Epoch]) == 0 {
+			delete(vc.fixes, args.Epoch)
+		}
+		vc.mu.Unlock()
+	}
+}
+
+//
+// Get the dealers of an epoch from the counter that fixed them
+//
+func (vc *electionCounter) FixDealers(args *FixDealersArgs, reply *FixDealersReply) {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+
+	if args.Epoch <= vc.epoch {
+		reply.Success = true
+		return
+	}
+
+	if !vc.validFix(args) {
+		reply.Success = false
+		return
+	}
+
+	if _, ok := vc.dealers[args.Epoch]; !ok {
+		vc.dealers[args.Epoch] = append([]int(nil), args.Dealers...)
+		vc.applyRefreshes()
+		vc.persist()
+	}
+	reply.Success = true
+}
+
+//
+// Check that a fix comes from a counter that may fix the dealers,
+// and names at least threshold of them, in order
+//
+func (vc *electionCounter) validFix(args *FixDealersArgs) bool {
+	n := len(vc.committeeMembers)
+	if args.Index < 1 || args.Index > n || len(args.Dealers) < vc.threshold {
+		return false
+	}
+	for i := 0; i < args.Index-1; i++ {
+		if i == vc.me || !vc.peerDead(i) {
+			return false
+		}
+	}
+
+	for i, dealer := range args.Dealers {
+		if dealer < 1 || dealer > n || (i > 0 && dealer <= args.Dealers[i-1]) {
+			return false
+		}
+	}
+	return true
+}
+
+//
+// Add a (checked) deal's sub-shares to our shares of its voters
+//
+func (vc *electionCounter) applyDeal(deal RefreshArgs) {
+	nCandidates := len(vc.candidates)
+	for i, id := range deal.Voters {
+		share, blind, ok := openShare(vc.key, id, vc.me+1, deal.Sealed[i], nCandidates)
+		if !ok {
+			continue
+		}
+
+		zs := vc.zeroSum(id)
+		vote, held := vc.votes[id]
+		voteBlind := vc.blinds[id]
+		if !held {
+			vote, voteBlind = zs.Share, zs.Blind
+		}
+
+		for c := 0; c < nCandidates; c++ {
+			vote[c] = fieldAdd(vote[c], share[c])
+			voteBlind[c] = fieldAdd(voteBlind[c], blind[c])
+			for j, d := range deal.Commitments[i][c] {
+				zs.Commitments[c][j] = mulGroup(zs.Commitments[c][j], d)
+			}
+		}
+	}
+}
+
+//
+// The sharings of zero added to a voter so far, starting from none
+//
+func (vc *electionCounter) zeroSum(id int64) *zeroSum {
+	if zs, ok := vc.zeroSums[id]; ok {
+		return zs
+	}
+
+	nCandidates := len(vc.candidates)
+	zs := &zeroSum{make([]int64, nCandidates), make([]int64, nCandidates), make([][]int64, nCandidates)}
+	for c := range zs.Commitments {
+		zs.Commitments[c] = make([]int64, vc.threshold)
+		for j := range zs.Commitments[c] {
+			zs.Commitments[c][j] = 1
+		}
+	}
+	vc.zeroSums[id] = zs
+	return zs
+}
+
+//
+// Add the deals we got for a voter before its ballot to its shares
+//
+func (vc *electionCounter) catchUp(id int64) {
+	zs, ok := vc.zeroSums[id]
+	if !ok {
+		return
+	}
+
+	for c := range vc.votes[id] {
+		vc.votes[id][c] = fieldAdd(vc.votes[id][c], zs.Share[c])
+		vc.blinds[id][c] = fieldAdd(vc.blinds[id][c], zs.Blind[c])
+		zs.Share[c] = 0
+		zs.Blind[c] = 0
+	}
+}
+
+//
+// The commitments to a voter's refreshed polynomials
+//
+func (vc *electionCounter) currentCommitments(id int64) [][]int64 {
+	zs, ok := vc.zeroSums[id]
+	if !ok {
+		return vc.commitments[id]
+	}
+	return mulCommitments(vc.commitments[id], zs.Commitments)
+}
+
+func mulCommitments(a, b [][]int64) [][]int64 {
+	if len(a) != len(b) {
+		return nil
+	}
+
+	product := make([][]int64, len(a))
+	for c := range a {
+		if len(a[c]) != len(b[c]) {
+			return nil
+		}
+		product[c] = make([]int64, len(a[c]))
+		for j := range a[c] {
+			product[c][j] = mulGroup(a[c][j], b[c][j])
+		}
+	}
+	return product
+}
+
+func mulGroup(a, b int64) int64 {
+	product := new(big.Int).Mul(big.NewInt(a), big.NewInt(b))
+	return product.Mod(product, bigP).Int64()
+}
@@ -0,0 +1,282 @@
+package election
+
+import (
+	"crypto/ed25519"
+	"time"
+)
+
+//
+// Voter registration. An election created with a registration
+// window (Deadlines.Registration) starts out Registering: voters
+// enroll with every counter through the Register RPC, proving
+// that they hold the key they register. When the window closes,
+// the counters exchange their rolls, and agree on the final roll
+// the same way as on the voter sets: once every counter that isn't
+// dead sent its roll, or once the exchange deadline has passed, as
+// long as threshold did. A voter is on the final roll if at least
+// threshold of the rolls have it, and all of them with the same
+// key, so a counter that missed some registrations, e.g. because
+// it was being replaced, learns them from the others. A roll
+// carries each voter's signature from its registration, so that a
+// counter can't put keys on it that no one registered. Voting then
+// opens, for the voters on the roll only, and the quorum of the
+// result is computed from the roll's size.
+//
+// Who may register is up to whoever runs the election, who lists
+// the eligible voter ids in the registry (see Registry.Allow). A
+// counter takes a registration, or a voter on another counter's
+// roll, only for one of them, and the counters make sure that they
+// agree on a single key for each voter.
+//
+
+type RegisterArgs struct {
+	ElectionId string
+	VoterId    int64
+	Key        ed25519.PublicKey
+	Signature  []byte // by Key, over the election id, VoterId and Key
+}
+
+type RegisterReply struct {
+	Success bool
+	Err     Err
+}
+
+type ExchangeRollArgs struct {
+	ElectionId string
+	Index      int
+	Voters     []int64
+	Keys       [][]byte // the public key of each voter
+	Signatures [][]byte // each voter's RegisterArgs.Signature
+}
+
+type ExchangeRollReply struct {
+	Success bool
+}
+
+//
+// The voters that at least threshold of the rolls have, with the
+// key that all of them agree on. rolls[index] maps voter ids to
+// (string) public keys.
+//
+func agreeRoll(rolls map[int]map[int64]string, threshold int) map[int64]string {
+	seen := make(map[int64]int)
+	keys := make(map[int64]string)
+	conflicting := make(map[int64]bool)
+	for _, roll := range rolls {
+		for id, key := range roll {
+			if k, ok := keys[id]; ok && k != key {
+				conflicting[id] = true
+			}
+			keys[id] = key
+			seen[id]++
+		}
+	}
+
+	roll := make(map[int64]string)
+	for id, n := range seen {
+		if n >= threshold && !conflicting[id] {
+			roll[id] = keys[id]
+		}
+	}
+	return roll
+}
+
+//
+// Enroll a voter, while registration is open
+//
+func (vc *electionCounter) Register(args *RegisterArgs, reply *RegisterReply) {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+
+	if !vc.registry.Eligible[args.VoterId] {
+		reply.Success = false
+		reply.Err = ErrNotEligible
+		return
+	}
+
+	if len(args.Key) != ed25519.PublicKeySize ||
+		!ed25519.Verify(args.Key, registrationDigest(vc.registry.ElectionId, args.VoterId, args.Key), args.Signature) {
+		reply.Success = false
+		reply.Err = ErrInvalidSignature
+		return
+	}
+
+	if key, ok := vc.registry.Voters[args.VoterId]; ok {
+		if !key.Equal(args.Key) {
+			reply.Success = false
+			reply.Err = ErrAlreadyRegistered
+			return
+		}
+		// a retry of the registration we already have
+		reply.Success = true
+		reply.Err = OK
+		return
+	}
+
+	if vc.phase != Registering {
+		reply.Success = false
+		reply.Err = ErrRegistrationClosed
+		return
+	}
+
+	vc.registry.Voters[args.VoterId] = append(ed25519.PublicKey(nil), args.Key...)
+	vc.registrations[args.VoterId] = append([]byte(nil), args.Signature...)
+	vc.nVoters = len(vc.registry.Voters)
+
+	vc.persist()
+	reply.Success = true
+	reply.Err = OK
+}
+
+//
+// Close the registration once its deadline has passed
+//
+func (vc *electionCounter) registrationDeadline() {
+	time.Sleep(vc.deadlines.Registration)
+
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+
+	if !vc.killed() && vc.phase == Registering {
+		vc.closeRegistration()
+		vc.persist()
+	}
+}
+
+//
+// Stop taking registrations, and start agreeing on the roll with
+// the rest of the committee
+//
+func (vc *electionCounter) closeRegistration() {
+	vc.phase = AgreeingRoll
+	vc.rolls[vc.me+1] = make(map[int64]string)
+	for id, key := range vc.registry.Voters {
+		vc.rolls[vc.me+1][id] = string(key)
+	}
+
+	go vc.sendRoll()
+	go vc.rollDeadline()
+
+	vc.checkRoll()
+}
+
+//
+// Stop waiting for the rolls of every counter once the exchange
+// deadline has passed
+//
+func (vc *electionCounter) rollDeadline() {
+	time.Sleep(vc.deadlines.Exchange)
+
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+
+	vc.rollExpired = true
+	vc.checkRoll()
+	vc.persist()
+}
+
+//
+// Send our roll to the other vote counters
+//
+func (vc *electionCounter) sendRoll() {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+
+	for !vc.killed() && len(vc.rollSuccess) < len(vc.committeeMembers)-1 {
+		voters := make([]int64, 0, len(vc.rolls[vc.me+1]))
+		for id := range vc.rolls[vc.me+1] {
+			voters = append(voters, id)
+		}
+		voters = sortVoters(voters)
+		keys := make([][]byte, len(voters))
+		signatures := make([][]byte, len(voters))
+		for i, id := range voters {
+			keys[i] = []byte(vc.rolls[vc.me+1][id])
+			signatures[i] = vc.registrations[id]
+		}
+
+		for i := 0; i < len(vc.committeeMembers); i++ {
+			if i != vc.me && !vc.rollSuccess[i] && !vc.peerDead(i) {
+				go func(counter int, args ExchangeRollArgs) {
+					reply := ExchangeRollReply{}
+					vc.sendExchangeRoll(counter, &args, &reply)
+				}(i, ExchangeRollArgs{vc.registry.ElectionId, vc.me + 1, voters, keys, signatures})
+			}
+		}
+
+		vc.mu.Unlock()
+		time.Sleep(time.Duration(receiveTotalsTimeout) * time.Millisecond)
+		vc.mu.Lock()
+	}
+}
+
+func (vc *electionCounter) sendExchangeRoll(counter int, args *ExchangeRollArgs, reply *ExchangeRollReply) {
+	ok := vc.committeeMembers[counter].CallContext(vc.ctx, "VoteCounter.ExchangeRoll", args, reply) == nil
+
+	if ok && reply.Success {
+		vc.mu.Lock()
+		vc.rollSuccess[counter] = true
+		vc.mu.Unlock()
+	}
+}
+
+//
+// Get the roll of another vote counter, once our registration has
+// closed. A key without the voter's signature, or of a voter who
+// isn't eligible, isn't on the roll.
+//
+func (vc *electionCounter) ExchangeRoll(args *ExchangeRollArgs, reply *ExchangeRollReply) {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+
+	if vc.phase < AgreeingRoll || len(args.Keys) != len(args.Voters) || len(args.Signatures) != len(args.Voters) ||
+		args.Index < 1 || args.Index > len(vc.committeeMembers) || args.Index == vc.me+1 {
+		reply.Success = false
+		return
+	}
+
+	if _, ok := vc.rolls[args.Index]; !ok && vc.phase == AgreeingRoll {
+		vc.rolls[args.Index] = make(map[int64]string)
+		for i, id := range args.Voters {
+			key := ed25519.PublicKey(args.Keys[i])
+			if vc.registry.Eligible[id] && len(key) == ed25519.PublicKeySize &&
+				ed25519.Verify(key, registrationDigest(vc.registry.ElectionId, id, key), args.Signatures[i]) {
+				vc.rolls[args.Index][id] = string(key)
+			}
+		}
+	}
+	vc.checkRoll()
+
+	vc.persist()
+	reply.Success = true
+}
+
+//
+// Agree on the roll once the rolls of every counter that isn't
+// dead are known, or once the exchange deadline has passed, as
+// long as at least threshold of them are, and open the voting
+//
+func (vc *electionCounter) checkRoll() {
+	if vc.phase != AgreeingRoll {
+		return
+	}
+
+	missing := 0
+	for i := range vc.committeeMembers {
+		if _, ok := vc.rolls[i+1]; !ok && !vc.peerDead(i) {
+			missing++
+		}
+	}
+
+	if len(vc.rolls) >= vc.threshold && (missing == 0 || vc.rollExpired) {
+		voters := make(map[int64]ed25519.PublicKey)
+		for id, key := range agreeRoll(vc.rolls, vc.threshold) {
+			voters[id] = ed25519.PublicKey(key)
+		}
+		vc.registry.Voters = voters
+		vc.nVoters = len(voters)
+
+		vc.phase = VotingOpen
+		go vc.votingDeadline()
+	}
+}
@@ -0,0 +1,194 @@
+package election
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+//
+// Voter eligibility. Each eligible voter is issued an id and an
+// Ed25519 key pair for the election. The vote counters are given
+// the registry of public keys, and only take ballots that are
+// signed, together with the election id, by a registered voter.
+// For an election with a registration window, the registry instead
+// lists the voter ids that may register, and the voters bring
+// their own keys.
+//
+
+type Credential struct {
+	ElectionId string
+	VoterId    int64
+	Key        ed25519.PrivateKey
+}
+
+type Registry struct {
+	ElectionId string
+	Voters     map[int64]ed25519.PublicKey
+	Eligible   map[int64]bool // the voter ids that may register
+}
+
+//
+// A fresh credential, for a voter to register with the counters
+// of an election that has a registration window
+//
+func MakeCredential(electionId string, voterId int64) (Credential, error) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return Credential{}, err
+	}
+
+	return Credential{electionId, voterId, private}, nil
+}
+
+func MakeRegistry(electionId string) *Registry {
+	rg := &Registry{}
+	rg.ElectionId = electionId
+	rg.Voters = make(map[int64]ed25519.PublicKey)
+	rg.Eligible = make(map[int64]bool)
+	return rg
+}
+
+//
+// A copy that enrolling more voters into rg won't change
+//
+func (rg *Registry) copy() *Registry {
+	c := MakeRegistry(rg.ElectionId)
+	for id, public := range rg.Voters {
+		c.Voters[id] = public
+	}
+	for id := range rg.Eligible {
+		c.Eligible[id] = true
+	}
+	return c
+}
+
+//
+// Let voterId register itself, in an election with a registration
+// window
+//
+func (rg *Registry) Allow(voterId int64) {
+	rg.Eligible[voterId] = true
+}
+
+//
+// Issue a fresh credential for voterId, and register its public key
+//
+func (rg *Registry) Enroll(voterId int64) (Credential, error) {
+	credential, err := MakeCredential(rg.ElectionId, voterId)
+	if err != nil {
+		return Credential{}, err
+	}
+
+	rg.Voters[voterId] = credential.public()
+	return credential, nil
+}
+
+func (cr Credential) public() ed25519.PublicKey {
+	return cr.Key.Public().(ed25519.PublicKey)
+}
+
+//
+// Hash of a registration, bound to the election it is for
+//
+func registrationDigest(electionId string, voterId int64, key ed25519.PublicKey) []byte {
+	h := sha256.New()
+	buf := make([]byte, 8)
+	h.Write([]byte("distributed-evoting/registration"))
+	binary.BigEndian.PutUint64(buf, uint64(len(electionId)))
+	h.Write(buf)
+	h.Write([]byte(electionId))
+	binary.BigEndian.PutUint64(buf, uint64(voterId))
+	h.Write(buf)
+	h.Write(key)
+
+	return h.Sum(nil)
+}
+
+//
+// The signed registration of the credential's key
+//
+func (cr Credential) registration() RegisterArgs {
+	key := cr.public()
+	return RegisterArgs{cr.ElectionId, cr.VoterId, key, ed25519.Sign(cr.Key, registrationDigest(cr.ElectionId, cr.VoterId, key))}
+}
+
+//
+// A ballot as the counters keep it once its shares are opened: the
+// sealed share is left out, and only its hash, which the signature
+// covers, is kept. The signed ballot is still evidence of what the
+// voter cast, but no longer holds shares that a counter's key,
+// stolen in some later refresh epoch, could open.
+//
+type SignedBallot struct {
+	VoterId     int64
+	Sealed      []byte // sealedDigest of the ballot's sealed share
+	Commitments [][]int64
+	Proof       BallotProof
+	Signature   []byte
+}
+
+func (args *CountVoteArgs) signed() *SignedBallot {
+	return &SignedBallot{args.VoterId, sealedDigest(args.Sealed), args.Commitments, args.Proof, args.Signature}
+}
+
+//
+// Hash of everything in a ballot but its signature, bound to the
+// election it is cast in
+//
+func ballotDigest(electionId string, args *SignedBallot) []byte {
+	h := sha256.New()
+	buf := make([]byte, 8)
+	writeInt := func(x int64) {
+		binary.BigEndian.PutUint64(buf, uint64(x))
+		h.Write(buf)
+	}
+	writeBytes := func(b []byte) {
+		writeInt(int64(len(b)))
+		h.Write(b)
+	}
+	writeInts := func(xs []int64) {
+		writeInt(int64(len(xs)))
+		for _, x := range xs {
+			writeInt(x)
+		}
+	}
+
+	h.Write([]byte("distributed-evoting/signature"))
+	writeBytes([]byte(electionId))
+	writeInt(args.VoterId)
+	writeBytes(args.Sealed)
+	writeInt(int64(len(args.Commitments)))
+	for _, candidate := range args.Commitments {
+		writeInts(candidate)
+	}
+	writeInt(int64(len(args.Proof.Bits)))
+	for _, bit := range args.Proof.Bits {
+		writeInts([]int64{bit.A0, bit.A1, bit.E0, bit.E1, bit.Z0, bit.Z1})
+	}
+	writeInts([]int64{args.Proof.SumA, args.Proof.SumZ})
+
+	return h.Sum(nil)
+}
+
+func (cr Credential) sign(args *CountVoteArgs) {
+	args.Signature = ed25519.Sign(cr.Key, ballotDigest(cr.ElectionId, args.signed()))
+}
+
+//
+// Check that a ballot comes from a registered voter. Returns OK,
+// ErrUnknownVoter or ErrInvalidSignature.
+//
+func (rg *Registry) authenticate(args *SignedBallot) Err {
+	public, ok := rg.Voters[args.VoterId]
+	if !ok {
+		return ErrUnknownVoter
+	}
+
+	if !ed25519.Verify(public, ballotDigest(rg.ElectionId, args), args.Signature) {
+		return ErrInvalidSignature
+	}
+
+	return OK
+}
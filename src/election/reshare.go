@@ -0,0 +1,403 @@
+package election
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/sha256"
+	"encoding/binary"
+	"math/big"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+//
+// Replacing a lost counter. The counter at index k (counter + 1)
+// is started afresh, with a new key pair if the old one was lost
+// too, and the others are given its new public key with
+// ReplaceCounter. It then asks threshold of them, the helpers H,
+// to reshare: for every voter, f(k) = sum_{h in H} l_h f(h), with
+// l_h the Lagrange coefficients of H at k, and likewise for the
+// blinding polynomials.
+//
+// A helper's piece l_h f(h) would give its own share away, so
+// every pair of helpers adds a mask that only the two of them
+// can derive from their X25519 keys, one with a plus sign and the
+// other with a minus. The masks cancel out in the sum, and every
+// piece is sealed for the new counter, so it learns f(k) and
+// nothing else, and no secret is ever reconstructed. The new
+// shares are checked against the voters' commitments, and other
+// helpers are tried if they don't match.
+//
+// Helpers only reshare once their voting has closed, so that
+// their voter sets no longer change. They reshare their refreshed
+// shares, which the new counter checks against the voters'
+// commitments times the refreshes' (see refresh.go), and all of
+// them must be in the same refresh epoch. A new counter can start
+// recovering in any phase before the result, and it takes up the
+// election from that phase once its shares are rebuilt.
+//
+
+type ReshareArgs struct {
+	ElectionId string
+	Index      int    // the counter being rebuilt (index+1)
+	Helpers    []int  // the threshold counters (index+1) resharing
+	Round      int64  // fresh for every attempt, so masks are never reused
+	Key        []byte // the new counter's X25519 public key
+}
+
+type ReshareReply struct {
+	Success     bool
+	Err         Err
+	Voters      []int64
+	Commitments [][][]int64   // Commitments[voter][candidate][coefficient]
+	Refreshes   [][][]int64   // the product of each voter's refresh commitments
+	Pieces      []SealedShare // each voter's masked pieces, sealed for the new counter
+	Epoch       int
+}
+
+//
+// Forget what we sent to counter, which has been replaced
+//
+func (vc *electionCounter) replaceCounter(counter int) {
+	// the replacement has nothing we sent to the lost counter
+	delete(vc.voterSetSuccess, counter)
+	delete(vc.submissionSuccess, counter)
+	for id := range vc.reportSuccess {
+		delete(vc.reportSuccess[id], counter)
+	}
+
+	if _, ok := vc.voterSets[vc.me+1]; ok {
+		go vc.sendVoterSet()
+	}
+	if _, ok := vc.ownTotal(); ok {
+		go vc.sendShareTotal()
+	}
+	for id := range vc.equivocations {
+		go vc.sendEquivocation(id)
+	}
+
+	// our deals for the lost counter were sealed with its old key
+	for epoch := range vc.deals {
+		delete(vc.deals[epoch], counter)
+		if len(vc.deals[epoch]) == 0 {
+			delete(vc.deals, epoch)
+		}
+	}
+}
+
+//
+// Start rebuilding our shares of the election from the others
+//
+func (vc *electionCounter) recover() {
+	if vc.recovering || vc.phase == ResultFinal {
+		return
+	}
+
+	vc.recovering = true
+	go vc.recoverLoop()
+}
+
+//
+// Ask threshold other counters to reshare, until they give us
+// shares that match the voters' commitments
+//
+func (vc *electionCounter) recoverLoop() {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+
+	for !vc.killed() && vc.recovering {
+		args := ReshareArgs{vc.registry.ElectionId, vc.me + 1, vc.pickHelpers(), nrand(0), vc.key.PublicKey().Bytes()}
+		replies := make([]*ReshareReply, len(args.Helpers))
+
+		vc.mu.Unlock()
+		var wg sync.WaitGroup
+		for i, index := range args.Helpers {
+			wg.Add(1)
+			go func(i, counter int) {
+				defer wg.Done()
+				reply := ReshareReply{}
+				ok := vc.committeeMembers[counter].CallContext(vc.ctx, "VoteCounter.Reshare", &args, &reply) == nil
+				if ok && reply.Success {
+					replies[i] = &reply
+				}
+			}(i, index-1)
+		}
+		wg.Wait()
+		vc.mu.Lock()
+
+		if vc.installReshare(replies) {
+			vc.recovering = false
+			vc.applyRefreshes()
+			vc.rejoin()
+			vc.persist()
+			return
+		}
+
+		vc.mu.Unlock()
+		time.Sleep(time.Duration(receiveTotalsTimeout) * time.Millisecond)
+		vc.mu.Lock()
+	}
+}
+
+//
+// Take part in the election again with our rebuilt shares, which
+// are those of the helpers' closed voting. A voter set we sent
+// before had none of them, and the others may still take the new
+// one if they are waiting for it; once the common voters are
+// agreed on, we add up their shares if we are one of the common
+// counters. Before the voting, the roll goes on as usual.
+//
+func (vc *electionCounter) rejoin() {
+	switch vc.phase {
+	case VotingOpen, VotingClosed:
+		vc.voterSetSuccess = make(map[int]bool)
+		vc.closeVoting()
+	case ExchangingTotals:
+		for _, index := range vc.commonCounters {
+			if index == vc.me+1 {
+				vc.submissionSuccess = make(map[int]bool)
+				vc.addCommonVotes()
+			}
+		}
+	}
+}
+
+//
+// A random threshold of the other counters (index+1)
+//
+func (vc *electionCounter) pickHelpers() []int {
+	helpers := make([]int, 0, vc.threshold)
+	for _, i := range rand.Perm(len(vc.committeeMembers)) {
+		if i != vc.me && len(helpers) < vc.threshold {
+			helpers = append(helpers, i+1)
+		}
+	}
+	sort.Ints(helpers)
+
+	return helpers
+}
+
+//
+// Add up the helpers' pieces into our shares of every voter that
+// all of them hold with the same commitments. Fails, leaving our
+// state alone, unless every new share matches its commitments.
+//
+func (vc *electionCounter) installReshare(replies []*ReshareReply) bool {
+	nCandidates := len(vc.candidates)
+	votes := make(map[int64][]int64)
+	blinds := make(map[int64][]int64)
+	commitments := make(map[int64][][]int64)
+	refreshes := make(map[int64][][]int64)
+	held := make(map[int64]int)
+	mismatched := make(map[int64]bool)
+
+	for _, reply := range replies {
+		if reply == nil || len(reply.Commitments) != len(reply.Voters) ||
+			len(reply.Refreshes) != len(reply.Voters) ||
+			len(reply.Pieces) != len(reply.Voters) || reply.Epoch != replies[0].Epoch {
+			return false
+		}
+
+		for i, id := range reply.Voters {
+			share, blind, ok := openShare(vc.key, id, vc.me+1, reply.Pieces[i], nCandidates)
+			if !ok {
+				return false
+			}
+
+			if _, ok := commitments[id]; !ok {
+				commitments[id] = reply.Commitments[i]
+				refreshes[id] = reply.Refreshes[i]
+				votes[id] = make([]int64, nCandidates)
+				blinds[id] = make([]int64, nCandidates)
+			} else if commitmentDigest(commitments[id]) != commitmentDigest(reply.Commitments[i]) {
+				// the voter equivocated, the agreement leaves it out anyway
+				mismatched[id] = true
+			} else if commitmentDigest(refreshes[id]) != commitmentDigest(reply.Refreshes[i]) {
+				return false
+			}
+
+			for c := 0; c < nCandidates; c++ {
+				votes[id][c] = fieldAdd(votes[id][c], share[c])
+				blinds[id][c] = fieldAdd(blinds[id][c], blind[c])
+			}
+			held[id]++
+		}
+	}
+
+	for id := range votes {
+		if held[id] != len(replies) || mismatched[id] {
+			delete(votes, id)
+		} else if !vc.validShares(votes[id], blinds[id], mulCommitments(commitments[id], refreshes[id])) {
+			return false
+		}
+	}
+
+	for id := range votes {
+		vc.votes[id] = votes[id]
+		vc.blinds[id] = blinds[id]
+		vc.commitments[id] = commitments[id]
+		vc.zeroSums[id] = &zeroSum{make([]int64, nCandidates), make([]int64, nCandidates), refreshes[id]}
+	}
+
+	// the deals up to the helpers' epoch are in the shares already
+	if len(replies) > 0 {
+		vc.epoch = replies[0].Epoch
+		for epoch := range vc.pendingDeals {
+			if epoch <= vc.epoch {
+				delete(vc.pendingDeals, epoch)
+			}
+		}
+		for epoch := range vc.dealers {
+			if epoch <= vc.epoch {
+				delete(vc.dealers, epoch)
+			}
+		}
+	}
+
+	return true
+}
+
+//
+// Whether we can take part in rebuilding a counter's shares
+//
+func (vc *electionCounter) validReshare(args *ReshareArgs) bool {
+	n := len(vc.committeeMembers)
+	if args.Index < 1 || args.Index > n || len(args.Helpers) != vc.threshold {
+		return false
+	}
+
+	seen := make(map[int]bool)
+	for _, index := range args.Helpers {
+		if index < 1 || index > n || index == args.Index || seen[index] {
+			return false
+		}
+		seen[index] = true
+	}
+
+	return seen[vc.me+1]
+}
+
+//
+// The mask that we and another helper add to our pieces of a
+// voter's shares, with opposite signs, so that they cancel out.
+// kind is 0 for the shares, and 1 for the blinding shares.
+//
+func reshareMask(shared []byte, args *ReshareArgs, voterId int64, candidate, kind int) *big.Int {
+	h := sha256.New()
+	buf := make([]byte, 8)
+	h.Write([]byte("distributed-evoting/reshare"))
+	h.Write(shared)
+	binary.BigEndian.PutUint64(buf, uint64(len(args.ElectionId)))
+	h.Write(buf)
+	h.Write([]byte(args.ElectionId))
+	values := []int64{args.Round, int64(args.Index), voterId, int64(candidate), int64(kind)}
+	for _, index := range args.Helpers {
+		values = append(values, int64(index))
+	}
+	for _, v := range values {
+		binary.BigEndian.PutUint64(buf, uint64(v))
+		h.Write(buf)
+	}
+
+	m := new(big.Int).SetBytes(h.Sum(nil))
+	return m.Mod(m, bigField)
+}
+
+//
+// Send our masked pieces of every voter's shares to the counter
+// being rebuilt
+//
+func (vc *electionCounter) Reshare(args *ReshareArgs, reply *ReshareReply) {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+
+	if !vc.validReshare(args) ||
+		!bytes.Equal(args.Key, vc.counterKeys[args.Index-1].Bytes()) {
+		reply.Success = false
+		reply.Err = ErrUnauthorized
+		return
+	}
+
+	if vc.phase < VotingClosed || vc.recovering {
+		reply.Success = false
+		reply.Err = ErrNotReady
+		return
+	}
+
+	recipient, err := ecdh.X25519().NewPublicKey(args.Key)
+	if err != nil {
+		reply.Success = false
+		reply.Err = ErrUnauthorized
+		return
+	}
+
+	lagrange, err := votingField.LagrangeAt(args.Helpers, args.Index)
+	if err != nil {
+		reply.Success = false
+		reply.Err = ErrUnauthorized
+		return
+	}
+
+	// our coefficient, and a shared secret with every other helper
+	var l *big.Int
+	shared := make(map[int][]byte)
+	for i, index := range args.Helpers {
+		if index == vc.me+1 {
+			l = lagrange[i]
+			continue
+		}
+		secret, err := vc.key.ECDH(vc.counterKeys[index-1])
+		if err != nil {
+			reply.Success = false
+			reply.Err = ErrNotReady
+			return
+		}
+		shared[index] = secret
+	}
+
+	nCandidates := len(vc.candidates)
+	for _, id := range vc.voterSets[vc.me+1] {
+		if _, ok := vc.equivocations[id]; ok {
+			continue
+		}
+
+		share := make([]int64, nCandidates)
+		blind := make([]int64, nCandidates)
+		for c := 0; c < nCandidates; c++ {
+			pieces := [2]*big.Int{
+				new(big.Int).Mul(l, big.NewInt(vc.votes[id][c])),
+				new(big.Int).Mul(l, big.NewInt(vc.blinds[id][c])),
+			}
+			for index, secret := range shared {
+				for kind := range pieces {
+					mask := reshareMask(secret, args, id, c, kind)
+					if vc.me+1 < index {
+						pieces[kind].Add(pieces[kind], mask)
+					} else {
+						pieces[kind].Sub(pieces[kind], mask)
+					}
+				}
+			}
+			share[c] = votingField.Reduce(pieces[0]).Int64()
+			blind[c] = votingField.Reduce(pieces[1]).Int64()
+		}
+
+		sealed, err := sealShare(recipient, id, args.Index, share, blind)
+		if err != nil {
+			reply.Success = false
+			reply.Err = ErrNotReady
+			return
+		}
+
+		reply.Voters = append(reply.Voters, id)
+		reply.Commitments = append(reply.Commitments, vc.commitments[id])
+		reply.Refreshes = append(reply.Refreshes, vc.zeroSum(id).Commitments)
+		reply.Pieces = append(reply.Pieces, sealed)
+	}
+
+	reply.Epoch = vc.epoch
+	reply.Success = true
+	reply.Err = OK
+}
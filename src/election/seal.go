@@ -0,0 +1,130 @@
+package election
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+//
+// Hybrid encryption of the shares, so that only the counter they
+// are meant for can read them. Every counter has an X25519 key
+// pair, and the voter seals each counter's shares with AES-GCM,
+// under a key derived from a one-time X25519 exchange with that
+// counter's public key. The voter id and the counter index are
+// authenticated along with the shares, so a sealed share can't
+// be passed off as another voter's, or sent to another counter.
+//
+
+type SealedShare struct {
+	Ephemeral  []byte // the voter's one-time X25519 public key
+	Nonce      []byte
+	Ciphertext []byte // the shares then the blinding shares, 8 bytes each
+}
+
+func sealKey(shared, ephemeral, recipient []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte("distributed-evoting/seal"))
+	h.Write(shared)
+	h.Write(ephemeral)
+	h.Write(recipient)
+	return h.Sum(nil)
+}
+
+func sealedData(voterId int64, index int) []byte {
+	data := make([]byte, 16)
+	binary.BigEndian.PutUint64(data[:8], uint64(voterId))
+	binary.BigEndian.PutUint64(data[8:], uint64(index))
+	return data
+}
+
+func sealAEAD(key []byte) cipher.AEAD {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return aead
+}
+
+//
+// Seal voter's shares for the counter with the given index
+// (counter + 1) and public key
+//
+func sealShare(recipient *ecdh.PublicKey, voterId int64, index int, vote, blind []int64) (SealedShare, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return SealedShare{}, err
+	}
+	shared, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return SealedShare{}, err
+	}
+
+	plaintext := make([]byte, 0, 8*(len(vote)+len(blind)))
+	for _, x := range append(append([]int64(nil), vote...), blind...) {
+		plaintext = binary.BigEndian.AppendUint64(plaintext, uint64(x))
+	}
+
+	sealed := SealedShare{}
+	sealed.Ephemeral = ephemeral.PublicKey().Bytes()
+	aead := sealAEAD(sealKey(shared, sealed.Ephemeral, recipient.Bytes()))
+	sealed.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(sealed.Nonce); err != nil {
+		return SealedShare{}, err
+	}
+	sealed.Ciphertext = aead.Seal(nil, sealed.Nonce, plaintext, sealedData(voterId, index))
+
+	return sealed, nil
+}
+
+//
+// Hash of a sealed share, which stands in for it in the voter's
+// signature (see SignedBallot)
+//
+func sealedDigest(sealed SealedShare) []byte {
+	h := sha256.New()
+	for _, b := range [][]byte{sealed.Ephemeral, sealed.Nonce, sealed.Ciphertext} {
+		h.Write(binary.BigEndian.AppendUint64(nil, uint64(len(b))))
+		h.Write(b)
+	}
+	return h.Sum(nil)
+}
+
+//
+// Open shares sealed for us, with our private key. Returns
+// false if they weren't sealed for us, have been tampered
+// with, or don't hold nCandidates shares.
+//
+func openShare(key *ecdh.PrivateKey, voterId int64, index int, sealed SealedShare, nCandidates int) ([]int64, []int64, bool) {
+	ephemeral, err := ecdh.X25519().NewPublicKey(sealed.Ephemeral)
+	if err != nil {
+		return nil, nil, false
+	}
+	shared, err := key.ECDH(ephemeral)
+	if err != nil {
+		return nil, nil, false
+	}
+
+	aead := sealAEAD(sealKey(shared, sealed.Ephemeral, key.PublicKey().Bytes()))
+	if len(sealed.Nonce) != aead.NonceSize() {
+		return nil, nil, false
+	}
+	plaintext, err := aead.Open(nil, sealed.Nonce, sealed.Ciphertext, sealedData(voterId, index))
+	if err != nil || len(plaintext) != 16*nCandidates {
+		return nil, nil, false
+	}
+
+	values := make([]int64, 2*nCandidates)
+	for i := range values {
+		values[i] = int64(binary.BigEndian.Uint64(plaintext[8*i:]))
+	}
+
+	return values[:nCandidates], values[nCandidates:], true
+}
@@ -0,0 +1,511 @@
+package election
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"6.824/labgob"
+	"6.824/labrpc"
+	"6.824/raft"
+)
+
+//
+// Replicated seats. A counter that loses its disk loses its shares
+// for good, so a committee seat can instead be run by a small group
+// of replicas that keep its state in a Raft log. Only the replica
+// that leads the group runs the seat's VoteCounter, and every time
+// the counter persists its state, e.g. for a CountVote or a
+// CountTotal, the state is committed to the log before the counter
+// replies, and before it sends anything but heartbeats to the rest
+// of the committee. The counter doesn't wait for the log itself, so
+// it goes on answering heartbeats and RPCs while a commit is under
+// way, and states written in the meantime are committed together,
+// as the last of them. If the leader fails, the next one starts the
+// counter afresh from the last committed state, so the seat
+// survives the failure of any minority of its replicas. Only
+// the last state matters, so each replica snapshots it as soon as it
+// is applied, and the log keeps no more than the entries not yet
+// applied.
+//
+// The replicas of a seat hold the seat's key and its shares, so they
+// are one party of the secret sharing, run by whoever runs the seat:
+// threshold counts seats, not replicas, and the privacy of the votes
+// is as it was with one counter per seat.
+//
+// Voters and the other counters reach a seat through a SeatEnd,
+// which sends every RPC to the replicas in turn until it finds the
+// leader.
+//
+
+const seatCommitTimeout int32 = 1000
+const seatCheckTimeout int32 = 50
+
+// A committed state of the seat's counter, or nil for the no-op a
+// new leader commits to learn the latest state
+type seatEntry struct {
+	Id    int64
+	State []byte
+}
+
+type SeatCallArgs struct {
+	SvcMeth string // e.g. "VoteCounter.CountVote"
+	Args    []byte
+}
+
+type SeatCallReply struct {
+	WrongLeader bool
+	Err         Err
+	Reply       []byte
+}
+
+//
+// A seat call that the seat's counter couldn't run
+//
+type SeatError struct {
+	SvcMeth string
+	Err     Err
+}
+
+func (se *SeatError) Error() string {
+	return fmt.Sprintf("election: seat call %v: %v", se.SvcMeth, se.Err)
+}
+
+//
+// The client side of a seat: an Endpoint that finds the leader
+// among the replicas
+//
+type SeatEnd struct {
+	mu       sync.Mutex
+	replicas []*labrpc.ClientEnd
+	leader   int // the replica that last answered
+}
+
+func MakeSeatEnd(replicas []*labrpc.ClientEnd) *SeatEnd {
+	se := &SeatEnd{}
+	se.replicas = replicas
+	return se
+}
+
+func (se *SeatEnd) Call(svcMeth string, args interface{}, reply interface{}) bool {
+	return se.CallContext(context.Background(), svcMeth, args, reply) == nil
+}
+
+func (se *SeatEnd) CallContext(ctx context.Context, svcMeth string, args interface{}, reply interface{}) error {
+	w := new(bytes.Buffer)
+	if err := labgob.NewEncoder(w).Encode(args); err != nil {
+		panic(err)
+	}
+	callArgs := SeatCallArgs{svcMeth, w.Bytes()}
+
+	se.mu.Lock()
+	leader := se.leader
+	se.mu.Unlock()
+
+	for i := 0; i < len(se.replicas); i++ {
+		server := (leader + i) % len(se.replicas)
+		callReply := SeatCallReply{}
+		err := se.replicas[server].CallContext(ctx, "SeatReplica.Call", &callArgs, &callReply)
+		if err == labrpc.ErrTimeout || err == labrpc.ErrCanceled || err == labrpc.ErrNetworkDestroyed {
+			return err
+		}
+		if err == nil && !callReply.WrongLeader {
+			se.mu.Lock()
+			se.leader = server
+			se.mu.Unlock()
+
+			if callReply.Err != OK {
+				return &SeatError{SvcMeth: svcMeth, Err: callReply.Err}
+			}
+
+			if err := labgob.NewDecoder(bytes.NewBuffer(callReply.Reply)).Decode(reply); err != nil {
+				return &labrpc.DecodeError{SvcMeth: svcMeth, Err: err}
+			}
+			return nil
+		}
+	}
+
+	// no leader among the replicas
+	return labrpc.ErrServerDead
+}
+
+//
+// One replica of a seat
+//
+type SeatReplica struct {
+	mu      sync.Mutex
+	dead    int32 // set by Kill()
+	rf      *raft.Raft
+	applyCh chan raft.ApplyMsg
+
+	state   []byte             // the last committed state of the counter
+	waiting map[int]chan int64 // by log index, the ids of the entries applied there
+
+	makeCounter func(persister Persister) *VoteCounter
+	counter     *VoteCounter // nil unless we lead the seat
+	persister   *seatPersister
+}
+
+//
+// Persists the counter's state by committing it to the log. Writes
+// only keep the state, and commitLoop() commits the last of them
+// in the background. Once a commit fails, e.g. because we lost the
+// leadership, the counter is stopped, and all of its later writes
+// fail.
+//
+type seatPersister struct {
+	sr        *SeatReplica
+	mu        sync.Mutex
+	cond      *sync.Cond
+	state     []byte // the last state written
+	written   int    // the number of states written
+	committed int    // the number of those committed
+	lost      bool
+}
+
+func makeSeatPersister(sr *SeatReplica, state []byte) *seatPersister {
+	sp := &seatPersister{sr: sr, state: state}
+	sp.cond = sync.NewCond(&sp.mu)
+	return sp
+}
+
+func (sp *seatPersister) readPersistState() []byte {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	return sp.state
+}
+
+func (sp *seatPersister) writePersistState(data []byte) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	if sp.lost {
+		return
+	}
+	sp.state = data
+	sp.written++
+	sp.cond.Broadcast()
+}
+
+//
+// Commit the last state written whenever there is one that isn't
+// committed, until a commit fails
+//
+func (sp *seatPersister) commitLoop() {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	for !sp.lost {
+		if sp.committed == sp.written {
+			sp.cond.Wait()
+			continue
+		}
+		state, written := sp.state, sp.written
+
+		// writes go on while the log commits
+		sp.mu.Unlock()
+		ok := sp.sr.replicate(state)
+		sp.mu.Lock()
+
+		if !ok {
+			sp.lost = true
+		} else {
+			sp.committed = written
+		}
+		sp.cond.Broadcast()
+	}
+}
+
+//
+// Wait until every state written so far is committed. Returns
+// false if one can't be.
+//
+func (sp *seatPersister) flush() bool {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	written := sp.written
+	for !sp.lost && sp.committed < written {
+		sp.cond.Wait()
+	}
+	return !sp.lost
+}
+
+//
+// Fail every write from now on, e.g. once we no longer lead the seat
+//
+func (sp *seatPersister) stop() {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	sp.lost = true
+	sp.cond.Broadcast()
+}
+
+func (sp *seatPersister) failed() bool {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	return sp.lost
+}
+
+//
+// An end from a seat's counter to another committee member, that
+// only sends once the counter's state is committed, so that nothing
+// the counter sends is lost with the leader. Heartbeats tell nothing
+// of the state, so they go at once.
+//
+type seatMemberEnd struct {
+	Endpoint
+	sp *seatPersister
+}
+
+func (sm *seatMemberEnd) Call(svcMeth string, args interface{}, reply interface{}) bool {
+	return sm.CallContext(context.Background(), svcMeth, args, reply) == nil
+}
+
+func (sm *seatMemberEnd) CallContext(ctx context.Context, svcMeth string, args interface{}, reply interface{}) error {
+	if svcMeth != "VoteCounter.Heartbeat" && !sm.sp.flush() {
+		return labrpc.ErrServerDead
+	}
+	return sm.Endpoint.CallContext(ctx, svcMeth, args, reply)
+}
+
+func (sp *seatPersister) memberEnds(ends []Endpoint) []Endpoint {
+	members := make([]Endpoint, len(ends))
+	for i, end := range ends {
+		members[i] = &seatMemberEnd{end, sp}
+	}
+	return members
+}
+
+//
+// peers are the Raft ends to every replica of the seat, including
+// this one (me). makeCounter starts the seat's counter with the
+// given persister, whenever we become the leader.
+//
+func MakeSeatReplica(peers []*labrpc.ClientEnd, me int, persister *raft.Persister, makeCounter func(persister Persister) *VoteCounter) *SeatReplica {
+	labgob.Register(seatEntry{})
+
+	sr := &SeatReplica{}
+	sr.applyCh = make(chan raft.ApplyMsg)
+	sr.waiting = make(map[int]chan int64)
+	sr.makeCounter = makeCounter
+	sr.rf = raft.Make(peers, me, persister, sr.applyCh)
+
+	go sr.applyLoop()
+	go sr.leaderLoop()
+
+	return sr
+}
+
+//
+// Commit an entry to the log, and wait until it is applied. Fails if
+// we aren't the leader, or lose the leadership before it commits.
+//
+func (sr *SeatReplica) replicate(state []byte) bool {
+	entry := seatEntry{nrand(0), state}
+	index, _, isLeader := sr.rf.Start(entry)
+	if !isLeader {
+		return false
+	}
+
+	ch := make(chan int64, 1)
+	sr.mu.Lock()
+	sr.waiting[index] = ch
+	sr.mu.Unlock()
+
+	defer func() {
+		sr.mu.Lock()
+		delete(sr.waiting, index)
+		sr.mu.Unlock()
+	}()
+
+	select {
+	case id := <-ch:
+		return id == entry.Id
+	case <-time.After(time.Duration(seatCommitTimeout) * time.Millisecond):
+		return false
+	}
+}
+
+//
+// Keep the last committed state, snapshot it in place of the log
+// before it, and tell whoever waits on an entry
+//
+func (sr *SeatReplica) applyLoop() {
+	for msg := range sr.applyCh {
+		if msg.SnapshotValid {
+			sr.mu.Lock()
+			sr.state = msg.Snapshot
+			sr.mu.Unlock()
+			continue
+		}
+		if !msg.CommandValid {
+			continue
+		}
+		entry, ok := msg.Command.(seatEntry)
+		if !ok {
+			continue
+		}
+
+		sr.mu.Lock()
+		if entry.State != nil {
+			sr.state = entry.State
+		}
+		state := sr.state
+		if ch, ok := sr.waiting[msg.CommandIndex]; ok {
+			ch <- entry.Id
+			delete(sr.waiting, msg.CommandIndex)
+		}
+		sr.mu.Unlock()
+
+		sr.rf.Snapshot(msg.CommandIndex, state)
+	}
+}
+
+//
+// Run the seat's counter while we lead the replicas, and stop it
+// as soon as we don't
+//
+func (sr *SeatReplica) leaderLoop() {
+	for !sr.killed() {
+		_, isLeader := sr.rf.GetState()
+
+		sr.mu.Lock()
+		if sr.counter != nil && (!isLeader || sr.persister.failed()) {
+			sr.persister.stop()
+			sr.counter.Kill()
+			sr.counter = nil
+			sr.persister = nil
+		}
+		takeOver := isLeader && sr.counter == nil
+		sr.mu.Unlock()
+
+		if takeOver {
+			sr.takeOver()
+		}
+
+		time.Sleep(time.Duration(seatCheckTimeout) * time.Millisecond)
+	}
+}
+
+//
+// Start the counter from the latest committed state, once a no-op
+// of our term has committed everything before it
+//
+func (sr *SeatReplica) takeOver() {
+	if !sr.replicate(nil) {
+		return
+	}
+
+	sr.mu.Lock()
+	persister := makeSeatPersister(sr, sr.state)
+	sr.mu.Unlock()
+
+	go persister.commitLoop()
+	vc := sr.makeCounter(persister)
+
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+
+	if sr.killed() {
+		persister.stop()
+		vc.Kill()
+		return
+	}
+	sr.counter = vc
+	sr.persister = persister
+}
+
+//
+// Returns the seat's counter, if we lead the seat
+//
+func (sr *SeatReplica) Counter() (*VoteCounter, bool) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+
+	return sr.counter, sr.counter != nil
+}
+
+//
+// Run a VoteCounter RPC on the seat's counter, if we lead the seat.
+// Whatever it changes is committed by the time we reply. A call that
+// isn't to one of the counter's RPC handlers, or whose args don't
+// decode, fails with an Err.
+//
+func (sr *SeatReplica) Call(caller labrpc.Caller, args *SeatCallArgs, reply *SeatCallReply) {
+	sr.mu.Lock()
+	vc, persister := sr.counter, sr.persister
+	sr.mu.Unlock()
+
+	if vc == nil {
+		reply.WrongLeader = true
+		return
+	}
+
+	// only the counter's RPC handlers, as labrpc would dispatch them,
+	// passing on who called us to those that ask
+	method := reflect.ValueOf(vc).MethodByName(strings.TrimPrefix(args.SvcMeth, "VoteCounter."))
+	if !strings.HasPrefix(args.SvcMeth, "VoteCounter.") || !method.IsValid() {
+		reply.Err = ErrUnknownMethod
+		return
+	}
+	mtype := method.Type()
+	callerType := reflect.TypeOf((*labrpc.Caller)(nil)).Elem()
+	var in []reflect.Value
+	if mtype.NumIn() == 3 && mtype.In(0) == callerType {
+		callerv := reflect.New(callerType).Elem()
+		if caller != nil {
+			callerv.Set(reflect.ValueOf(caller))
+		}
+		in = append(in, callerv)
+	}
+	if mtype.NumIn() != len(in)+2 || mtype.NumOut() != 0 ||
+		mtype.In(len(in)).Kind() != reflect.Ptr || mtype.In(len(in)+1).Kind() != reflect.Ptr {
+		reply.Err = ErrUnknownMethod
+		return
+	}
+
+	arg := reflect.New(mtype.In(len(in)).Elem())
+	if labgob.NewDecoder(bytes.NewBuffer(args.Args)).Decode(arg.Interface()) != nil {
+		reply.Err = ErrInvalidArgs
+		return
+	}
+	out := reflect.New(mtype.In(len(in) + 1).Elem())
+	method.Call(append(in, arg, out))
+
+	if !persister.flush() {
+		reply.WrongLeader = true
+		return
+	}
+
+	w := new(bytes.Buffer)
+	labgob.NewEncoder(w).Encode(out.Interface())
+	reply.Err = OK
+	reply.Reply = w.Bytes()
+}
+
+func (sr *SeatReplica) Kill() {
+	atomic.StoreInt32(&sr.dead, 1)
+	sr.rf.Kill()
+
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+
+	if sr.counter != nil {
+		sr.persister.stop()
+		sr.counter.Kill()
+	}
+}
+
+func (sr *SeatReplica) killed() bool {
+	z := atomic.LoadInt32(&sr.dead)
+	return z == 1
+}
@@ -0,0 +1,149 @@
+package election
+
+import (
+	"sort"
+)
+
+// Above this many threshold-sized subsets, use the greedy heuristic
+const maxExactSubsets = 5000
+
+//
+// Number of k-sized subsets of n elements, capped at max+1
+//
+func binomial(n, k, max int) int {
+	if k < 0 || k > n {
+		return 0
+	}
+
+	c := 1
+	for i := 1; i <= k; i++ {
+		c = c * (n - k + i) / i
+		if c > max {
+			return max + 1
+		}
+	}
+
+	return c
+}
+
+//
+// Choose the threshold counters (voterSets keys) whose voter sets
+// have the largest intersection, and return them along with the
+// voters they have in common. The search is exhaustive for small
+// committees, and greedy for large ones. Ties are broken in favor
+// of the lowest counter indices, so that counters with the same
+// voter sets always make the same choice.
+//
+func chooseCounters(voterSets map[int][]int64, threshold int) ([]int, []int64) {
+	indices := make([]int, 0, len(voterSets))
+	for index := range voterSets {
+		indices = append(indices, index)
+	}
+	sort.Ints(indices)
+
+	if len(indices) < threshold {
+		return nil, nil
+	}
+
+	if binomial(len(indices), threshold, maxExactSubsets) <= maxExactSubsets {
+		return chooseCountersExact(voterSets, indices, threshold)
+	}
+	return chooseCountersGreedy(voterSets, indices, threshold)
+}
+
+//
+// Every counter (voterSets key) that holds all of voters
+//
+func coveringCounters(voterSets map[int][]int64, voters []int64) []int {
+	counters := make([]int, 0)
+	for index, set := range voterSets {
+		held := make(map[int64]bool)
+		for _, id := range set {
+			held[id] = true
+		}
+
+		covers := true
+		for _, id := range voters {
+			if !held[id] {
+				covers = false
+				break
+			}
+		}
+		if covers {
+			counters = append(counters, index)
+		}
+	}
+	sort.Ints(counters)
+
+	return counters
+}
+
+func commonVotersOf(voterSets map[int][]int64, counters []int) []int64 {
+	sets := make(map[int][]int64)
+	for _, index := range counters {
+		sets[index] = voterSets[index]
+	}
+	return intersectVoters(sets)
+}
+
+//
+// Try every threshold-sized subset of indices, in lexicographic order
+//
+func chooseCountersExact(voterSets map[int][]int64, indices []int, threshold int) ([]int, []int64) {
+	var bestCounters []int
+	var bestVoters []int64
+
+	subset := make([]int, threshold)
+	var choose func(start, depth int)
+	choose = func(start, depth int) {
+		if depth == threshold {
+			voters := commonVotersOf(voterSets, subset)
+			if bestCounters == nil || len(voters) > len(bestVoters) {
+				bestCounters = append([]int(nil), subset...)
+				bestVoters = voters
+			}
+			return
+		}
+
+		for i := start; i <= len(indices)-(threshold-depth); i++ {
+			subset[depth] = indices[i]
+			choose(i+1, depth+1)
+		}
+	}
+	choose(0, 0)
+
+	return bestCounters, bestVoters
+}
+
+//
+// Start from the largest voter set, and keep adding the counter
+// that keeps the most voters in common
+//
+func chooseCountersGreedy(voterSets map[int][]int64, indices []int, threshold int) ([]int, []int64) {
+	chosen := make([]int, 0, threshold)
+	used := make(map[int]bool)
+
+	for len(chosen) < threshold {
+		bestIndex := -1
+		var bestVoters []int64
+
+		for _, index := range indices {
+			if used[index] {
+				continue
+			}
+
+			voters := commonVotersOf(voterSets, append(append([]int(nil), chosen...), index))
+			if bestIndex == -1 || len(voters) > len(bestVoters) {
+				bestIndex = index
+				bestVoters = voters
+			}
+		}
+
+		chosen = append(chosen, bestIndex)
+		used[bestIndex] = true
+	}
+
+	sort.Ints(chosen)
+
+	return chosen, commonVotersOf(voterSets, chosen)
+}
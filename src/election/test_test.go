@@ -1,30 +1,75 @@
 package election
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	crand "crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"math/big"
+	"reflect"
+	"sort"
+	"sync"
 	"testing"
 	"time"
+
+	"6.824/labgob"
+	"6.824/labrpc"
+	"6.824/shamir"
 )
 
-func (cfg *config) voteResult() int {
+func (cfg *config) electionResult() (bool, Result) {
 	for iters := 0; iters < 10; iters++ {
 		time.Sleep(1000 * time.Millisecond)
 
 		for i := 0; i < cfg.nCounters; i++ {
 			if cfg.counters[i] != nil {
-				done, vote := cfg.counters[i].Done()
+				done, result := cfg.election(i).Done()
 				if done {
-					return vote
+					return true, result
 				}
 			}
 		}
 	}
-	return -1
+	return false, Result{Winner: NoWinner}
+}
+
+func (cfg *config) voteResult() int {
+	_, result := cfg.electionResult()
+	return result.Winner
+}
+
+// wait until every running voter has finished submitting its shares
+func (cfg *config) waitVoters() {
+	for iters := 0; iters < 50; iters++ {
+		done := true
+		for i := 0; i < cfg.nVoters; i++ {
+			if cfg.voters[i] != nil && !cfg.voters[i].Done() {
+				done = false
+			}
+		}
+		if done {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	cfg.t.Fatalf("voters did not finish submitting their shares")
+}
+
+func (cfg *config) expectedTally() []int64 {
+	tally := make([]int64, len(cfg.candidates))
+	for _, vote := range cfg.votes {
+		tally[vote]++
+	}
+	return tally
 }
 
 func TestInitialElection0(t *testing.T) {
 	fmt.Println("Starting simple test - 0 wins")
-	cfg := makeConfig(t, 3, 5, 3, []int{0, 0, 0, 1, 1}, false)
+	cfg := makeConfig(t, 3, 5, 3, referendum, []int{0, 0, 0, 1, 1}, false)
 	cfg.startVoting()
 
 	voteResult := cfg.voteResult()
@@ -39,7 +84,7 @@ func TestInitialElection0(t *testing.T) {
 
 func TestInitialElection1(t *testing.T) {
 	fmt.Println("Starting simple test - 1 wins")
-	cfg := makeConfig(t, 3, 5, 3, []int{0, 0, 1, 1, 1}, false)
+	cfg := makeConfig(t, 3, 5, 3, referendum, []int{0, 0, 1, 1, 1}, false)
 	cfg.startVoting()
 
 	voteResult := cfg.voteResult()
@@ -54,7 +99,7 @@ func TestInitialElection1(t *testing.T) {
 
 func TestUnreliableElection0(t *testing.T) {
 	fmt.Println("Starting unreliable election test - 0 wins")
-	cfg := makeConfig(t, 3, 5, 3, []int{0, 0, 0, 1, 1}, true)
+	cfg := makeConfig(t, 3, 5, 3, referendum, []int{0, 0, 0, 1, 1}, true)
 	cfg.startVoting()
 
 	voteResult := cfg.voteResult()
@@ -69,7 +114,7 @@ func TestUnreliableElection0(t *testing.T) {
 
 func TestUnreliableElection1(t *testing.T) {
 	fmt.Println("Starting unreliable election test - 1 wins")
-	cfg := makeConfig(t, 3, 5, 3, []int{0, 0, 1, 1, 1}, true)
+	cfg := makeConfig(t, 3, 5, 3, referendum, []int{0, 0, 1, 1, 1}, true)
 	cfg.startVoting()
 
 	voteResult := cfg.voteResult()
@@ -82,18 +127,274 @@ func TestUnreliableElection1(t *testing.T) {
 	cfg.cleanup()
 }
 
-// Test voter crash without recovery
-func TestInfiniteElection(t *testing.T) {
-	fmt.Println("Starting infinite election test")
-	cfg := makeConfig(t, 3, 5, 3, []int{0, 0, 1, 1, 1}, true)
-	cfg.crashVoter(2)
+// Test that a seeded network drops the same requests again
+func TestSeededNetwork(t *testing.T) {
+	fmt.Println("Starting seeded network test")
+	t.Setenv("LABRPC_SEED", "1")
+
+	// the names and ids of a seeded config, and which of a voter's
+	// first requests to counter 0 go through
+	run := func() ([]string, []bool) {
+		cfg := makeConfig(t, 3, 3, 2, referendum, []int{1, 0, 1}, true)
+		defer cfg.cleanup()
 
+		names := []string{cfg.registry.ElectionId}
+		for i := 0; i < cfg.nCounters; i++ {
+			names = append(names, cfg.counterEndnames[i]...)
+		}
+		for i := 0; i < cfg.nVoters; i++ {
+			names = append(names, cfg.voterEndnames[i]...)
+			names = append(names, fmt.Sprint(cfg.credentials[i].VoterId))
+		}
+
+		delivered := make([]bool, 40)
+		for n := range delivered {
+			args := GetResultArgs{cfg.registry.ElectionId, cfg.voters[0].voterId}
+			err := cfg.voters[0].committeeMembers[0].CallContext(context.Background(), "VoteCounter.GetResult", &args, &GetResultReply{})
+			delivered[n] = err == nil
+		}
+		return names, delivered
+	}
+
+	names0, delivered0 := run()
+	names1, delivered1 := run()
+	if !reflect.DeepEqual(names0, names1) {
+		t.Fatalf("expecting the same names from the same seed, but got %v and %v", names0, names1)
+	}
+	if !reflect.DeepEqual(delivered0, delivered1) {
+		t.Fatalf("expecting the same requests to be dropped, but got %v and %v", delivered0, delivered1)
+	}
+	dropped := 0
+	for _, ok := range delivered0 {
+		if !ok {
+			dropped++
+		}
+	}
+	if dropped == 0 || dropped == len(delivered0) {
+		t.Fatalf("expecting some of %v requests to be dropped, but %v were", len(delivered0), dropped)
+	}
+
+	fmt.Println("ok")
+}
+
+func TestMultiCandidateElection(t *testing.T) {
+	fmt.Println("Starting multi-candidate election test - Carol wins")
+	candidates := []string{"Alice", "Bob", "Carol", "Dave"}
+	cfg := makeConfig(t, 5, 7, 3, candidates, []int{0, 2, 1, 2, 3, 2, 0}, true)
 	cfg.startVoting()
-	time.Sleep(time.Duration(5000) * time.Millisecond)
 
-	voteResult := cfg.voteResult()
-	if voteResult != -1 {
-		cfg.t.Fatalf("expecting no result, but got %v", voteResult)
+	_, result := cfg.electionResult()
+	if result.Winner != 2 || result.Outcome != Plurality {
+		cfg.t.Fatalf("expecting plurality for 2, but got %v", result)
+	}
+	if !reflect.DeepEqual(result.Tally, cfg.expectedTally()) {
+		cfg.t.Fatalf("expecting tally %v, but got %v", cfg.expectedTally(), result.Tally)
+	} else {
+		fmt.Println("ok")
+	}
+
+	cfg.cleanup()
+}
+
+func TestFullResult(t *testing.T) {
+	fmt.Println("Starting full result test - 1 wins")
+	cfg := makeConfig(t, 5, 7, 3, referendum, []int{0, 1, 1, 0, 1, 1, 1}, false)
+	cfg.startVoting()
+
+	done, result := cfg.electionResult()
+	if !done {
+		cfg.t.Fatalf("expecting a result")
+	}
+	if result.Winner != 1 || result.Outcome != Majority {
+		cfg.t.Fatalf("expecting majority for 1, but got %v", result)
+	}
+	if !reflect.DeepEqual(result.Tally, cfg.expectedTally()) || result.Ballots != 7 {
+		cfg.t.Fatalf("expecting tally %v of 7 ballots, but got %v", cfg.expectedTally(), result)
+	}
+	if len(result.Counters) < cfg.threshold {
+		cfg.t.Fatalf("expecting at least %v counters, but got %v", cfg.threshold, result.Counters)
+	}
+	if !result.CrossChecked {
+		cfg.t.Fatalf("expecting the tally to be cross-checked, but got %v", result)
+	}
+	// every counter holds every voter, so the lowest ones are chosen
+	if !reflect.DeepEqual(result.Chosen, []int{1, 2, 3}) {
+		cfg.t.Fatalf("expecting counters [1 2 3] to be chosen, but got %v", result.Chosen)
+	} else {
+		fmt.Println("ok")
+	}
+
+	cfg.cleanup()
+}
+
+func TestTieElection(t *testing.T) {
+	fmt.Println("Starting tie election test - no winner")
+	cfg := makeConfig(t, 3, 6, 3, []string{"Alice", "Bob", "Carol"}, []int{0, 2, 1, 2, 1, 0}, true)
+	cfg.startVoting()
+
+	done, result := cfg.electionResult()
+	if !done {
+		cfg.t.Fatalf("expecting a result")
+	}
+	if result.Winner != NoWinner || result.Outcome != Tie {
+		cfg.t.Fatalf("expecting a tie, but got %v", result)
+	} else {
+		fmt.Println("ok")
+	}
+
+	cfg.cleanup()
+}
+
+// Test voter crash without recovery: the election goes on without it
+func TestMissingVoterElection(t *testing.T) {
+	fmt.Println("Starting missing voter election test - 1 wins")
+	cfg := makeConfig(t, 3, 5, 3, referendum, []int{0, 0, 1, 1, 1}, true)
+	cfg.crashVoter(0)
+
+	cfg.startVoting()
+
+	done, result := cfg.electionResult()
+	if !done {
+		cfg.t.Fatalf("expecting a result without voter 0")
+	}
+	if result.Winner != 1 || result.Ballots != 4 {
+		cfg.t.Fatalf("expecting 1 to win with 4 ballots, but got %v", result)
+	}
+	if !reflect.DeepEqual(result.Tally, []int64{1, 3}) {
+		cfg.t.Fatalf("expecting tally [1 3], but got %v", result.Tally)
+	} else {
+		fmt.Println("ok")
+	}
+
+	cfg.cleanup()
+}
+
+// Test counters that received shares from different voters
+func TestCommonVoterSet(t *testing.T) {
+	fmt.Println("Starting common voter set test - 0 wins")
+	cfg := makeConfig(t, 3, 5, 3, referendum, []int{0, 0, 1, 1, 1}, false)
+	cfg.disconnectVoterFrom(3, 0)
+	cfg.disconnectVoterFrom(4, 2)
+
+	cfg.startVoting()
+
+	done, result := cfg.electionResult()
+	if !done {
+		cfg.t.Fatalf("expecting a result over the common voters")
+	}
+	if result.Winner != 0 || result.Ballots != 3 {
+		cfg.t.Fatalf("expecting 0 to win with 3 ballots, but got %v", result)
+	} else {
+		fmt.Println("ok")
+	}
+
+	cfg.cleanup()
+}
+
+// Test that the k counters sharing the most voters are chosen
+func TestBestCounterSubset(t *testing.T) {
+	fmt.Println("Starting best counter subset test - 1 wins")
+	cfg := makeConfig(t, 5, 7, 3, referendum, []int{0, 0, 0, 1, 1, 1, 1}, false)
+	cfg.disconnectVoterFrom(6, 0)
+	cfg.disconnectVoterFrom(5, 1)
+
+	cfg.startVoting()
+
+	done, result := cfg.electionResult()
+	if !done {
+		cfg.t.Fatalf("expecting a result")
+	}
+	if result.Winner != 1 || result.Ballots != 7 {
+		cfg.t.Fatalf("expecting 1 to win with all 7 ballots, but got %v", result)
+	}
+	if !reflect.DeepEqual(result.Counters, []int{3, 4, 5}) {
+		cfg.t.Fatalf("expecting counters [3 4 5], but got %v", result.Counters)
+	}
+	if !reflect.DeepEqual(result.Chosen, []int{3, 4, 5}) {
+		cfg.t.Fatalf("expecting counters [3 4 5] to be chosen, but got %v", result.Chosen)
+	} else {
+		fmt.Println("ok")
+	}
+
+	cfg.cleanup()
+}
+
+func TestChooseCounters(t *testing.T) {
+	fmt.Println("Starting choose counters test")
+
+	voterSets := map[int][]int64{
+		1: {1, 2, 3, 4},
+		2: {1, 2, 3, 4, 5},
+		3: {2, 3, 4, 5},
+		4: {1, 2, 3, 4, 5},
+		5: {1, 2, 3, 4, 5},
+	}
+
+	counters, voters := chooseCounters(voterSets, 3)
+	if !reflect.DeepEqual(counters, []int{2, 4, 5}) || len(voters) != 5 {
+		t.Fatalf("exact: expecting [2 4 5] with 5 voters, but got %v %v", counters, voters)
+	}
+
+	counters, voters = chooseCountersGreedy(voterSets, []int{1, 2, 3, 4, 5}, 3)
+	if !reflect.DeepEqual(counters, []int{2, 4, 5}) || len(voters) != 5 {
+		t.Fatalf("greedy: expecting [2 4 5] with 5 voters, but got %v %v", counters, voters)
+	}
+
+	counters, _ = chooseCounters(voterSets, 6)
+	if counters != nil {
+		t.Fatalf("expecting no subset larger than the committee, but got %v", counters)
+	}
+
+	fmt.Println("ok")
+}
+
+// Test that ballots are rejected once the voting deadline has passed
+func TestVotingDeadline(t *testing.T) {
+	fmt.Println("Starting voting deadline test - 0 wins")
+	deadlines := Deadlines{Voting: 1500 * time.Millisecond, Exchange: 1000 * time.Millisecond}
+	cfg := makeConfigDeadlines(t, 3, 5, 3, referendum, []int{0, 0, 0, 1, 1}, false, deadlines)
+	cfg.crashVoter(4)
+
+	for i := 0; i < cfg.nCounters; i++ {
+		if phase := cfg.election(i).Phase(); phase != VotingOpen {
+			cfg.t.Fatalf("expecting counter %v to be in VotingOpen, but got %v", i, phase)
+		}
+	}
+
+	cfg.startVoting()
+
+	done, result := cfg.electionResult()
+	if !done || result.Winner != 0 || result.Ballots != 4 {
+		cfg.t.Fatalf("expecting 0 to win with 4 ballots, but got %v", result)
+	}
+
+	for i := 0; i < cfg.nCounters; i++ {
+		if phase := cfg.election(i).Phase(); phase != ResultFinal {
+			cfg.t.Fatalf("expecting counter %v to be in ResultFinal, but got %v", i, phase)
+		}
+	}
+
+	// a late voter is turned away by every counter
+	cfg.startVoter(4)
+	cfg.connectVoter(4)
+	cfg.vote(4)
+	time.Sleep(1000 * time.Millisecond)
+
+	if !cfg.voters[4].Done() {
+		cfg.t.Fatalf("expecting the late voter to give up")
+	}
+
+	args := CountVoteArgs{VoterId: cfg.credentials[4].VoterId}
+	cfg.credentials[4].sign(&args)
+	reply := CountVoteReply{}
+	cfg.election(0).CountVote(&args, &reply)
+	if reply.Success || reply.Err != ErrVotingClosed {
+		cfg.t.Fatalf("expecting %v, but got %v", ErrVotingClosed, reply)
+	}
+
+	_, after := cfg.election(0).Done()
+	if !reflect.DeepEqual(after, result) {
+		cfg.t.Fatalf("expecting the result %v to stay final, but got %v", result, after)
 	} else {
 		fmt.Println("ok")
 	}
@@ -104,7 +405,7 @@ func TestInfiniteElection(t *testing.T) {
 // Test voter crash with recovery
 func TestPersistedVoteElection(t *testing.T) {
 	fmt.Println("Starting persisted vote election test - 1 wins")
-	cfg := makeConfig(t, 3, 5, 3, []int{0, 0, 1, 1, 1}, true)
+	cfg := makeConfig(t, 3, 5, 3, referendum, []int{0, 0, 1, 1, 1}, true)
 	cfg.crashVoter(2)
 
 	cfg.startVoting()
@@ -123,12 +424,66 @@ func TestPersistedVoteElection(t *testing.T) {
 	cfg.cleanup()
 }
 
+// Test a committee split in two, with the voters seeing every counter
+func TestCommitteePartition(t *testing.T) {
+	fmt.Println("Starting committee partition test - 1 wins")
+	cfg := makeConfig(t, 5, 7, 3, referendum, []int{0, 0, 0, 1, 1, 1, 1}, false)
+	cfg.net.Partition([]interface{}{0, 1}, []interface{}{2, 3, 4})
+
+	cfg.startVoting()
+
+	done, result := cfg.electionResult()
+	if !done {
+		cfg.t.Fatalf("expecting a result from the majority side")
+	}
+	if result.Winner != 1 || result.Ballots != 7 || !reflect.DeepEqual(result.Counters, []int{3, 4, 5}) {
+		cfg.t.Fatalf("expecting 1 to win with 7 ballots from counters [3 4 5], but got %v", result)
+	}
+	for i := 0; i < 2; i++ {
+		if done, _ := cfg.election(i).Done(); done {
+			cfg.t.Fatalf("expecting counter %v to have no result in the minority", i)
+		}
+	}
+	for i := 0; i < cfg.nVoters; i++ {
+		for iters := 0; ; iters++ {
+			done, result := cfg.voters[i].Result()
+			if done && result.Winner == 1 {
+				break
+			}
+			if iters == 50 {
+				cfg.t.Fatalf("expecting voter %v to learn that 1 won, but got %v", i, result)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	cfg.net.Heal()
+
+	for iters := 0; ; iters++ {
+		if iters == 100 {
+			cfg.t.Fatalf("expecting the minority to learn the result once healed")
+		}
+		done0, result0 := cfg.election(0).Done()
+		done1, result1 := cfg.election(1).Done()
+		if done0 && done1 {
+			if !result0.sameOutcome(result) || !result1.sameOutcome(result) {
+				cfg.t.Fatalf("expecting %v, but got %v and %v", result, result0, result1)
+			}
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	fmt.Println("ok")
+
+	cfg.cleanup()
+}
+
 // Test crasher with servers
 func TestServerCrash(t *testing.T) {
 	fmt.Println("Starting server crash result test - 1 wins")
-	cfg := makeConfig(t, 5, 7, 3, []int{0, 0, 0, 1, 1, 1, 1}, false)
+	cfg := makeConfig(t, 5, 7, 3, referendum, []int{0, 0, 0, 1, 1, 1, 1}, false)
 
-	randomServer := int(nrand(5))
+	randomServer := cfg.rand.Intn(5)
 	cfg.crashCounter(randomServer)
 	cfg.crashCounter((randomServer + 1) % 5)
 	cfg.crashCounter((randomServer + 2) % 5)
@@ -156,9 +511,9 @@ func TestServerCrash(t *testing.T) {
 // Test crasher with servers and unreliable network
 func TestServerCrashUnreliable(t *testing.T) {
 	fmt.Println("Starting server crash unreliable result test - 0 wins")
-	cfg := makeConfig(t, 5, 7, 3, []int{0, 0, 0, 0, 1, 1, 1}, true)
+	cfg := makeConfig(t, 5, 7, 3, referendum, []int{0, 0, 0, 0, 1, 1, 1}, true)
 
-	randomServer := int(nrand(5))
+	randomServer := cfg.rand.Intn(5)
 	cfg.crashCounter(randomServer)
 	cfg.crashCounter((randomServer + 1) % 5)
 	cfg.crashCounter((randomServer + 2) % 5)
@@ -182,3 +537,1838 @@ func TestServerCrashUnreliable(t *testing.T) {
 
 	cfg.cleanup()
 }
+
+// Test counter crash after voting, with recovery from persisted state
+func TestCounterCrashRecovery(t *testing.T) {
+	fmt.Println("Starting counter crash recovery test - 1 wins")
+	cfg := makeConfig(t, 3, 5, 3, referendum, []int{0, 0, 1, 1, 1}, true)
+
+	cfg.startVoting()
+	cfg.waitVoters()
+
+	cfg.crashCounter(1)
+	time.Sleep(1000 * time.Millisecond)
+	cfg.startCounter(1)
+	cfg.connectCounter(1)
+
+	done, result := cfg.electionResult()
+	if !done || result.Winner != 1 || result.Ballots != 5 {
+		cfg.t.Fatalf("expecting 1 to win with 5 ballots, but got %v", result)
+	}
+	if !reflect.DeepEqual(result.Tally, cfg.expectedTally()) {
+		cfg.t.Fatalf("expecting tally %v, but got %v", cfg.expectedTally(), result.Tally)
+	} else {
+		fmt.Println("ok")
+	}
+
+	cfg.cleanup()
+}
+
+// Test replacing a counter that is lost with its state and key
+// during the election
+func TestReplaceCounter(t *testing.T) {
+	fmt.Println("Starting replace counter test - 1 wins")
+	deadlines := Deadlines{Voting: 3000 * time.Millisecond, Exchange: 10000 * time.Millisecond}
+	cfg := makeConfigDeadlines(t, 3, 5, 2, referendum, []int{1, 0, 1, 1, 0}, false, deadlines)
+
+	for i := 0; i < 3; i++ {
+		cfg.vote(i)
+	}
+	var lost map[int64][]int64
+	for iters := 0; lost == nil; iters++ {
+		if iters == 30 {
+			cfg.t.Fatalf("expecting counter 2 to get the first 3 ballots")
+		}
+		time.Sleep(100 * time.Millisecond)
+		vc := cfg.election(2)
+		vc.mu.Lock()
+		if len(vc.votes) == 3 {
+			lost = make(map[int64][]int64)
+			for id, vote := range vc.votes {
+				lost[id] = vote
+			}
+		}
+		vc.mu.Unlock()
+	}
+
+	// the last ballots never reach the counter being replaced
+	cfg.crashCounter(2)
+	cfg.vote(3)
+	cfg.vote(4)
+	time.Sleep(500 * time.Millisecond)
+
+	cfg.replaceCounter(2)
+
+	done, result := cfg.electionResult()
+	if !done || result.Winner != 1 || result.Ballots != 5 {
+		cfg.t.Fatalf("expecting 1 to win with 5 ballots, but got %v", result)
+	}
+	if !reflect.DeepEqual(result.Counters, []int{1, 2, 3}) {
+		cfg.t.Fatalf("expecting the replacement's total to be used, but got %v", result.Counters)
+	}
+
+	vc := cfg.election(2)
+	vc.mu.Lock()
+	if len(vc.votes) != 5 {
+		cfg.t.Fatalf("expecting the replacement to hold 5 ballots, but got %v", len(vc.votes))
+	}
+	for id, vote := range lost {
+		if !reflect.DeepEqual(vc.votes[id], vote) {
+			cfg.t.Fatalf("expecting voter %v's share %v to be rebuilt, but got %v", id, vote, vc.votes[id])
+		}
+	}
+	vc.mu.Unlock()
+
+	// a helper's pieces don't give its own shares away
+	helper := cfg.election(0)
+	args := ReshareArgs{cfg.registry.ElectionId, 3, []int{1, 2}, nrand(0), cfg.counterKeys[2].PublicKey().Bytes()}
+	reply := ReshareReply{}
+	helper.Reshare(&args, &reply)
+	if !reply.Success || len(reply.Voters) != 5 {
+		cfg.t.Fatalf("expecting counter 0 to reshare 5 ballots, but got %v", reply.Err)
+	}
+	lagrange, _ := votingField.LagrangeAt(args.Helpers, args.Index)
+	helper.mu.Lock()
+	for i, id := range reply.Voters {
+		piece, _, ok := openShare(cfg.counterKeys[2], id, args.Index, reply.Pieces[i], len(referendum))
+		unmasked := new(big.Int).Mul(lagrange[0], big.NewInt(helper.votes[id][1]))
+		if !ok || votingField.Reduce(unmasked).Int64() == piece[1] {
+			cfg.t.Fatalf("expecting voter %v's piece to be masked", id)
+		}
+	}
+	helper.mu.Unlock()
+	cfg.cleanup()
+
+	// once the others' voting has closed, and the replacement's
+	// own voting has closed too before it recovers
+	cfg = makeConfigDeadlines(t, 3, 5, 2, referendum, []int{1, 0, 1, 1, 0}, false, deadlines)
+	for i := 0; i < 3; i++ {
+		cfg.vote(i)
+	}
+	lost = nil
+	for iters := 0; lost == nil; iters++ {
+		if iters == 30 {
+			cfg.t.Fatalf("expecting counter 2 to get the first 3 ballots")
+		}
+		time.Sleep(100 * time.Millisecond)
+		vc := cfg.election(2)
+		vc.mu.Lock()
+		if len(vc.votes) == 3 {
+			lost = make(map[int64][]int64)
+			for id, vote := range vc.votes {
+				lost[id] = vote
+			}
+		}
+		vc.mu.Unlock()
+	}
+
+	cfg.crashCounter(2)
+	cfg.vote(3)
+	cfg.vote(4)
+	for iters := 0; ; iters++ {
+		if iters == 30 {
+			cfg.t.Fatalf("expecting the voting to close with every ballot")
+		}
+		time.Sleep(100 * time.Millisecond)
+		status0, _ := cfg.counters[0].QueryElection(cfg.registry.ElectionId)
+		status1, _ := cfg.counters[1].QueryElection(cfg.registry.ElectionId)
+		if status0.Phase >= VotingClosed && status1.Phase >= VotingClosed {
+			break
+		}
+	}
+
+	cfg.startReplacement(2)
+	if err := cfg.counters[2].CloseElection(cfg.registry.ElectionId); err != OK {
+		cfg.t.Fatalf("expecting the replacement to close its voting, but got %v", err)
+	}
+	cfg.counters[2].Recover()
+
+	for iters := 0; ; iters++ {
+		if iters == 100 {
+			cfg.t.Fatalf("expecting the replacement to recover once the voting has closed")
+		}
+		time.Sleep(100 * time.Millisecond)
+		vc := cfg.election(2)
+		vc.mu.Lock()
+		recovered := !vc.recovering && len(vc.votes) == 5
+		vc.mu.Unlock()
+		if recovered {
+			break
+		}
+	}
+
+	vc = cfg.election(2)
+	vc.mu.Lock()
+	for id, vote := range lost {
+		if !reflect.DeepEqual(vc.votes[id], vote) {
+			cfg.t.Fatalf("expecting voter %v's share %v to be rebuilt, but got %v", id, vote, vc.votes[id])
+		}
+	}
+	vc.mu.Unlock()
+
+	done, result = cfg.electionResult()
+	if !done || result.Winner != 1 || result.Ballots != 5 {
+		cfg.t.Fatalf("expecting 1 to win with 5 ballots, but got %v", result)
+	}
+
+	fmt.Println("ok")
+
+	cfg.cleanup()
+}
+
+// Test that a counter that chose the common voters without a voter
+// set that came too late ends up with those of the others
+func TestDelayedVoterSet(t *testing.T) {
+	fmt.Println("Starting delayed voter set test - 1 wins")
+	deadlines := Deadlines{Voting: 1500 * time.Millisecond, Exchange: 1000 * time.Millisecond}
+	cfg := makeConfigDeadlines(t, 3, 5, 2, referendum, []int{1, 0, 1, 1, 0}, false, deadlines)
+
+	// voter 4's ballot never reaches counter 0, and counter 2's
+	// voter set only gets there once counter 0 has chosen without it
+	cfg.net.Enable(cfg.voterEndnames[4][0], false)
+	cfg.net.Enable(cfg.counterEndnames[2][0], false)
+	cfg.startVoting()
+
+	for iters := 0; cfg.election(0).Phase() < ExchangingTotals; iters++ {
+		if iters == 100 {
+			cfg.t.Fatalf("expecting counter 0 to choose the common voters")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	cfg.net.Enable(cfg.counterEndnames[2][0], true)
+
+	var results []Result
+	for i := 0; i < cfg.nCounters; i++ {
+		for iters := 0; ; iters++ {
+			if iters == 100 {
+				cfg.t.Fatalf("expecting counter %v to have a result", i)
+			}
+			if done, result := cfg.election(i).Done(); done {
+				results = append(results, result)
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	for i, result := range results {
+		if result.Winner != 1 || result.Ballots != 5 || !reflect.DeepEqual(result.Tally, cfg.expectedTally()) {
+			cfg.t.Fatalf("expecting counter %v to count 5 ballots for 1 to win, but got %v", i, result)
+		}
+		vc := cfg.election(i)
+		vc.mu.Lock()
+		common := vc.commonVoters
+		vc.mu.Unlock()
+		if len(common) != 5 {
+			cfg.t.Fatalf("expecting counter %v to end up with all 5 voters in common, but got %v", i, common)
+		}
+	}
+
+	// counter 0 chose without voter 4, but only the voters the
+	// others chose were ever added up
+	vc := cfg.election(0)
+	vc.mu.Lock()
+	own := vc.choices[1].Voters
+	vc.mu.Unlock()
+	if len(own) != 4 {
+		cfg.t.Fatalf("expecting counter 0 to choose 4 voters, but got %v", own)
+	}
+
+	fmt.Println("ok")
+
+	cfg.cleanup()
+}
+
+// Test every counter crashing after voting, with recovery
+func TestProactiveRefresh(t *testing.T) {
+	fmt.Println("Starting proactive refresh test - 1 wins")
+	deadlines := Deadlines{Voting: 6000 * time.Millisecond, Exchange: 10000 * time.Millisecond, Refresh: 200 * time.Millisecond}
+	cfg := makeConfigDeadlines(t, 3, 5, 2, referendum, []int{1, 0, 1, 1, 0}, false, deadlines)
+
+	for i := 0; i < 3; i++ {
+		cfg.vote(i)
+	}
+	id := cfg.voters[0].voterId
+
+	// counter 0's share of voter 0, and its epoch
+	snapshot := func() (int, int64) {
+		vc := cfg.election(0)
+		vc.mu.Lock()
+		defer vc.mu.Unlock()
+		if vote, ok := vc.votes[id]; ok {
+			return vc.epoch, vote[1]
+		}
+		return -1, 0
+	}
+	epoch, stolen := snapshot()
+	for iters := 0; epoch < 0; iters++ {
+		if iters == 30 {
+			cfg.t.Fatalf("expecting counter 0 to get voter 0's ballot")
+		}
+		time.Sleep(100 * time.Millisecond)
+		epoch, stolen = snapshot()
+	}
+
+	// wait for two more refreshes, then take counters 0 and 1's
+	// shares from the same epoch
+	var shares []shamir.Share
+	for iters := 0; shares == nil; iters++ {
+		if iters == 50 {
+			cfg.t.Fatalf("expecting the counters to refresh their shares past epoch %v", epoch+1)
+		}
+		time.Sleep(100 * time.Millisecond)
+		vc0, vc1 := cfg.election(0), cfg.election(1)
+		vc0.mu.Lock()
+		vc1.mu.Lock()
+		if vc0.epoch >= epoch+2 && vc0.epoch == vc1.epoch {
+			shares = []shamir.Share{
+				{X: 1, Y: big.NewInt(vc0.votes[id][1])},
+				{X: 2, Y: big.NewInt(vc1.votes[id][1])},
+			}
+		}
+		vc1.mu.Unlock()
+		vc0.mu.Unlock()
+	}
+
+	secret, err := votingField.Combine(shares)
+	if err != nil || secret.Int64() != int64(cfg.votes[0]) {
+		cfg.t.Fatalf("expecting refreshed shares to give voter 0's vote %v, but got %v %v", cfg.votes[0], secret, err)
+	}
+	secret, err = votingField.Combine([]shamir.Share{{X: 1, Y: big.NewInt(stolen)}, shares[1]})
+	if err != nil || secret.Int64() == int64(cfg.votes[0]) {
+		cfg.t.Fatalf("expecting a share from before the refresh to be useless, but got %v %v", secret, err)
+	}
+
+	// the last ballots arrive after the refreshes
+	cfg.vote(3)
+	cfg.vote(4)
+
+	done, result := cfg.electionResult()
+	if !done || result.Winner != 1 || result.Ballots != 5 {
+		cfg.t.Fatalf("expecting 1 to win with 5 ballots, but got %v", result)
+	}
+	if !reflect.DeepEqual(result.Tally, cfg.expectedTally()) {
+		cfg.t.Fatalf("expecting tally %v, but got %v", cfg.expectedTally(), result.Tally)
+	}
+
+	for i := 0; i < cfg.nCounters; i++ {
+		vc := cfg.election(i)
+		vc.mu.Lock()
+		for id := range vc.votes {
+			if !vc.validShares(vc.votes[id], vc.blinds[id], vc.currentCommitments(id)) {
+				cfg.t.Fatalf("expecting counter %v's refreshed shares of voter %v to match the commitments", i, id)
+			}
+		}
+		vc.mu.Unlock()
+	}
+
+	// the epoch survives a restart
+	epoch = cfg.election(1).Epoch()
+	cfg.crashCounter(1)
+	cfg.startCounter(1)
+	if got := cfg.election(1).Epoch(); got != epoch {
+		cfg.t.Fatalf("expecting counter 1 to restart in epoch %v, but got %v", epoch, got)
+	}
+
+	fmt.Println("ok")
+
+	cfg.cleanup()
+}
+
+// Test that breaking into threshold counters in different refresh
+// epochs doesn't give away a ballot
+func TestCompromiseAcrossEpochs(t *testing.T) {
+	fmt.Println("Starting compromise across epochs test")
+	deadlines := Deadlines{Voting: 6000 * time.Millisecond, Exchange: 10000 * time.Millisecond, Refresh: 200 * time.Millisecond}
+	cfg := makeConfigDeadlines(t, 3, 5, 2, referendum, []int{1, 0, 1, 1, 0}, false, deadlines)
+
+	for i := 0; i < 3; i++ {
+		cfg.vote(i)
+	}
+	id := cfg.voters[0].voterId
+
+	// what an attacker gets from breaking into counter i: its key,
+	// its disk, and its share of voter 0, once it holds one
+	type loot struct {
+		epoch int
+		share int64
+		disk  []byte
+	}
+	breakIn := func(i, after int) loot {
+		for iters := 0; iters < 50; iters++ {
+			vc := cfg.election(i)
+			vc.mu.Lock()
+			vote, ok := vc.votes[id]
+			stolen := loot{vc.epoch, 0, cfg.counterSaved[i].readPersistState()}
+			vc.mu.Unlock()
+			if ok && stolen.epoch > after {
+				stolen.share = vote[1]
+				return stolen
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		cfg.t.Fatalf("expecting counter %v to hold voter 0 past epoch %v", i, after)
+		return loot{}
+	}
+	first := breakIn(0, -1)
+	second := breakIn(1, first.epoch)
+
+	secret, err := votingField.Combine([]shamir.Share{{X: 1, Y: big.NewInt(first.share)}, {X: 2, Y: big.NewInt(second.share)}})
+	if err != nil || secret.Int64() == int64(cfg.votes[0]) {
+		cfg.t.Fatalf("expecting shares from epochs %v and %v to be useless, but got %v %v", first.epoch, second.epoch, secret, err)
+	}
+
+	// nor is anything left on the counters' disks that their keys
+	// could open for the first shares
+	for i, stolen := range []loot{first, second} {
+		for v := 0; v < 3; v++ {
+			cfg.voters[v].mu.Lock()
+			sealed := cfg.voters[v].sealed
+			cfg.voters[v].mu.Unlock()
+			for j, sealed := range sealed {
+				if bytes.Contains(stolen.disk, sealed.Ciphertext) {
+					cfg.t.Fatalf("expecting counter %v to keep none of voter %v's sealed shares, but it kept counter %v's", i, v, j)
+				}
+			}
+		}
+	}
+
+	fmt.Println("ok")
+
+	cfg.cleanup()
+}
+
+// Test the refreshes going on after the counter that fixes their
+// dealers crashes
+func TestRefreshDeadCounter(t *testing.T) {
+	fmt.Println("Starting refresh with a dead counter test - 1 wins")
+	deadlines := Deadlines{Voting: 10000 * time.Millisecond, Exchange: 10000 * time.Millisecond, Refresh: 200 * time.Millisecond}
+	cfg := makeConfigDeadlines(t, 3, 5, 2, referendum, []int{1, 0, 1, 1, 0}, false, deadlines)
+
+	for i := 0; i < 3; i++ {
+		cfg.vote(i)
+	}
+	id := cfg.voters[0].voterId
+
+	epochs := func() (int, int) {
+		vc1, vc2 := cfg.election(1), cfg.election(2)
+		vc1.mu.Lock()
+		defer vc1.mu.Unlock()
+		vc2.mu.Lock()
+		defer vc2.mu.Unlock()
+		return vc1.epoch, vc2.epoch
+	}
+	for iters := 0; ; iters++ {
+		if iters == 50 {
+			cfg.t.Fatalf("expecting the counters to refresh their shares")
+		}
+		time.Sleep(100 * time.Millisecond)
+		if epoch1, epoch2 := epochs(); epoch1 > 0 && epoch2 > 0 {
+			break
+		}
+	}
+
+	cfg.crashCounter(0)
+	epoch, _ := epochs()
+
+	// wait for two more refreshes, then take counters 1 and 2's
+	// shares from the same epoch
+	var shares []shamir.Share
+	for iters := 0; shares == nil; iters++ {
+		if iters == 50 {
+			cfg.t.Fatalf("expecting counters 1 and 2 to refresh their shares past epoch %v without counter 0", epoch+1)
+		}
+		time.Sleep(100 * time.Millisecond)
+		vc1, vc2 := cfg.election(1), cfg.election(2)
+		vc1.mu.Lock()
+		vc2.mu.Lock()
+		if vc1.epoch >= epoch+2 && vc1.epoch == vc2.epoch {
+			shares = []shamir.Share{
+				{X: 2, Y: big.NewInt(vc1.votes[id][1])},
+				{X: 3, Y: big.NewInt(vc2.votes[id][1])},
+			}
+		}
+		vc2.mu.Unlock()
+		vc1.mu.Unlock()
+	}
+
+	secret, err := votingField.Combine(shares)
+	if err != nil || secret.Int64() != int64(cfg.votes[0]) {
+		cfg.t.Fatalf("expecting refreshed shares to give voter 0's vote %v, but got %v %v", cfg.votes[0], secret, err)
+	}
+
+	cfg.vote(3)
+	cfg.vote(4)
+	done, result := cfg.electionResult()
+	if !done || result.Winner != 1 || result.Ballots != 5 {
+		cfg.t.Fatalf("expecting 1 to win with 5 ballots, but got %v", result)
+	}
+	if !reflect.DeepEqual(result.Tally, cfg.expectedTally()) {
+		cfg.t.Fatalf("expecting tally %v, but got %v", cfg.expectedTally(), result.Tally)
+	}
+
+	fmt.Println("ok")
+
+	cfg.cleanup()
+}
+
+func TestFailureDetection(t *testing.T) {
+	fmt.Println("Starting failure detection test - 1 wins")
+	deadlines := Deadlines{Voting: 10000 * time.Millisecond, Exchange: 10000 * time.Millisecond}
+	cfg := makeConfigDeadlines(t, 5, 5, 3, referendum, []int{1, 0, 1, 1, 0}, false, deadlines)
+
+	for counter, h := range cfg.counters[0].Health() {
+		if h.Status != Alive {
+			cfg.t.Fatalf("expecting counter %v to start out alive, but got %v", counter, h.Status)
+		}
+	}
+
+	cfg.crashCounter(4)
+
+	suspected := false
+	for iters := 0; ; iters++ {
+		if iters == 50 {
+			cfg.t.Fatalf("expecting counter 4 to be found dead")
+		}
+		time.Sleep(50 * time.Millisecond)
+
+		health := cfg.counters[0].Health()
+		if health[4].Status == Suspected {
+			suspected = true
+		}
+		if health[4].Status == Dead {
+			if !suspected {
+				cfg.t.Fatalf("expecting counter 4 to be suspected before it is dead")
+			}
+			if health[4].Since.Before(health[4].LastHeard) {
+				cfg.t.Fatalf("expecting counter 4 to have died after it was last heard from")
+			}
+			for counter := 1; counter < 4; counter++ {
+				if health[counter].Status != Alive {
+					cfg.t.Fatalf("expecting counter %v to be alive, but got %v", counter, health[counter].Status)
+				}
+			}
+			break
+		}
+	}
+
+	// the others don't wait out the deadlines for the dead counter
+	start := time.Now()
+	cfg.startVoting()
+	done, result := cfg.electionResult()
+	if !done || result.Winner != 1 || result.Ballots != 5 {
+		cfg.t.Fatalf("expecting 1 to win with 5 ballots, but got %v", result)
+	}
+	if time.Since(start) >= deadlines.Exchange {
+		cfg.t.Fatalf("expecting a result before the exchange deadline, but took %v", time.Since(start))
+	}
+
+	cfg.startCounter(4)
+	cfg.connectCounter(4)
+	time.Sleep(time.Duration(3*heartbeatInterval) * time.Millisecond)
+	if h := cfg.counters[0].Health()[4]; h.Status != Alive {
+		cfg.t.Fatalf("expecting counter 4 to be alive again, but got %v", h.Status)
+	}
+
+	fmt.Println("ok")
+
+	cfg.cleanup()
+}
+
+func TestReplicatedSeats(t *testing.T) {
+	fmt.Println("Starting replicated seats test - 1 wins")
+	deadlines := Deadlines{Voting: 10000 * time.Millisecond, Exchange: 3000 * time.Millisecond}
+	cfg := makeSeatConfig(t, 3, 3, 5, 2, referendum, []int{1, 0, 1, 1, 0}, deadlines)
+
+	held := func(vc *VoteCounter) int {
+		status, _ := vc.QueryElection(cfg.registry.ElectionId)
+		return status.Ballots
+	}
+
+	for i := 0; i < 3; i++ {
+		cfg.voters[i].Vote()
+	}
+	leaders := make([]int, cfg.nSeats)
+	for s := 0; s < cfg.nSeats; s++ {
+		for iters := 0; ; iters++ {
+			if iters == 50 {
+				cfg.t.Fatalf("expecting seat %v to commit the first 3 ballots", s)
+			}
+			time.Sleep(100 * time.Millisecond)
+			if r, vc := cfg.leader(s); vc != nil && held(vc) == 3 {
+				leaders[s] = r
+				break
+			}
+		}
+	}
+
+	// every seat loses the replica running its counter, disk and all
+	for s := 0; s < cfg.nSeats; s++ {
+		cfg.crashReplica(s, leaders[s])
+	}
+	cfg.voters[3].Vote()
+	cfg.voters[4].Vote()
+
+	var result Result
+	done := false
+	for iters := 0; iters < 100 && !done; iters++ {
+		time.Sleep(100 * time.Millisecond)
+		for s := 0; s < cfg.nSeats && !done; s++ {
+			if _, vc := cfg.leader(s); vc != nil {
+				status, _ := vc.QueryElection(cfg.registry.ElectionId)
+				done, result = status.Done, status.Result
+			}
+		}
+	}
+	if !done || result.Winner != 1 || result.Ballots != 5 {
+		cfg.t.Fatalf("expecting 1 to win with 5 ballots, but got %v", result)
+	}
+	if !reflect.DeepEqual(result.Tally, []int64{2, 3}) {
+		cfg.t.Fatalf("expecting tally [2 3], but got %v", result.Tally)
+	}
+
+	// a call that isn't to a counter RPC fails, rather than getting
+	// an empty reply
+	var seatErr *SeatError
+	err := cfg.seatEnds(voterNode(0))[0].CallContext(context.Background(), "VoteCounter.NoSuchMethod", &GetResultArgs{}, &GetResultReply{})
+	if !errors.As(err, &seatErr) || seatErr.Err != ErrUnknownMethod {
+		cfg.t.Fatalf("expecting %v for an unknown method, but got %v", ErrUnknownMethod, err)
+	}
+
+	for s := 0; s < cfg.nSeats; s++ {
+		r, vc := cfg.leader(s)
+		if vc == nil || r == leaders[s] {
+			cfg.t.Fatalf("expecting another replica to run seat %v's counter", s)
+		}
+		if n := held(vc); n != 5 {
+			cfg.t.Fatalf("expecting seat %v to have kept all 5 ballots, but got %v", s, n)
+		}
+	}
+
+	// the replicas keep the last state, not every state before it
+	cfg.mu.Lock()
+	for s := 0; s < cfg.nSeats; s++ {
+		for r, persister := range cfg.raftSaved[s] {
+			if persister != nil && persister.RaftStateSize() > 4*persister.SnapshotSize() {
+				cfg.t.Fatalf("expecting seat %v's replica %v to compact its log, but it takes %v bytes", s, r, persister.RaftStateSize())
+			}
+		}
+	}
+	cfg.mu.Unlock()
+
+	fmt.Println("ok")
+
+	cfg.cleanup()
+}
+
+func TestAllCountersCrashRecovery(t *testing.T) {
+	fmt.Println("Starting all counters crash recovery test - 0 wins")
+	cfg := makeConfig(t, 5, 7, 3, referendum, []int{0, 0, 0, 0, 1, 1, 1}, false)
+	cfg.crashVoter(6) // keep the voting open until the deadline
+
+	cfg.startVoting()
+	cfg.waitVoters()
+
+	for i := 0; i < cfg.nCounters; i++ {
+		cfg.crashCounter(i)
+	}
+	for i := 0; i < cfg.nCounters; i++ {
+		cfg.startCounter(i)
+		cfg.connectCounter(i)
+	}
+
+	done, result := cfg.electionResult()
+	if !done || result.Winner != 0 || result.Ballots != 6 {
+		cfg.t.Fatalf("expecting 0 to win with 6 ballots, but got %v", result)
+	} else {
+		fmt.Println("ok")
+	}
+
+	cfg.cleanup()
+}
+
+// Test that every voter learns the result from the committee
+func TestVotersLearnResult(t *testing.T) {
+	fmt.Println("Starting voters learn result test - 1 wins")
+	cfg := makeConfig(t, 5, 7, 3, referendum, []int{1, 0, 1, 0, 1, 1, 0}, true)
+	cfg.crashCounter(0)
+	cfg.crashCounter(3)
+
+	cfg.startVoting()
+
+	done, result := cfg.electionResult()
+	if !done || result.Winner != 1 {
+		cfg.t.Fatalf("expecting 1 to win, but got %v", result)
+	}
+
+	for iters := 0; iters < 30; iters++ {
+		learned := 0
+		for i := 0; i < cfg.nVoters; i++ {
+			if voterDone, voterResult := cfg.voters[i].Result(); voterDone {
+				if !reflect.DeepEqual(voterResult, result) {
+					cfg.t.Fatalf("voter %v expected result %v, but got %v", i, result, voterResult)
+				}
+				learned++
+			}
+		}
+		if learned == cfg.nVoters {
+			fmt.Println("ok")
+			cfg.cleanup()
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	cfg.t.Fatalf("expecting every voter to learn the result")
+}
+
+func TestVerifyShare(t *testing.T) {
+	fmt.Println("Starting verify share test")
+	vt := MakeVoter(make([]Endpoint, 5), nil, unregisteredCredential(t), referendum, 1, 3, &MemPersister{})
+
+	for i := range vt.shares {
+		for c := range referendum {
+			if !verifyShare(vt.commitments[c], int64(i+1), vt.shares[i][c], vt.blinds[i][c]) {
+				t.Fatalf("share %v of candidate %v doesn't match its commitments", i, c)
+			}
+			if verifyShare(vt.commitments[c], int64(i+1), (vt.shares[i][c]+1)%field, vt.blinds[i][c]) {
+				t.Fatalf("tampered share %v of candidate %v matches its commitments", i, c)
+			}
+			if verifyShare(vt.commitments[c], int64(i+2), vt.shares[i][c], vt.blinds[i][c]) {
+				t.Fatalf("share %v of candidate %v matches the wrong counter", i, c)
+			}
+		}
+	}
+
+	fmt.Println("ok")
+}
+
+// Test that commitments outside the order-field subgroup are rejected,
+// as they could match some counters' shares but not the others'
+func TestCommitmentOutsideGroup(t *testing.T) {
+	fmt.Println("Starting commitment outside group test")
+	vt := MakeVoter(make([]Endpoint, 5), nil, unregisteredCredential(t), referendum, 1, 3, &MemPersister{})
+
+	// an element of order 5, so that w^x is 1 for x = 5 only
+	var w *big.Int
+	for a := int64(2); w == nil || w.Cmp(big.NewInt(1)) == 0; a++ {
+		w = expP(big.NewInt(a), big.NewInt(4*field))
+	}
+
+	for c := range referendum {
+		commitments := append([]int64(nil), vt.commitments[c]...)
+		commitments[1] = mulP(big.NewInt(commitments[1]), w).Int64()
+		for i := range vt.shares {
+			if verifyShare(commitments, int64(i+1), vt.shares[i][c], vt.blinds[i][c]) {
+				t.Fatalf("share %v of candidate %v matches commitments outside the group", i, c)
+			}
+		}
+	}
+
+	fmt.Println("ok")
+}
+
+// Test that a counter rejects a share that doesn't match its commitments
+func TestCorruptShareRejected(t *testing.T) {
+	fmt.Println("Starting corrupt share test - 1 wins")
+	cfg := makeConfig(t, 5, 7, 3, referendum, []int{0, 0, 1, 1, 1, 0, 1}, false)
+
+	vt := cfg.voters[2]
+	vt.mu.Lock()
+	vt.shares[0][1] = (vt.shares[0][1] + 1) % field
+	vt.mu.Unlock()
+
+	cfg.startVoting()
+	cfg.waitVoters()
+
+	vc := cfg.election(0)
+	vc.mu.Lock()
+	_, accepted := vc.votes[vt.voterId]
+	vc.mu.Unlock()
+	if accepted {
+		cfg.t.Fatalf("expecting counter 0 to reject the corrupt share")
+	}
+
+	done, result := cfg.electionResult()
+	if !done || result.Winner != 1 || result.Ballots != 7 {
+		cfg.t.Fatalf("expecting 1 to win with 7 ballots, but got %v", result)
+	}
+	if result.Counters[0] == 1 {
+		cfg.t.Fatalf("expecting counter 0 to be left out, but got %v", result.Counters)
+	} else {
+		fmt.Println("ok")
+	}
+
+	cfg.cleanup()
+}
+
+// Test a voter that shares different polynomials with different counters
+func TestEquivocatingVoter(t *testing.T) {
+	fmt.Println("Starting equivocating voter test - 0 wins")
+	cfg := makeConfig(t, 5, 5, 3, referendum, []int{0, 0, 1, 1, 1}, false)
+	cfg.crashVoter(4)
+
+	// two ballots for voter 4, each consistent on its own
+	first := MakeVoter(make([]Endpoint, 5), cfg.counterPublicKeys(), cfg.credentials[4], referendum, 0, 3, &MemPersister{})
+	second := MakeVoter(make([]Endpoint, 5), cfg.counterPublicKeys(), cfg.credentials[4], referendum, 1, 3, &MemPersister{})
+	for i := 0; i < cfg.nCounters; i++ {
+		ballot := first
+		if i >= 2 {
+			ballot = second
+		}
+		args := ballot.ballot(i)
+		reply := CountVoteReply{}
+		cfg.election(i).CountVote(&args, &reply)
+		if !reply.Success {
+			cfg.t.Fatalf("expecting counter %v to accept a consistent share, but got %v", i, reply.Err)
+		}
+	}
+
+	cfg.startVoting()
+
+	done, result := cfg.electionResult()
+	if !done || result.Winner != NoWinner || result.Ballots != 4 {
+		cfg.t.Fatalf("expecting a tie of 4 ballots without voter 4, but got %v", result)
+	}
+	if !reflect.DeepEqual(result.Tally, []int64{2, 2}) {
+		cfg.t.Fatalf("expecting tally [2 2], but got %v", result.Tally)
+	} else {
+		fmt.Println("ok")
+	}
+
+	cfg.cleanup()
+}
+
+// Test that a retried ballot is taken once, and that a different
+// ballot from the same voter gets it disqualified everywhere
+func TestConflictingResubmission(t *testing.T) {
+	fmt.Println("Starting conflicting resubmission test - tie")
+	cfg := makeConfig(t, 5, 5, 3, referendum, []int{0, 0, 1, 1, 1}, false)
+	cfg.crashVoter(4)
+
+	credential := cfg.credentials[4]
+	first := MakeVoter(make([]Endpoint, 5), cfg.counterPublicKeys(), credential, referendum, 1, 3, &MemPersister{})
+	second := MakeVoter(make([]Endpoint, 5), cfg.counterPublicKeys(), credential, referendum, 0, 3, &MemPersister{})
+
+	for i := 0; i < cfg.nCounters; i++ {
+		args := first.ballot(i)
+		for try := 0; try < 2; try++ {
+			reply := CountVoteReply{}
+			cfg.election(i).CountVote(&args, &reply)
+			if !reply.Success {
+				cfg.t.Fatalf("expecting counter %v to accept the ballot again, but got %v", i, reply.Err)
+			}
+		}
+	}
+
+	args := second.ballot(0)
+	reply := CountVoteReply{}
+	cfg.election(0).CountVote(&args, &reply)
+	if reply.Success || reply.Err != ErrConflictingShare {
+		cfg.t.Fatalf("expecting %v, but got %v", ErrConflictingShare, reply)
+	}
+
+	vc := cfg.election(0)
+	vc.mu.Lock()
+	kept := vc.votes[credential.VoterId]
+	vc.mu.Unlock()
+	if !reflect.DeepEqual(kept, first.shares[0]) {
+		cfg.t.Fatalf("expecting the first share to be kept, but got %v", kept)
+	}
+
+	// every counter hears about it
+	for iters := 0; iters < 30; iters++ {
+		reported := 0
+		for i := 0; i < cfg.nCounters; i++ {
+			vc := cfg.election(i)
+			vc.mu.Lock()
+			if _, ok := vc.equivocations[credential.VoterId]; ok {
+				reported++
+			}
+			vc.mu.Unlock()
+		}
+		if reported == cfg.nCounters {
+			break
+		}
+		if iters == 29 {
+			cfg.t.Fatalf("expecting every counter to learn of the equivocation, but only %v did", reported)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	cfg.startVoting()
+
+	done, result := cfg.electionResult()
+	if !done || result.Winner != NoWinner || result.Ballots != 4 {
+		cfg.t.Fatalf("expecting a tie of 4 ballots without voter 4, but got %v", result)
+	}
+	if !reflect.DeepEqual(result.Tally, []int64{2, 2}) {
+		cfg.t.Fatalf("expecting tally [2 2], but got %v", result.Tally)
+	} else {
+		fmt.Println("ok")
+	}
+
+	cfg.cleanup()
+}
+
+func TestBallotProof(t *testing.T) {
+	fmt.Println("Starting ballot proof test")
+	candidates := []string{"Alice", "Bob", "Carol"}
+
+	for vote := range candidates {
+		vt := MakeVoter(make([]Endpoint, 3), nil, unregisteredCredential(t), candidates, vote, 2, &MemPersister{})
+		if !verifyBallot(vt.voterId, vt.commitments, vt.proof) {
+			t.Fatalf("expecting the proof of a vote for %v to verify", vote)
+		}
+		if verifyBallot(vt.voterId+1, vt.commitments, vt.proof) {
+			t.Fatalf("expecting the proof to be bound to the voter")
+		}
+	}
+
+	// a vote for no candidate isn't cast
+	for _, vote := range []int{-1, len(candidates)} {
+		vt := MakeVoter(make([]Endpoint, 3), nil, unregisteredCredential(t), candidates, vote, 2, &MemPersister{})
+		if err := vt.Vote(); err != ErrInvalidVote {
+			t.Fatalf("expecting a vote for %v to fail with %v, but got %v", vote, ErrInvalidVote, err)
+		}
+		vt.Kill()
+	}
+
+	invalid := [][]int64{{2, -1, 0}, {1, 1, 0}, {0, 0, 0}, {1000, 0, 0}}
+	for _, secrets := range invalid {
+		vt := MakeVoter(make([]Endpoint, 3), nil, unregisteredCredential(t), candidates, 0, 2, &MemPersister{})
+		vt.shareSecrets(secrets)
+		if verifyBallot(vt.voterId, vt.commitments, vt.proof) {
+			t.Fatalf("expecting the proof of %v not to verify", secrets)
+		}
+	}
+
+	fmt.Println("ok")
+}
+
+// Test that counters reject a ballot that is not one-hot
+func TestInvalidBallotRejected(t *testing.T) {
+	fmt.Println("Starting invalid ballot test - 0 wins")
+	cfg := makeConfig(t, 3, 5, 3, referendum, []int{0, 0, 1, 1, 1}, true)
+
+	vt := cfg.voters[4]
+	vt.mu.Lock()
+	vt.shareSecrets([]int64{-1000, 1001})
+	vt.mu.Unlock()
+
+	cfg.startVoting()
+
+	done, result := cfg.electionResult()
+	if !done || result.Ballots != 4 {
+		cfg.t.Fatalf("expecting a result without the invalid ballot, but got %v", result)
+	}
+	if !reflect.DeepEqual(result.Tally, []int64{2, 2}) {
+		cfg.t.Fatalf("expecting tally [2 2], but got %v", result.Tally)
+	} else {
+		fmt.Println("ok")
+	}
+
+	cfg.cleanup()
+}
+
+// Test that counters only take ballots signed by registered voters
+func TestSignedBallots(t *testing.T) {
+	fmt.Println("Starting signed ballots test - 1 wins")
+	cfg := makeConfig(t, 3, 3, 2, referendum, []int{1, 0, 1}, false)
+
+	// voter 0's ballot, which only voter 0's key can sign
+	victim := cfg.credentials[0]
+	forger := cfg.credentials[1]
+	ballot := MakeVoter(make([]Endpoint, 3), cfg.counterPublicKeys(), victim, referendum, 0, 2, &MemPersister{})
+	args := ballot.ballot(0)
+	args.Signature = nil
+
+	check := func(what string, expected Err) {
+		reply := CountVoteReply{}
+		cfg.election(0).CountVote(&args, &reply)
+		if reply.Success || reply.Err != expected {
+			cfg.t.Fatalf("expecting %v for %v, but got %v", expected, what, reply)
+		}
+	}
+
+	check("an unsigned ballot", ErrInvalidSignature)
+
+	forger.sign(&args)
+	check("a ballot signed by another voter", ErrInvalidSignature)
+
+	Credential{"another election", victim.VoterId, victim.Key}.sign(&args)
+	check("a ballot signed for another election", ErrInvalidSignature)
+
+	victim.sign(&args)
+	args.Sealed = ballot.sealed[1]
+	check("a ballot changed after it was signed", ErrInvalidSignature)
+
+	outsider := unregisteredCredential(t)
+	args.VoterId = outsider.VoterId
+	outsider.sign(&args)
+	check("an unregistered voter", ErrUnknownVoter)
+
+	vc := cfg.election(0)
+	vc.mu.Lock()
+	nVotes := len(vc.votes)
+	vc.mu.Unlock()
+	if nVotes != 0 {
+		cfg.t.Fatalf("expecting no ballots to be taken, but got %v", nVotes)
+	}
+
+	cfg.startVoting()
+
+	done, result := cfg.electionResult()
+	if !done || result.Winner != 1 || result.Ballots != 3 {
+		cfg.t.Fatalf("expecting 1 to win with 3 ballots, but got %v", result)
+	} else {
+		fmt.Println("ok")
+	}
+
+	cfg.cleanup()
+}
+
+// Test that an eavesdropper recording every ballot on the network
+// can't read any of the shares, while the counters can
+func TestSealedShares(t *testing.T) {
+	fmt.Println("Starting sealed shares test - 1 wins")
+	cfg := makeConfig(t, 5, 3, 3, referendum, []int{1, 0, 1}, false)
+
+	var mu sync.Mutex
+	transcript := make(map[interface{}][][]byte) // CountVote args, by end name
+	cfg.net.Tap(func(endname interface{}, svcMeth string, args []byte) {
+		if svcMeth == "VoteCounter.CountVote" {
+			mu.Lock()
+			transcript[endname] = append(transcript[endname], args)
+			mu.Unlock()
+		}
+	})
+
+	cfg.startVoting()
+
+	done, result := cfg.electionResult()
+	if !done || result.Winner != 1 {
+		cfg.t.Fatalf("expecting 1 to win, but got %v", result)
+	}
+	cfg.net.Tap(nil)
+
+	eavesdropper, _ := ecdh.X25519().GenerateKey(crand.Reader)
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i := 0; i < cfg.nVoters; i++ {
+		vt := cfg.voters[i]
+		vt.mu.Lock()
+		shares, blinds := vt.shares, vt.blinds
+		vt.mu.Unlock()
+
+		opened := make([]shamir.Share, 0)
+		for j := 0; j < cfg.nCounters; j++ {
+			messages := transcript[cfg.voterEndnames[i][j]]
+			if len(messages) == 0 {
+				cfg.t.Fatalf("expecting voter %v's ballot for counter %v on the wire", i, j)
+			}
+
+			for _, raw := range messages {
+				for c := range referendum {
+					for _, x := range []int64{shares[j][c], blinds[j][c]} {
+						if bytes.Contains(raw, binary.BigEndian.AppendUint64(nil, uint64(x))) {
+							cfg.t.Fatalf("voter %v's share for counter %v is on the wire in the clear", i, j)
+						}
+					}
+				}
+
+				args := CountVoteArgs{}
+				if err := labgob.NewDecoder(bytes.NewBuffer(raw)).Decode(&args); err != nil {
+					cfg.t.Fatalf("decode ballot: %v", err)
+				}
+				if _, _, ok := openShare(eavesdropper, args.VoterId, j+1, args.Sealed, len(referendum)); ok {
+					cfg.t.Fatalf("expecting the eavesdropper not to open voter %v's ballot", i)
+				}
+				for k := 0; k < cfg.nCounters; k++ {
+					vote, _, ok := openShare(cfg.counterKeys[k], args.VoterId, j+1, args.Sealed, len(referendum))
+					if ok != (k == j) {
+						cfg.t.Fatalf("expecting only counter %v to open its ballot, but counter %v: %v", j, k, ok)
+					}
+					if ok && len(opened) < cfg.threshold && (len(opened) == 0 || opened[len(opened)-1].X != j+1) {
+						opened = append(opened, shamir.Share{X: j + 1, Y: big.NewInt(vote[1])})
+					}
+				}
+			}
+		}
+
+		// with the counters' keys, the same messages give the vote back
+		secret, err := votingField.Combine(opened)
+		if err != nil || secret.Int64() != int64(cfg.votes[i]) {
+			cfg.t.Fatalf("expecting the counters to read voter %v's vote %v, but got %v %v", i, cfg.votes[i], secret, err)
+		}
+	}
+
+	fmt.Println("ok")
+
+	cfg.cleanup()
+}
+
+// Test that a counter sending a wrong total is detected and left out
+func TestFaultyCounterTotal(t *testing.T) {
+	fmt.Println("Starting faulty counter total test - 1 wins")
+	cfg := makeConfig(t, 5, 5, 3, referendum, []int{1, 0, 1, 0, 1}, false)
+
+	// counter 4 (index 5) tells everyone else a wrong total instead
+	// of its own: nothing it sends gets through, but its voter set,
+	// which we pass on with made-up ballots that mustn't get the
+	// voters left out
+	for j := 0; j < cfg.nCounters; j++ {
+		cfg.net.Enable(cfg.counterEndnames[4][j], false)
+	}
+
+	cfg.startVoting()
+
+	waitPhase := func(i int, phase Phase) {
+		for iters := 0; cfg.election(i).Phase() < phase; iters++ {
+			if iters == 100 {
+				cfg.t.Fatalf("expecting counter %v to reach %v", i, phase)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+
+	waitPhase(4, VotingClosed)
+	faulty := cfg.election(4)
+	faulty.mu.Lock()
+	voterSet := ExchangeVotersArgs{cfg.registry.ElectionId, 5, faulty.voterSets[5], faulty.ownBallots(), nil}
+	faulty.mu.Unlock()
+	for i := range voterSet.Ballots {
+		other := voterSet.Ballots[(i+1)%len(voterSet.Ballots)]
+		voterSet.Ballots[i].Commitments = other.Commitments
+	}
+	for i := 0; i < 4; i++ {
+		cfg.election(i).ExchangeVoters(&voterSet, &ExchangeVotersReply{})
+	}
+
+	for i := 0; i < 4; i++ {
+		el := cfg.election(i)
+		args := CountTotalArgs{cfg.registry.ElectionId, 5, []int64{nrand(field), nrand(field)}, cfg.commonVoters(i), 0, voterSet.Voters}
+		reply := CountTotalReply{}
+		el.CountTotal(&args, &reply)
+		if !reply.Success {
+			cfg.t.Fatalf("expecting counter %v to take counter 5's total", i)
+		}
+	}
+
+	done, result := cfg.electionResult()
+	if !done || result.Winner != 1 || result.Ballots != 5 {
+		cfg.t.Fatalf("expecting 1 to win with 5 ballots, but got %v", result)
+	}
+	if !reflect.DeepEqual(result.Tally, cfg.expectedTally()) {
+		cfg.t.Fatalf("expecting tally %v, but got %v", cfg.expectedTally(), result.Tally)
+	}
+
+	for iters := 0; iters < 30; iters++ {
+		if done, result = cfg.election(0).Done(); done {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if !reflect.DeepEqual(result.Faulty, []int{5}) || !reflect.DeepEqual(result.Counters, []int{1, 2, 3, 4}) {
+		cfg.t.Fatalf("expecting counter 5 to be faulty, but got %v", result)
+	} else {
+		fmt.Println("ok")
+	}
+
+	cfg.cleanup()
+}
+
+// Test that one counter can't send totals for the others
+func TestFaultyCounterIndexes(t *testing.T) {
+	fmt.Println("Starting faulty counter indexes test - 1 wins")
+	cfg := makeConfig(t, 5, 5, 3, referendum, []int{1, 0, 1, 0, 1}, false)
+
+	// an end of counter 4's to counter 0
+	endname := randstring(cfg.rand, 20)
+	end := cfg.net.MakeEnd(endname)
+	cfg.net.Connect(endname, 0)
+	cfg.net.Enable(endname, true)
+	cfg.net.SetOwner(endname, 4)
+
+	voters := make([]int64, 0)
+	for i := 0; i < cfg.nVoters; i++ {
+		voters = append(voters, cfg.voters[i].voterId)
+	}
+	voters = sortVoters(voters)
+
+	// a made-up total under every index, that would give a
+	// tally of [0 1000] if counter 0 took them
+	forge := func() int {
+		taken := 0
+		for index := 0; index <= cfg.nCounters+1; index++ {
+			args := CountTotalArgs{cfg.registry.ElectionId, index, []int64{0, 1000}, voters, 0, nil}
+			reply := CountTotalReply{}
+			if end.Call("VoteCounter.CountTotal", &args, &reply) && reply.Success {
+				taken++
+			}
+		}
+		return taken
+	}
+
+	// while voting
+	if taken := forge(); taken != 0 {
+		cfg.t.Fatalf("expecting counter 0 to take no totals while voting, but it took %v", taken)
+	}
+
+	// nor voter sets under indexes that aren't another counter's
+	for _, index := range []int{0, 1, cfg.nCounters + 1} {
+		args := ExchangeVotersArgs{cfg.registry.ElectionId, index, voters[:1], nil, nil}
+		reply := ExchangeVotersReply{}
+		cfg.election(0).ExchangeVoters(&args, &reply)
+		if reply.Success {
+			cfg.t.Fatalf("expecting counter 0 to refuse a voter set for index %v", index)
+		}
+	}
+	el := cfg.election(0)
+	el.mu.Lock()
+	nSets := len(el.voterSets)
+	el.mu.Unlock()
+	if nSets != 0 {
+		cfg.t.Fatalf("expecting counter 0 to hold no voter sets while voting, but it holds %v", nSets)
+	}
+
+	cfg.startVoting()
+
+	for iters := 0; cfg.election(0).Phase() < ExchangingTotals; iters++ {
+		if iters == 100 {
+			cfg.t.Fatalf("expecting counter 0 to agree on the voters")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	forge()
+
+	// nor under counter 0's own index, whoever sends it
+	for _, index := range []int{1, 6} {
+		args := CountTotalArgs{cfg.registry.ElectionId, index, []int64{0, 1000}, voters, 0, nil}
+		reply := CountTotalReply{}
+		cfg.election(0).CountTotal(&args, &reply)
+		if reply.Success {
+			cfg.t.Fatalf("expecting counter 0 to refuse a total for index %v", index)
+		}
+	}
+
+	for iters := 0; ; iters++ {
+		if iters == 100 {
+			cfg.t.Fatalf("expecting counter 0 to get the result")
+		}
+		if done, result := cfg.election(0).Done(); done {
+			if result.Winner != 1 || !reflect.DeepEqual(result.Tally, cfg.expectedTally()) {
+				cfg.t.Fatalf("expecting tally %v, but got %v", cfg.expectedTally(), result)
+			}
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	fmt.Println("ok")
+
+	cfg.cleanup()
+}
+
+// Test that a bad total among just threshold of them gives no result,
+// unless there are no more counters, and then the result isn't
+// cross-checked
+func TestTooFewTotals(t *testing.T) {
+	fmt.Println("Starting too few totals test - no result")
+	cfg := makeConfig(t, 4, 5, 3, referendum, []int{1, 0, 1, 0, 1}, false)
+
+	// counter 3 sends nothing, and counter 2 nothing to counter 0,
+	// so that counter 0 only ever gets counter 1's total besides its
+	// own; we pass their voter sets on for them
+	for j := 0; j < cfg.nCounters; j++ {
+		cfg.net.Enable(cfg.counterEndnames[3][j], false)
+	}
+	cfg.net.Enable(cfg.counterEndnames[2][0], false)
+
+	cfg.startVoting()
+
+	waitPhase := func(i int, phase Phase) {
+		for iters := 0; cfg.election(i).Phase() < phase; iters++ {
+			if iters == 100 {
+				cfg.t.Fatalf("expecting counter %v to reach %v", i, phase)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+
+	// counter i's voter set, and its choice if it made one, once it
+	// reaches phase
+	voterSet := func(i int, phase Phase) ExchangeVotersArgs {
+		waitPhase(i, phase)
+		el := cfg.election(i)
+		el.mu.Lock()
+		defer el.mu.Unlock()
+		return ExchangeVotersArgs{cfg.registry.ElectionId, i + 1, el.voterSets[i+1], el.ownBallots(), el.ownChoice()}
+	}
+	set2, set3 := voterSet(2, VotingClosed), voterSet(3, VotingClosed)
+	cfg.election(0).ExchangeVoters(&set2, &ExchangeVotersReply{})
+	for i := 0; i < 3; i++ {
+		cfg.election(i).ExchangeVoters(&set3, &ExchangeVotersReply{})
+	}
+	choice2 := voterSet(2, ExchangingTotals)
+	cfg.election(0).ExchangeVoters(&choice2, &ExchangeVotersReply{})
+
+	// counter 2's total, as a wrong one
+	el := cfg.election(0)
+	args := CountTotalArgs{cfg.registry.ElectionId, 3, []int64{nrand(field), nrand(field)}, cfg.commonVoters(0), 0, nil}
+	reply := CountTotalReply{}
+	el.CountTotal(&args, &reply)
+	if !reply.Success {
+		cfg.t.Fatalf("expecting counter 0 to take counter 2's total")
+	}
+
+	// well past the totals deadline
+	time.Sleep(cfg.deadlines.Exchange + 2*time.Second)
+
+	if done, result := el.Done(); done {
+		cfg.t.Fatalf("expecting no result from threshold totals, but got %v", result)
+	}
+	if phase := el.Phase(); phase != ExchangingTotals {
+		cfg.t.Fatalf("expecting counter 0 to stay in %v, but it is in %v", ExchangingTotals, phase)
+	}
+	resultReply := GetResultReply{}
+	el.GetResult(&GetResultArgs{cfg.registry.ElectionId, cfg.voters[0].voterId}, &resultReply)
+	if resultReply.Done {
+		cfg.t.Fatalf("expecting no result for the voters, but got %v", resultReply.Result)
+	}
+
+	cfg.cleanup()
+
+	// with as many counters as the threshold, there is nothing to
+	// check a wrong total against, and the result says so
+	cfg = makeConfig(t, 3, 5, 3, referendum, []int{1, 0, 1, 0, 1}, false)
+	cfg.net.Enable(cfg.counterEndnames[2][0], false)
+
+	cfg.startVoting()
+
+	set2 = voterSet(2, VotingClosed)
+	cfg.election(0).ExchangeVoters(&set2, &ExchangeVotersReply{})
+
+	el = cfg.election(0)
+	args = CountTotalArgs{cfg.registry.ElectionId, 3, []int64{nrand(field), nrand(field)}, cfg.commonVoters(0), 0, nil}
+	el.CountTotal(&args, &reply)
+
+	for i := 0; i < cfg.nCounters; i++ {
+		var result Result
+		done := false
+		for iters := 0; iters < 50 && !done; iters++ {
+			time.Sleep(100 * time.Millisecond)
+			done, result = cfg.election(i).Done()
+		}
+		if !done {
+			cfg.t.Fatalf("expecting counter %v to have a result", i)
+		}
+		if result.CrossChecked || len(result.Faulty) != 0 {
+			cfg.t.Fatalf("expecting counter %v's result not to be cross-checked, but got %v", i, result)
+		}
+	}
+	fmt.Println("ok")
+
+	cfg.cleanup()
+}
+
+func TestConcurrentElections(t *testing.T) {
+	fmt.Println("Starting concurrent elections test - 1 and Carol win")
+	deadlines := Deadlines{Voting: 10000 * time.Millisecond, Exchange: 3000 * time.Millisecond}
+	cfg := makeConfigDeadlines(t, 3, 5, 2, referendum, []int{1, 0, 1, 1, 0}, false, deadlines)
+
+	board := []string{"Alice", "Bob", "Carol"}
+	boardRegistry, boardVoters := cfg.makeElection(board, []int{2, 2, 0, 2}, deadlines)
+	// a third election, that is closed before everyone votes
+	recallRegistry, recallVoters := cfg.makeElection(referendum, []int{1, 1, 0}, deadlines)
+
+	if err := cfg.counters[0].CreateElection(boardRegistry, board, cfg.threshold, deadlines); err != ErrElectionExists {
+		cfg.t.Fatalf("expecting %v, but got %v", ErrElectionExists, err)
+	}
+	ids := []string{cfg.registry.ElectionId, boardRegistry.ElectionId, recallRegistry.ElectionId}
+	sort.Strings(ids)
+	if got := cfg.counters[1].Elections(); !reflect.DeepEqual(got, ids) {
+		cfg.t.Fatalf("expecting elections %v, but got %v", ids, got)
+	}
+
+	args := CountVoteArgs{ElectionId: "unknown", VoterId: cfg.credentials[0].VoterId}
+	reply := CountVoteReply{}
+	cfg.counters[0].CountVote(&args, &reply)
+	if reply.Success || reply.Err != ErrUnknownElection {
+		cfg.t.Fatalf("expecting %v, but got %v", ErrUnknownElection, reply)
+	}
+
+	cfg.startVoting()
+	for _, vt := range boardVoters {
+		vt.Vote()
+	}
+	recallVoters[0].Vote()
+	recallVoters[1].Vote()
+
+	// ballots of one election don't count in another
+	wait := func(electionId string) ElectionStatus {
+		for iters := 0; iters < 100; iters++ {
+			if status, ok := cfg.counters[0].QueryElection(electionId); ok && status.Done {
+				return status
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		cfg.t.Fatalf("expecting election %v to have a result", electionId)
+		return ElectionStatus{}
+	}
+	status := wait(cfg.registry.ElectionId)
+	if status.Result.Winner != 1 || !reflect.DeepEqual(status.Result.Tally, []int64{2, 3}) {
+		cfg.t.Fatalf("expecting 1 to win 3 to 2, but got %v", status.Result)
+	}
+	status = wait(boardRegistry.ElectionId)
+	if status.Result.Winner != 2 || !reflect.DeepEqual(status.Result.Tally, []int64{1, 0, 3}) ||
+		status.Result.Ballots != 4 || !reflect.DeepEqual(status.Candidates, board) {
+		cfg.t.Fatalf("expecting Carol to win with 3 of 4 ballots, but got %v", status.Result)
+	}
+
+	// the recall stays open until it is closed on every counter
+	for iters := 0; ; iters++ {
+		if iters == 50 {
+			cfg.t.Fatalf("expecting every counter to get 2 ballots of the recall")
+		}
+		held := 0
+		for i := 0; i < cfg.nCounters; i++ {
+			if status, _ := cfg.counters[i].QueryElection(recallRegistry.ElectionId); status.Ballots == 2 {
+				if status.Phase != VotingOpen {
+					cfg.t.Fatalf("expecting the recall to be open, but it is %v", status.Phase)
+				}
+				held++
+			}
+		}
+		if held == cfg.nCounters {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	for i := 0; i < cfg.nCounters; i++ {
+		if err := cfg.counters[i].CloseElection(recallRegistry.ElectionId); err != OK {
+			cfg.t.Fatalf("expecting counter %v to close the recall, but got %v", i, err)
+		}
+	}
+	status = wait(recallRegistry.ElectionId)
+	if status.Result.Winner != 1 || status.Result.Ballots != 2 {
+		cfg.t.Fatalf("expecting 1 to win the recall with 2 ballots, but got %v", status.Result)
+	} else {
+		fmt.Println("ok")
+	}
+
+	for _, vt := range append(boardVoters, recallVoters...) {
+		vt.Kill()
+	}
+	cfg.cleanup()
+}
+
+func TestVoterRegistration(t *testing.T) {
+	fmt.Println("Starting voter registration test - 1 wins")
+	deadlines := Deadlines{Registration: 1500 * time.Millisecond, Voting: 10000 * time.Millisecond, Exchange: 3000 * time.Millisecond}
+	cfg := makeConfig(t, 3, 0, 2, referendum, []int{}, false)
+
+	registry, voters := cfg.makeElection(referendum, []int{1, 1, 0, 1, 0}, deadlines)
+	if status, _ := cfg.counters[0].QueryElection(registry.ElectionId); status.Phase != Registering || status.Voters != 0 {
+		cfg.t.Fatalf("expecting the election to be Registering with no voters, but got %v", status)
+	}
+
+	// voter 4 never registers, and can't vote
+	for i, vt := range voters {
+		if i < 4 {
+			vt.Register()
+		}
+		vt.Vote()
+	}
+
+	// a registration for another election is no good
+	forged, _ := MakeCredential("another", voters[4].voterId)
+	args := forged.registration()
+	args.ElectionId = registry.ElectionId
+	reply := RegisterReply{}
+	cfg.counters[0].Register(&args, &reply)
+	if reply.Success || reply.Err != ErrInvalidSignature {
+		cfg.t.Fatalf("expecting %v, but got %v", ErrInvalidSignature, reply)
+	}
+
+	// nor one by a voter who isn't eligible, however well signed
+	for i := 0; i < 3; i++ {
+		outsider, _ := MakeCredential(registry.ElectionId, randVoterId(cfg.rand))
+		args := outsider.registration()
+		reply := RegisterReply{}
+		cfg.counters[0].Register(&args, &reply)
+		if reply.Success || reply.Err != ErrNotEligible {
+			cfg.t.Fatalf("expecting %v, but got %v", ErrNotEligible, reply)
+		}
+	}
+
+	var status ElectionStatus
+	for iters := 0; !status.Done; iters++ {
+		if iters == 100 {
+			cfg.t.Fatalf("expecting the election to have a result")
+		}
+		time.Sleep(100 * time.Millisecond)
+		status, _ = cfg.counters[1].QueryElection(registry.ElectionId)
+	}
+	if status.Voters != 4 {
+		cfg.t.Fatalf("expecting 4 voters on the roll, but got %v", status.Voters)
+	}
+	result := status.Result
+	if result.Winner != 1 || !reflect.DeepEqual(result.Tally, []int64{1, 3}) ||
+		result.Ballots != 4 || result.Roll != 4 || !result.Quorum {
+		cfg.t.Fatalf("expecting 1 to win 3 to 1 with 4 of 4 ballots, but got %v", result)
+	}
+
+	// too late to register
+	late := voters[4].credential.registration()
+	reply = RegisterReply{}
+	cfg.counters[2].Register(&late, &reply)
+	if reply.Success || reply.Err != ErrRegistrationClosed {
+		cfg.t.Fatalf("expecting %v, but got %v", ErrRegistrationClosed, reply)
+	}
+	if !voters[4].Done() {
+		cfg.t.Fatalf("expecting the unregistered voter to give up")
+	} else {
+		fmt.Println("ok")
+	}
+
+	for _, vt := range voters {
+		vt.Kill()
+	}
+	cfg.cleanup()
+}
+
+// Test that one counter can't put voters on the roll
+func TestFaultyCounterRoll(t *testing.T) {
+	fmt.Println("Starting faulty counter roll test - 1 wins")
+	deadlines := Deadlines{Registration: 1500 * time.Millisecond, Voting: 10000 * time.Millisecond, Exchange: 3000 * time.Millisecond}
+	cfg := makeConfig(t, 3, 0, 2, referendum, []int{}, false)
+
+	// counter 2 (index 3) sends made-up rolls instead of its own:
+	// nothing it sends gets through but those
+	for j := 0; j < cfg.nCounters; j++ {
+		cfg.net.Enable(cfg.counterEndnames[2][j], false)
+	}
+	ends := make([]*labrpc.ClientEnd, 2)
+	for j := range ends {
+		endname := randstring(cfg.rand, 20)
+		ends[j] = cfg.net.MakeEnd(endname)
+		cfg.net.Connect(endname, j)
+		cfg.net.Enable(endname, true)
+		cfg.net.SetOwner(endname, 2)
+	}
+
+	registry, voters := cfg.makeElection(referendum, []int{1, 1, 0}, deadlines)
+	for _, vt := range voters {
+		vt.Register()
+		vt.Vote()
+	}
+
+	// a voter who never registered, with a key of its own, and
+	// another without a signature
+	invented, _ := MakeCredential(registry.ElectionId, randVoterId(cfg.rand))
+	registration := invented.registration()
+	roll := func(index int) ExchangeRollArgs {
+		return ExchangeRollArgs{registry.ElectionId, index, []int64{registration.VoterId, randVoterId(cfg.rand)},
+			[][]byte{registration.Key, registration.Key}, [][]byte{registration.Signature, nil}}
+	}
+
+	// too early
+	args := roll(3)
+	reply := ExchangeRollReply{}
+	if ends[0].Call("VoteCounter.ExchangeRoll", &args, &reply) && reply.Success {
+		cfg.t.Fatalf("expecting a roll to be refused while registering")
+	}
+
+	for j := range ends {
+		for iters := 0; ; iters++ {
+			if iters == 50 {
+				cfg.t.Fatalf("expecting counter %v to agree on the roll", j)
+			}
+			if status, _ := cfg.counters[j].QueryElection(registry.ElectionId); status.Phase == AgreeingRoll {
+				break
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+
+		// under each index, as if it were every counter's roll
+		for index := 1; index <= cfg.nCounters; index++ {
+			args := roll(index)
+			reply := ExchangeRollReply{}
+			ok := ends[j].Call("VoteCounter.ExchangeRoll", &args, &reply) && reply.Success
+			if ok != (index == 3) {
+				cfg.t.Fatalf("expecting counter %v to take only index 3's roll, but index %v: %v", j, index, ok)
+			}
+		}
+	}
+
+	var status ElectionStatus
+	for iters := 0; !status.Done; iters++ {
+		if iters == 100 {
+			cfg.t.Fatalf("expecting the election to have a result")
+		}
+		time.Sleep(100 * time.Millisecond)
+		status, _ = cfg.counters[0].QueryElection(registry.ElectionId)
+	}
+	result := status.Result
+	if status.Voters != 3 || result.Roll != 3 || result.Winner != 1 || !reflect.DeepEqual(result.Tally, []int64{1, 2}) {
+		cfg.t.Fatalf("expecting 1 to win 2 to 1 on a roll of 3, but got %v voters, %v", status.Voters, result)
+	} else {
+		fmt.Println("ok")
+	}
+
+	for _, vt := range voters {
+		vt.Kill()
+	}
+	cfg.cleanup()
+}
+
+// Test that voters learn the result when counters that got some
+// rolls late agreed on different rolls
+func TestLateRoll(t *testing.T) {
+	fmt.Println("Starting late roll test - 1 wins")
+	deadlines := Deadlines{Registration: 1500 * time.Millisecond, Voting: 10000 * time.Millisecond, Exchange: 3000 * time.Millisecond}
+	cfg := makeConfig(t, 3, 0, 2, referendum, []int{}, false)
+
+	// counters 0 and 1 only get each other's rolls once they agreed
+	// on theirs without them
+	cfg.net.Enable(cfg.counterEndnames[0][1], false)
+	cfg.net.Enable(cfg.counterEndnames[1][0], false)
+
+	registry, voters := cfg.makeElection(referendum, []int{1, 0, 1, 1, 0}, deadlines)
+
+	// voters 2 and 3 register with counters 1 and 2, and voter 4 with
+	// counters 0 and 2, so that counter 0 agrees on a roll of 3,
+	// counter 1 on one of 4, and counter 2 on one of 5
+	registeredWith := [][]int{{0, 1, 2}, {0, 1, 2}, {1, 2}, {1, 2}, {0, 2}}
+	for i, counters := range registeredWith {
+		args := voters[i].credential.registration()
+		for _, j := range counters {
+			reply := RegisterReply{}
+			cfg.counters[j].Register(&args, &reply)
+			if !reply.Success {
+				cfg.t.Fatalf("expecting counter %v to register voter %v, but got %v", j, i, reply.Err)
+			}
+		}
+	}
+
+	for i := 0; i < cfg.nCounters; i++ {
+		for iters := 0; ; iters++ {
+			if iters == 100 {
+				cfg.t.Fatalf("expecting counter %v to open the voting", i)
+			}
+			if status, _ := cfg.counters[i].QueryElection(registry.ElectionId); status.Phase >= VotingOpen {
+				if status.Voters != 3+i {
+					cfg.t.Fatalf("expecting counter %v to agree on a roll of %v, but got %v", i, 3+i, status.Voters)
+				}
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	cfg.net.Enable(cfg.counterEndnames[0][1], true)
+	cfg.net.Enable(cfg.counterEndnames[1][0], true)
+
+	for _, vt := range voters {
+		vt.Vote()
+	}
+
+	for i, vt := range voters {
+		var result Result
+		done := false
+		for iters := 0; iters < 100 && !done; iters++ {
+			time.Sleep(100 * time.Millisecond)
+			done, result = vt.Result()
+		}
+		if !done {
+			cfg.t.Fatalf("expecting voter %v to learn the result", i)
+		}
+		if result.Winner != 1 || !reflect.DeepEqual(result.Tally, []int64{1, 3}) || result.Ballots != 4 {
+			cfg.t.Fatalf("expecting 1 to win 3 to 1 with 4 ballots, but voter %v got %v", i, result)
+		}
+	}
+	fmt.Println("ok")
+
+	for _, vt := range voters {
+		vt.Kill()
+	}
+	cfg.cleanup()
+}
+
+func TestTLSCommittee(t *testing.T) {
+	fmt.Println("Starting committee over mutual TLS test - No wins")
+	nCounters, threshold := 3, 2
+	votes := []int{0, 0, 1}
+	deadlines := Deadlines{Voting: 2000 * time.Millisecond, Exchange: 2000 * time.Millisecond}
+
+	ca, err := labrpc.MakeCA("election-ca")
+	if err != nil {
+		t.Fatalf("MakeCA: %v", err)
+	}
+
+	keys := make([]*ecdh.PrivateKey, nCounters)
+	publicKeys := make([]*ecdh.PublicKey, nCounters)
+	configs := make([]*tls.Config, nCounters)
+	servers := make([]*labrpc.Server, nCounters)
+	listeners := make([]*labrpc.TCPListener, nCounters)
+	for i := 0; i < nCounters; i++ {
+		keys[i], _ = ecdh.X25519().GenerateKey(crand.Reader)
+		publicKeys[i] = keys[i].PublicKey()
+		configs[i], _ = ca.Config(CounterIdentity(i))
+
+		// the services are added once the counters are made
+		servers[i] = labrpc.MakeServer()
+		listeners[i], err = labrpc.ListenTLS(servers[i], "localhost:0", configs[i], CommitteeAuthorizer(nCounters))
+		if err != nil {
+			t.Fatalf("ListenTLS: %v", err)
+		}
+	}
+	ends := func(config *tls.Config) []Endpoint {
+		ends := make([]Endpoint, nCounters)
+		for i := range ends {
+			ends[i] = labrpc.MakeTLSEnd(listeners[i].Addr(), CounterIdentity(i), config)
+		}
+		return ends
+	}
+
+	registry := MakeRegistry("tls")
+	credentials := make([]Credential, len(votes))
+	for i := range votes {
+		credentials[i], _ = registry.Enroll(int64(i))
+	}
+
+	counters := make([]*VoteCounter, nCounters)
+	for i := 0; i < nCounters; i++ {
+		counters[i] = MakeVoteCounter(ends(configs[i]), i, keys[i], publicKeys, &MemPersister{})
+		counters[i].CreateElection(registry, referendum, threshold, deadlines)
+		servers[i].AddService(labrpc.MakeService(counters[i]))
+	}
+
+	voters := make([]*Voter, len(votes))
+	voterConfigs := make([]*tls.Config, len(votes))
+	for i, vote := range votes {
+		voterConfigs[i], _ = ca.Config(VoterIdentity(credentials[i].VoterId))
+		voters[i] = MakeVoter(ends(voterConfigs[i]), publicKeys, credentials[i], referendum, vote, threshold, &MemPersister{})
+		voters[i].Vote()
+	}
+
+	for i, vt := range voters {
+		var result Result
+		for iters := 0; ; iters++ {
+			if iters == 100 {
+				t.Fatalf("expecting voter %v to get the result", i)
+			}
+			var ok bool
+			if ok, result = vt.Result(); ok {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		if result.Winner != 0 || !reflect.DeepEqual(result.Tally, []int64{2, 1}) {
+			t.Fatalf("expecting No to win 2 to 1, but got %v", result)
+		}
+	}
+
+	// a voter can ask a counter for the result, but can't pass
+	// for a counter, even with a certificate from the same CA
+	voterEnd := labrpc.MakeTLSEnd(listeners[0].Addr(), CounterIdentity(0), voterConfigs[0])
+	if !voterEnd.Call("VoteCounter.GetResult", &GetResultArgs{"tls", 0}, &GetResultReply{}) {
+		t.Fatalf("expecting a voter to get the result")
+	}
+	if voterEnd.Call("VoteCounter.CountTotal", &CountTotalArgs{ElectionId: "none"}, &CountTotalReply{}) {
+		t.Fatalf("expecting a voter's CountTotal to be refused")
+	}
+	counterEnd := labrpc.MakeTLSEnd(listeners[0].Addr(), CounterIdentity(0), configs[1])
+	if !counterEnd.Call("VoteCounter.CountTotal", &CountTotalArgs{ElectionId: "none"}, &CountTotalReply{}) {
+		t.Fatalf("expecting a counter's CountTotal to be taken")
+	}
+
+	// nor can one counter pass for another
+	heartbeat := HeartbeatReply{}
+	if !counterEnd.Call("VoteCounter.Heartbeat", &HeartbeatArgs{2}, &heartbeat) || !heartbeat.Success {
+		t.Fatalf("expecting counter 1's heartbeat to be taken")
+	}
+	heartbeat = HeartbeatReply{}
+	if counterEnd.Call("VoteCounter.Heartbeat", &HeartbeatArgs{3}, &heartbeat) && heartbeat.Success {
+		t.Fatalf("expecting counter 1's heartbeat as counter 2 to be refused")
+	}
+	total := CountTotalReply{}
+	if counterEnd.Call("VoteCounter.CountTotal", &CountTotalArgs{ElectionId: "tls", Index: 3}, &total) && total.Success {
+		t.Fatalf("expecting counter 1's total as counter 2 to be refused")
+	}
+
+	// no one gets the shares meant for counter 0 by listening in
+	// its place with the certificate of another counter
+	impostor, _ := labrpc.ListenTLS(labrpc.MakeServer(), "localhost:0", configs[1], nil)
+	impostorEnd := labrpc.MakeTLSEnd(impostor.Addr(), CounterIdentity(0), voterConfigs[0])
+	if impostorEnd.Call("VoteCounter.CountVote", &CountVoteArgs{}, &CountVoteReply{}) {
+		t.Fatalf("expecting a voter to refuse a counter with the wrong identity")
+	} else {
+		fmt.Println("ok")
+	}
+	impostor.Close()
+
+	for _, vt := range voters {
+		vt.Kill()
+	}
+	for i := 0; i < nCounters; i++ {
+		counters[i].Kill()
+		listeners[i].Close()
+	}
+}
+
+// an Endpoint whose calls never return until canceled
+type blockingEnd struct {
+	canceled chan string
+}
+
+func (be *blockingEnd) Call(svcMeth string, args interface{}, reply interface{}) bool {
+	return be.CallContext(context.Background(), svcMeth, args, reply) == nil
+}
+
+func (be *blockingEnd) CallContext(ctx context.Context, svcMeth string, args interface{}, reply interface{}) error {
+	<-ctx.Done()
+	be.canceled <- svcMeth
+	return labrpc.ErrCanceled
+}
+
+func TestKillCancelsCalls(t *testing.T) {
+	fmt.Println("Starting kill cancels calls test")
+	nCounters := 3
+
+	be := &blockingEnd{make(chan string, 100)}
+	ends := make([]Endpoint, nCounters)
+	keys := make([]*ecdh.PrivateKey, nCounters)
+	publicKeys := make([]*ecdh.PublicKey, nCounters)
+	for i := range ends {
+		ends[i] = be
+		keys[i], _ = ecdh.X25519().GenerateKey(crand.Reader)
+		publicKeys[i] = keys[i].PublicKey()
+	}
+
+	credential, _ := MakeCredential("kill", 1)
+	vt := MakeVoter(ends, publicKeys, credential, referendum, 1, 2, &MemPersister{})
+	vt.Vote()
+	vc := MakeVoteCounter(ends, 0, keys[0], publicKeys, &MemPersister{})
+
+	time.Sleep(500 * time.Millisecond)
+	select {
+	case svcMeth := <-be.canceled:
+		t.Fatalf("%v canceled before Kill()", svcMeth)
+	default:
+	}
+
+	vt.Kill()
+	vc.Kill()
+
+	canceled := make(map[string]bool)
+	timeout := time.After(2 * time.Second)
+	for !canceled["VoteCounter.CountVote"] || !canceled["VoteCounter.GetResult"] || !canceled["VoteCounter.Heartbeat"] {
+		select {
+		case svcMeth := <-be.canceled:
+			canceled[svcMeth] = true
+		case <-timeout:
+			t.Fatalf("expecting Kill() to cancel the calls in flight, but only %v were", canceled)
+		}
+	}
+	fmt.Println("ok")
+}
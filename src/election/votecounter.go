@@ -1,12 +1,14 @@
 package election
 
 import (
+	"crypto/ed25519"
 	"math/big"
-	"sync"
-	"sync/atomic"
+	"reflect"
+	"sort"
 	"time"
 
-	"6.824/labrpc"
+	"6.824/labgob"
+	"6.824/shamir"
 )
 
 const receiveTotalsTimeout int32 = 500
@@ -14,126 +16,672 @@ const votingTimeout int32 = 3000
 const exchangeTimeout int32 = 3000
 
 //
-// Add all of the votes
+// Add all of the votes, candidate by candidate, into shares at x
+// of the totals
 //
-func addVotes(votes map[int64]int64) (votesSum int64) {
-	for _, val := range votes {
-		votesSum += val
+func addVotes(votes map[int64][]int64, nCandidates, x int) []int64 {
+	votesSum := make([]int64, nCandidates)
+	for c := range votesSum {
+		shares := []shamir.Share{{X: x, Y: big.NewInt(0)}}
+		for _, val := range votes {
+			if c < len(val) {
+				shares = append(shares, shamir.Share{X: x, Y: big.NewInt(val[c])})
+			}
+		}
+		sum, _ := votingField.AddShares(shares...)
+		votesSum[c] = sum.Y.Int64()
 	}
 
-	votesSum %= field
+	return votesSum
+}
+
+type Outcome int
+
+const (
+	Majority  Outcome = iota // the winner has more than half of the ballots
+	Plurality                // the winner has the most votes, but no majority
+	Tie                      // several candidates share the most votes
+)
+
+const NoWinner = -1
 
-	return
+//
+// The outcome of an election, as reconstructed by a vote counter.
+// Chosen holds the threshold counters (counter index + 1) chosen for
+// sharing the most voters. Every counter that held those voters adds
+// them up, for redundancy: Counters holds those whose totals were
+// used in the reconstruction, and Faulty those whose totals didn't
+// fit the reconstructed polynomials. Unless more than threshold
+// totals fit them, a bad total would have gone unnoticed, and the
+// tally isn't CrossChecked.
+//
+type Result struct {
+	Tally        []int64 // votes per candidate
+	Winner       int     // index of the winning candidate, NoWinner on ties
+	Outcome      Outcome
+	Ballots      int  // number of ballots included in the tally
+	Roll         int  // number of voters on the counter's agreed roll
+	Quorum       bool // whether more than half of that roll is in the tally
+	Chosen       []int
+	Counters     []int
+	Faulty       []int
+	CrossChecked bool
 }
 
-//	Compute the winner of the election
-func computeWinner(shares map[int]int64, nVoters int) int {
-	total := big.NewInt(0)
-	for xi, yi := range shares {
-		partial := big.NewInt(yi)
-		for x := range shares {
-			if xi != x {
-				inv := big.NewInt(1).ModInverse(big.NewInt(int64(x-xi)), big.NewInt(field))
-				num := big.NewInt(int64(x))
-				partial.Mul(partial, num)
-				partial.Mod(partial, big.NewInt(field))
-				partial.Mul(partial, inv)
-				partial.Mod(partial, big.NewInt(field))
-			}
+//
+// Whether two results announce the same outcome, regardless of
+// the counters that each was reconstructed from. Counters that
+// closed the roll with different rolls at hand may have agreed
+// on different ones, and nothing reconciles them, so the roll
+// (and the quorum) of each is its own.
+//
+func (r Result) sameOutcome(o Result) bool {
+	return reflect.DeepEqual(r.Tally, o.Tally) && r.Winner == o.Winner &&
+		r.Outcome == o.Outcome && r.Ballots == o.Ballots
+}
+
+//
+//	Compute the tally and the winner of the election. Each
+//	candidate's total is reconstructed on its own, and the
+//	winner is the candidate with the most votes. Fails if
+//	the totals are too inconsistent to be decoded.
+//
+func computeWinner(shares map[int][]int64, nCandidates, nBallots, nRoll, threshold int) (Result, bool) {
+	result := Result{}
+	result.Tally = make([]int64, nCandidates)
+	result.Ballots = nBallots
+	result.Roll = nRoll
+	result.Quorum = nBallots > nRoll/2
+
+	faulty := make(map[int]bool)
+	for c := 0; c < nCandidates; c++ {
+		points := make([]shamir.Share, 0, len(shares))
+		for x, y := range shares {
+			points = append(points, shamir.Share{X: x, Y: big.NewInt(y[c])})
+		}
+
+		total, bad, err := votingField.RobustCombine(points, threshold)
+		if err != nil {
+			return result, false
+		}
+		result.Tally[c] = total.Int64()
+		for _, x := range bad {
+			faulty[x] = true
 		}
-		total.Add(total, partial)
-		total.Mod(total, big.NewInt(field))
 	}
 
-	totalVotes := total.Int64() % field
+	result.Counters = make([]int, 0)
+	result.Faulty = make([]int, 0)
+	for x := range shares {
+		if faulty[x] {
+			result.Faulty = append(result.Faulty, x)
+		} else {
+			result.Counters = append(result.Counters, x)
+		}
+	}
+	sort.Ints(result.Counters)
+	sort.Ints(result.Faulty)
 
-	if totalVotes < 0 {
-		totalVotes += field
+	if len(result.Counters) < threshold {
+		return result, false
+	}
+	result.CrossChecked = len(result.Counters) > threshold
+
+	result.Winner = NoWinner
+	result.Outcome = Tie
+	var most int64 = -1
+	for c, votes := range result.Tally {
+		if votes > most {
+			most = votes
+			result.Winner = c
+			result.Outcome = Plurality
+		} else if votes == most {
+			result.Winner = NoWinner
+			result.Outcome = Tie
+		}
 	}
 
-	if int(totalVotes) > nVoters/2 {
-		return 1
-	} else {
-		return 0
+	if result.Outcome == Plurality && most > int64(nBallots/2) {
+		result.Outcome = Majority
 	}
+
+	return result, true
 }
 
 type CountTotalArgs struct {
-	Index int
-	Value int64
+	ElectionId string
+	Index      int
+	Value      []int64 // one partial sum per candidate
+	Voters     []int64 // the common voter set added into Value
+	Epoch      int     // the refresh epoch of the shares added up
+	VoterSet   []int64 // the sender's own voter set, which we may lack
 }
 
 type CountTotalReply struct {
 	Success bool
 }
 
-type VoteCounter struct {
-	mu   sync.Mutex
-	dead int32 // set by Kill()
+type GetResultArgs struct {
+	ElectionId string
+	VoterId    int64
+}
+
+type GetResultReply struct {
+	Done   bool
+	Result Result
+}
 
-	committeeMembers []*labrpc.ClientEnd
-	me               int
+//
+// Partial sums from counters that added up the same voters.
+// Only totals over identical voter sets, and shares of the same
+// refresh epoch, can be interpolated together.
+//
+type voterTotals struct {
+	Voters   []int64
+	Counters []int // the counters expected to send a total
+	Epoch    int
+	Totals   map[int][]int64
+}
 
-	votes             map[int64]int64
+//
+// One election, as a counter runs it. Every election of a counter
+// embeds the counter, for the committee's endpoints and keys, and
+// they all share its lock.
+//
+type electionCounter struct {
+	*VoteCounter
+
+	recovering bool // rebuilding our shares from the others
+	candidates []string
+
+	phase     Phase
+	deadlines Deadlines
+
+	registry          *Registry // the eligible voters' public keys
+	votes             map[int64][]int64
+	commitments       map[int64][][]int64    // each voter's commitments
+	blinds            map[int64][]int64      // each voter's blinding shares
+	ballots           map[int64]SignedBallot // each voter's signed ballot
+	equivocations     map[int64]Equivocation // voters caught signing two ballots
+	reportSuccess     map[int64]map[int]bool
+	epoch             int                            // refreshes applied to our shares
+	deals             map[int]map[int]RefreshArgs    // our deals not yet taken, by epoch and counter
+	pendingDeals      map[int]map[int]RefreshArgs    // deals for us, by epoch and dealer (index+1)
+	dealers           map[int][]int                  // the fixed dealers of the epochs not yet applied
+	fixes             map[int]map[int]FixDealersArgs // our fixes not yet taken, by epoch and counter
+	zeroSums          map[int64]*zeroSum             // the refreshes of each voter
 	nVoters           int
 	submissionSuccess map[int]bool // TODO: Decide on data structure
 
-	totalCounts map[int]int64 // Holds sum of all the cm's
+	rolls         map[int]map[int64]string // each counter's registered voters and their keys
+	registrations map[int64][]byte         // the signature of each voter that registered with us
+	rollSuccess   map[int]bool
+	rollExpired   bool
+
+	voterSets       map[int][]int64        // Holds the voters of all the cm's
+	exchanged       map[int64]SignedBallot // ballots from the others' voter sets that we hold none of
+	voterSetSuccess map[int]bool
+	exchangeExpired bool
+	choices         map[int]VoterChoice // each counter's choice of common voters, ours included
+	chosenCounters  []int               // the threshold counters sharing the most voters
+	commonCounters  []int               // the counters holding every common voter
+	commonVoters    []int64             // nil until the voter sets are agreed on
+
+	totalsTimer   bool // whether the totals deadline is running
+	totalsExpired bool
+
+	totalCounts map[string]*voterTotals // Holds sum of all the cm's, by voter set
+	earlyTotals map[int]CountTotalArgs  // totals sent before we agreed on the voters, by index
 	threshold   int
-	winner      int
+	result      *Result
 }
 
-//
-// main/votecounter.go calls this function.
-//
-func MakeVoteCounter(committeeMembers []*labrpc.ClientEnd, me, nVoters, threshold int) *VoteCounter {
-	vc := &VoteCounter{}
-
-	vc.committeeMembers = committeeMembers
-	vc.me = me
+func makeElectionCounter(counter *VoteCounter, registry *Registry, candidates []string, threshold int, deadlines Deadlines) *electionCounter {
+	vc := &electionCounter{VoteCounter: counter}
 
-	vc.votes = make(map[int64]int64)
-	vc.nVoters = nVoters
+	vc.candidates = candidates
+	vc.phase = VotingOpen
+	if deadlines.Registration > 0 {
+		vc.phase = Registering
+	}
+	vc.deadlines = deadlines
+
+	vc.votes = make(map[int64][]int64)
+	vc.commitments = make(map[int64][][]int64)
+	vc.blinds = make(map[int64][]int64)
+	vc.ballots = make(map[int64]SignedBallot)
+	vc.equivocations = make(map[int64]Equivocation)
+	vc.reportSuccess = make(map[int64]map[int]bool)
+	vc.deals = make(map[int]map[int]RefreshArgs)
+	vc.pendingDeals = make(map[int]map[int]RefreshArgs)
+	vc.dealers = make(map[int][]int)
+	vc.fixes = make(map[int]map[int]FixDealersArgs)
+	vc.zeroSums = make(map[int64]*zeroSum)
+	vc.registry = registry
+	vc.nVoters = len(registry.Voters)
 	vc.submissionSuccess = make(map[int]bool)
 
-	vc.totalCounts = make(map[int]int64)
+	vc.rolls = make(map[int]map[int64]string)
+	vc.registrations = make(map[int64][]byte)
+	vc.rollSuccess = make(map[int]bool)
+
+	vc.voterSets = make(map[int][]int64)
+	vc.exchanged = make(map[int64]SignedBallot)
+	vc.voterSetSuccess = make(map[int]bool)
+	vc.choices = make(map[int]VoterChoice)
+
+	vc.totalCounts = make(map[string]*voterTotals)
+	vc.earlyTotals = make(map[int]CountTotalArgs)
 	vc.threshold = threshold
-	vc.winner = -1
 
 	return vc
 }
 
-func (vc *VoteCounter) CountVote(args *CountVoteArgs, reply *CountVoteReply) {
+//
+// Restore the election from the counter's persisted state, as
+// encode() wrote it
+//
+func (vc *electionCounter) decode(d *labgob.LabDecoder) bool {
+	var registry Registry
+	var candidates []string
+	var threshold int
+	var deadlines Deadlines
+	var phase Phase
+	var recovering bool
+	var votes map[int64][]int64
+	var commitments map[int64][][]int64
+	var blinds map[int64][]int64
+	var ballots map[int64]SignedBallot
+	var equivocations map[int64]Equivocation
+	var epoch int
+	var deals map[int]map[int]RefreshArgs
+	var pendingDeals map[int]map[int]RefreshArgs
+	var dealers map[int][]int
+	var fixes map[int]map[int]FixDealersArgs
+	var zeroSums map[int64]*zeroSum
+	var rolls map[int]map[int64]string
+	var registrations map[int64][]byte
+	var rollExpired bool
+	var voterSets map[int][]int64
+	var exchanged map[int64]SignedBallot
+	var choices map[int]VoterChoice
+	var agreed bool
+	var chosenCounters []int
+	var commonCounters []int
+	var commonVoters []int64
+	var totalCounts map[string]*voterTotals
+	var earlyTotals map[int]CountTotalArgs
+	var hasResult bool
+	var result Result
+
+	if d.Decode(&registry) != nil || d.Decode(&candidates) != nil ||
+		d.Decode(&threshold) != nil || d.Decode(&deadlines) != nil ||
+		d.Decode(&phase) != nil || d.Decode(&recovering) != nil ||
+		d.Decode(&votes) != nil ||
+		d.Decode(&commitments) != nil || d.Decode(&blinds) != nil ||
+		d.Decode(&ballots) != nil ||
+		d.Decode(&equivocations) != nil || d.Decode(&epoch) != nil ||
+		d.Decode(&deals) != nil || d.Decode(&pendingDeals) != nil ||
+		d.Decode(&dealers) != nil || d.Decode(&fixes) != nil ||
+		d.Decode(&zeroSums) != nil || d.Decode(&rolls) != nil ||
+		d.Decode(&registrations) != nil ||
+		d.Decode(&rollExpired) != nil || d.Decode(&voterSets) != nil ||
+		d.Decode(&exchanged) != nil || d.Decode(&choices) != nil ||
+		d.Decode(&agreed) != nil || d.Decode(&chosenCounters) != nil ||
+		d.Decode(&commonCounters) != nil ||
+		d.Decode(&commonVoters) != nil || d.Decode(&totalCounts) != nil ||
+		d.Decode(&earlyTotals) != nil ||
+		d.Decode(&hasResult) != nil || d.Decode(&result) != nil {
+		return false
+	}
+
+	vc.registry = &registry
+	vc.nVoters = len(registry.Voters)
+	vc.candidates = candidates
+	vc.threshold = threshold
+	vc.deadlines = deadlines
+	vc.phase = phase
+	vc.recovering = recovering
+	vc.votes = votes
+	vc.commitments = commitments
+	vc.blinds = blinds
+	vc.ballots = ballots
+	vc.equivocations = equivocations
+	vc.epoch = epoch
+	vc.deals = deals
+	vc.pendingDeals = pendingDeals
+	vc.dealers = dealers
+	vc.fixes = fixes
+	vc.zeroSums = zeroSums
+	vc.rolls = rolls
+	vc.registrations = registrations
+	vc.rollExpired = rollExpired
+	vc.voterSets = voterSets
+	vc.exchanged = exchanged
+	vc.choices = choices
+	vc.chosenCounters = chosenCounters
+	vc.commonCounters = commonCounters
+	vc.commonVoters = commonVoters
+	vc.totalCounts = totalCounts
+	vc.earlyTotals = earlyTotals
+	if hasResult {
+		vc.result = &result
+	}
+
+	// gob drops empty maps and slices
+	if vc.registry.Voters == nil {
+		vc.registry.Voters = make(map[int64]ed25519.PublicKey)
+	}
+	if vc.registry.Eligible == nil {
+		vc.registry.Eligible = make(map[int64]bool)
+	}
+	if vc.votes == nil {
+		vc.votes = make(map[int64][]int64)
+	}
+	if vc.commitments == nil {
+		vc.commitments = make(map[int64][][]int64)
+	}
+	if vc.blinds == nil {
+		vc.blinds = make(map[int64][]int64)
+	}
+	if vc.ballots == nil {
+		vc.ballots = make(map[int64]SignedBallot)
+	}
+	if vc.equivocations == nil {
+		vc.equivocations = make(map[int64]Equivocation)
+	}
+	if vc.deals == nil {
+		vc.deals = make(map[int]map[int]RefreshArgs)
+	}
+	if vc.pendingDeals == nil {
+		vc.pendingDeals = make(map[int]map[int]RefreshArgs)
+	}
+	if vc.dealers == nil {
+		vc.dealers = make(map[int][]int)
+	}
+	if vc.fixes == nil {
+		vc.fixes = make(map[int]map[int]FixDealersArgs)
+	}
+	if vc.zeroSums == nil {
+		vc.zeroSums = make(map[int64]*zeroSum)
+	}
+	if vc.rolls == nil {
+		vc.rolls = make(map[int]map[int64]string)
+	}
+	for index, roll := range vc.rolls {
+		if roll == nil {
+			vc.rolls[index] = make(map[int64]string)
+		}
+	}
+	if vc.registrations == nil {
+		vc.registrations = make(map[int64][]byte)
+	}
+	if vc.voterSets == nil {
+		vc.voterSets = make(map[int][]int64)
+	}
+	if vc.exchanged == nil {
+		vc.exchanged = make(map[int64]SignedBallot)
+	}
+	if vc.choices == nil {
+		vc.choices = make(map[int]VoterChoice)
+	}
+	if vc.commonVoters == nil && agreed {
+		vc.commonVoters = make([]int64, 0)
+	}
+	if vc.totalCounts == nil {
+		vc.totalCounts = make(map[string]*voterTotals)
+	}
+	if vc.earlyTotals == nil {
+		vc.earlyTotals = make(map[int]CountTotalArgs)
+	}
+
+	return true
+}
+
+func (vc *electionCounter) encode(e *labgob.LabEncoder) {
+	e.Encode(*vc.registry)
+	e.Encode(vc.candidates)
+	e.Encode(vc.threshold)
+	e.Encode(vc.deadlines)
+	e.Encode(vc.phase)
+	e.Encode(vc.recovering)
+	e.Encode(vc.votes)
+	e.Encode(vc.commitments)
+	e.Encode(vc.blinds)
+	e.Encode(vc.ballots)
+	e.Encode(vc.equivocations)
+	e.Encode(vc.epoch)
+	e.Encode(vc.deals)
+	e.Encode(vc.pendingDeals)
+	e.Encode(vc.dealers)
+	e.Encode(vc.fixes)
+	e.Encode(vc.zeroSums)
+	e.Encode(vc.rolls)
+	e.Encode(vc.registrations)
+	e.Encode(vc.rollExpired)
+	e.Encode(vc.voterSets)
+	e.Encode(vc.exchanged)
+	e.Encode(vc.choices)
+	e.Encode(vc.commonVoters != nil)
+	e.Encode(vc.chosenCounters)
+	e.Encode(vc.commonCounters)
+	e.Encode(vc.commonVoters)
+	e.Encode(vc.totalCounts)
+	e.Encode(vc.earlyTotals)
+	e.Encode(vc.result != nil)
+	if vc.result != nil {
+		e.Encode(*vc.result)
+	} else {
+		e.Encode(Result{})
+	}
+}
+
+//
+// Pick up the election where the (possibly restored) state
+// left it, restarting the timers and resending whatever the
+// other counters may still be missing
+//
+func (vc *electionCounter) resume() {
+	for id := range vc.equivocations {
+		go vc.sendEquivocation(id)
+	}
+
+	if vc.recovering {
+		go vc.recoverLoop()
+	}
+
+	for epoch := range vc.deals {
+		go vc.sendRefresh(epoch)
+	}
+	for epoch := range vc.fixes {
+		go vc.sendFixes(epoch)
+	}
+	if vc.deadlines.Refresh > 0 {
+		go vc.refreshLoop()
+	}
+
+	switch vc.phase {
+	case Registering:
+		go vc.registrationDeadline()
+	case AgreeingRoll:
+		go vc.sendRoll()
+		go vc.rollDeadline()
+	case VotingOpen:
+		go vc.votingDeadline()
+	case VotingClosed:
+		go vc.sendVoterSet()
+		go vc.exchangeDeadline()
+	case ExchangingTotals, ResultFinal:
+		if _, ok := vc.voterSets[vc.me+1]; ok {
+			go vc.sendVoterSet()
+		}
+		if vc.phase == ExchangingTotals {
+			vc.startTotalsDeadline()
+		}
+		if _, ok := vc.ownTotal(); ok {
+			go vc.sendShareTotal()
+		}
+	}
+}
+
+func (vc *electionCounter) CountVote(args *CountVoteArgs, reply *CountVoteReply) {
 	vc.mu.Lock()
 	defer vc.mu.Unlock()
 
-	vc.votes[args.VoterId] = args.Vote
+	if vc.phase < VotingOpen {
+		// the roll isn't final yet
+		reply.Success = false
+		reply.Err = ErrNotReady
+		return
+	}
+
+	if err := vc.registry.authenticate(args.signed()); err != OK {
+		reply.Success = false
+		reply.Err = err
+		return
+	}
+
+	if vc.recovering {
+		reply.Success = false
+		reply.Err = ErrRecovering
+		return
+	}
+
+	if _, ok := vc.votes[args.VoterId]; !ok && vc.phase != VotingOpen {
+		reply.Success = false
+		reply.Err = ErrVotingClosed
+		return
+	}
+
+	vote, blind, ok := openShare(vc.key, args.VoterId, vc.me+1, args.Sealed, len(vc.candidates))
+	if !ok || !vc.validShares(vote, blind, args.Commitments) {
+		reply.Success = false
+		reply.Err = ErrInvalidShare
+		return
+	}
+
+	if !verifyBallot(args.VoterId, args.Commitments, args.Proof) {
+		reply.Success = false
+		reply.Err = ErrInvalidProof
+		return
+	}
+
+	if _, ok := vc.equivocations[args.VoterId]; ok {
+		reply.Success = false
+		reply.Err = ErrConflictingShare
+		return
+	}
+
+	if _, ok := vc.votes[args.VoterId]; ok {
+		if vc.sameBallot(args.VoterId, args.Commitments) {
+			// a retry of the ballot we already have
+			reply.Success = true
+			reply.Err = OK
+			return
+		}
+
+		// shares we got by resharing come without a signed ballot
+		if first, ok := vc.ballots[args.VoterId]; ok {
+			evidence := Equivocation{first, *args.signed()}
+			if vc.validEquivocation(&evidence) {
+				vc.addEquivocation(evidence)
+				vc.persist()
+			}
+		}
+		reply.Success = false
+		reply.Err = ErrConflictingShare
+		return
+	}
+
+	vc.votes[args.VoterId] = vote
+	vc.commitments[args.VoterId] = args.Commitments
+	vc.blinds[args.VoterId] = blind
+	vc.ballots[args.VoterId] = *args.signed()
+	vc.catchUp(args.VoterId)
+
+	if len(vc.votes) == vc.nVoters && vc.phase == VotingOpen {
+		vc.closeVoting()
+	}
+
+	vc.persist()
 	reply.Success = true
+	reply.Err = OK
+}
 
-	_, shareTotalSent := vc.totalCounts[vc.me+1]
-	if len(vc.votes) == vc.nVoters && !shareTotalSent {
-		vc.totalCounts[vc.me+1] = addVotes(vc.votes)
+//
+// Check every candidate's share against the voter's commitments
+//
+func (vc *electionCounter) validShares(vote, blind []int64, commitments [][]int64) bool {
+	nCandidates := len(vc.candidates)
+	if len(vote) != nCandidates || len(blind) != nCandidates ||
+		len(commitments) != nCandidates {
+		return false
+	}
 
-		go vc.sendShareTotal()
+	for c := 0; c < nCandidates; c++ {
+		if len(commitments[c]) != vc.threshold ||
+			!verifyShare(commitments[c], int64(vc.me+1), vote[c], blind[c]) {
+			return false
+		}
 	}
+
+	return true
+}
+
+//
+// Close the voting once the voting deadline has passed, even
+// if some voters never submitted their shares
+//
+func (vc *electionCounter) votingDeadline() {
+	time.Sleep(vc.deadlines.Voting)
+
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+
+	if !vc.killed() && vc.phase == VotingOpen && !vc.recovering {
+		vc.closeVoting()
+		vc.persist()
+	}
+}
+
+//
+// Add up the shares of the agreed voters, and share the
+// total with the rest of the committee
+//
+func (vc *electionCounter) addCommonVotes() {
+	votes := make(map[int64][]int64)
+	for _, id := range vc.commonVoters {
+		votes[id] = vc.votes[id]
+	}
+
+	vc.addTotal(vc.me+1, vc.epoch, addVotes(votes, len(vc.candidates), vc.me+1))
+	vc.checkResult()
+
+	go vc.sendShareTotal()
 }
 
 //
 // Count the votes, and announce the winner (not fault tolerant)
 //
-func (vc *VoteCounter) sendShareTotal() {
+func (vc *electionCounter) sendShareTotal() {
 	vc.mu.Lock()
 	defer vc.mu.Unlock()
 
 	for !vc.killed() && len(vc.submissionSuccess) < len(vc.committeeMembers)-1 {
+		// a refresh may have added our total up again, and we may
+		// have chosen other common voters without us among their
+		// counters
+		total, ok := vc.ownTotal()
+		if !ok {
+			return
+		}
 		for i := 0; i < len(vc.committeeMembers); i++ {
 			_, alreadySubmitted := vc.submissionSuccess[i]
-			if i != vc.me && !alreadySubmitted {
-				go func(counter, index int, total int64) {
-					args := CountTotalArgs{index, total}
+			if i != vc.me && !alreadySubmitted && !vc.peerDead(i) {
+				go func(counter int, args CountTotalArgs) {
 					reply := CountTotalReply{}
 					vc.sendCountTotal(counter, &args, &reply)
-				}(i, vc.me+1, vc.totalCounts[vc.me+1])
+				}(i, CountTotalArgs{vc.registry.ElectionId, vc.me + 1, total, vc.commonVoters, vc.epoch, vc.voterSets[vc.me+1]})
 			}
 		}
 
@@ -143,55 +691,197 @@ func (vc *VoteCounter) sendShareTotal() {
 	}
 }
 
-func (vc *VoteCounter) sendCountTotal(counter int, args *CountTotalArgs, reply *CountTotalReply) {
-	ok := vc.committeeMembers[counter].Call("VoteCounter.CountTotal", args, reply)
+func (vc *electionCounter) sendCountTotal(counter int, args *CountTotalArgs, reply *CountTotalReply) {
+	ok := vc.committeeMembers[counter].CallContext(vc.ctx, "VoteCounter.CountTotal", args, reply) == nil
 
 	if ok && reply.Success {
 		vc.mu.Lock()
-		vc.submissionSuccess[counter] = true
+		if args.Epoch == vc.epoch && voterSetKey(args.Voters) == voterSetKey(vc.commonVoters) {
+			vc.submissionSuccess[counter] = true
+		}
 		vc.mu.Unlock()
 	}
 }
 
 //
-//	Get the total of other vote counters
+//	Get the total of other vote counters, once the voting is closed.
+//	A total that comes before we agree on the common voters waits
+//	for us to.
 //
-func (vc *VoteCounter) CountTotal(args *CountTotalArgs, reply *CountTotalReply) {
+func (vc *electionCounter) CountTotal(args *CountTotalArgs, reply *CountTotalReply) {
 	vc.mu.Lock()
 	defer vc.mu.Unlock()
 
-	vc.totalCounts[args.Index] = args.Value
+	if vc.phase < VotingClosed || len(args.Value) != len(vc.candidates) ||
+		args.Index < 1 || args.Index > len(vc.committeeMembers) || args.Index == vc.me+1 {
+		reply.Success = false
+		return
+	}
+
+	if vc.commonVoters == nil {
+		if _, ok := vc.earlyTotals[args.Index]; !ok {
+			vc.earlyTotals[args.Index] = *args
+		}
+	} else if !vc.takeTotal(args) {
+		reply.Success = false
+		return
+	}
+	vc.startTotalsDeadline()
+	vc.checkResult()
+
+	vc.persist()
 	reply.Success = true
+}
 
-	if len(vc.totalCounts) >= vc.threshold {
-		vc.winner = computeWinner(vc.totalCounts, vc.nVoters)
+//
+// Record another counter's total, if it is over the common voters,
+// and the counter is one of those we expect to add them up. The
+// total comes with the sender's voter set, in case we lacked it.
+//
+func (vc *electionCounter) takeTotal(args *CountTotalArgs) bool {
+	vc.adoptVoterSet(args.Index, args.VoterSet)
+	if !vc.commonCounter(args.Index) || voterSetKey(args.Voters) != voterSetKey(vc.commonVoters) {
+		return false
 	}
+	vc.addTotal(args.Index, args.Epoch, args.Value)
+	return true
 }
 
 //
-// Returns whether or not there is a winner and
-// the winner. If there is no winner, returns -1.
+// Whether counter (index+1) is one we expect a total from
 //
-func (vc *VoteCounter) Done() (bool, int) {
-	vc.mu.Lock()
-	defer vc.mu.Unlock()
+func (vc *electionCounter) commonCounter(index int) bool {
+	for _, i := range vc.commonCounters {
+		if i == index {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// Record a counter's total over the common voters. A counter's
+// total never changes within an epoch, so only the first one it
+// sends is kept.
+//
+func (vc *electionCounter) addTotal(index, epoch int, total []int64) {
+	key := totalsKey(vc.commonVoters, epoch)
+	if _, ok := vc.totalCounts[key]; !ok {
+		vc.totalCounts[key] = &voterTotals{vc.commonVoters, vc.commonCounters, epoch, make(map[int][]int64)}
+	}
+	if _, ok := vc.totalCounts[key].Totals[index]; !ok {
+		vc.totalCounts[key].Totals[index] = total
+	}
+}
+
+//
+// Stop waiting for the totals of every expected counter once
+// the exchange deadline has passed
+//
+func (vc *electionCounter) startTotalsDeadline() {
+	if vc.totalsTimer {
+		return
+	}
+	vc.totalsTimer = true
+
+	go func() {
+		time.Sleep(vc.deadlines.Exchange)
+
+		vc.mu.Lock()
+		defer vc.mu.Unlock()
+
+		vc.totalsExpired = true
+		vc.checkResult()
+		vc.persist()
+	}()
+}
+
+//
+// Our own partial sum over the common voters, if we added one
+//
+func (vc *electionCounter) ownTotal() ([]int64, bool) {
+	vt, ok := vc.totalCounts[totalsKey(vc.commonVoters, vc.epoch)]
+	if !ok || vc.commonVoters == nil {
+		return nil, false
+	}
 
-	return vc.winner != -1, vc.winner
+	total, ok := vt.Totals[vc.me+1]
+	return total, ok
 }
 
 //
-// the tester doesn't halt goroutines created after each test,
-// but it does call the Kill() method. The use of atomic avoids the
-// need for a lock.
+// Reconstruct the result once every expected counter that isn't
+// dead sent its total over the same voters, or once the totals
+// deadline has passed. Unless every expected counter sent one, that
+// takes more than threshold totals: with exactly threshold, a bad
+// one would go unnoticed, so there is no result until more come.
+// If the totals can't be decoded, wait for more of them rather
+// than guess.
 //
-func (vc *VoteCounter) Kill() {
-	atomic.StoreInt32(&vc.dead, 1)
+func (vc *electionCounter) checkResult() {
+	if vc.result != nil {
+		return
+	}
+
+	for _, vt := range vc.totalCounts {
+		// totals over voters we no longer take to be the common ones
+		if voterSetKey(vt.Voters) != voterSetKey(vc.commonVoters) {
+			continue
+		}
+
+		all, complete := true, true
+		for _, index := range vt.Counters {
+			if _, ok := vt.Totals[index]; !ok {
+				all = false
+				if !vc.peerDead(index - 1) {
+					complete = false
+				}
+			}
+		}
+
+		enough := len(vt.Totals) > vc.threshold || (all && len(vt.Totals) == vc.threshold)
+		if (complete || vc.totalsExpired) && enough {
+			result, ok := computeWinner(vt.Totals, len(vc.candidates), len(vt.Voters), vc.nVoters, vc.threshold)
+			if ok {
+				result.Chosen = vc.chosenCounters
+				vc.result = &result
+				vc.phase = ResultFinal
+				return
+			}
+		}
+	}
+}
+
+//
+//	Announce the result to a voter, once there is one
+//
+func (vc *electionCounter) GetResult(args *GetResultArgs, reply *GetResultReply) {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+
+	if vc.result != nil {
+		reply.Done = true
+		reply.Result = *vc.result
+	}
 }
 
 //
-// Check whether Kill() has been called.
+// Returns whether or not the election has a result and,
+// if it does, the reconstructed tally and winner.
 //
-func (vc *VoteCounter) killed() bool {
-	z := atomic.LoadInt32(&vc.dead)
-	return z == 1
+func (vc *electionCounter) Done() (bool, Result) {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+
+	if vc.result == nil {
+		return false, Result{Winner: NoWinner}
+	}
+
+	result := *vc.result
+	result.Tally = append([]int64(nil), vc.result.Tally...)
+	result.Chosen = append([]int(nil), vc.result.Chosen...)
+	result.Counters = append([]int(nil), vc.result.Counters...)
+	result.Faulty = append([]int(nil), vc.result.Faulty...)
+
+	return true, result
 }
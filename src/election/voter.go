@@ -2,14 +2,17 @@ package election
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdh"
 	"crypto/rand"
+	"log"
 	"math/big"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"6.824/labgob"
-	"6.824/labrpc"
+	"6.824/shamir"
 )
 
 // TODO: tune this
@@ -26,44 +29,61 @@ func nrand(max int64) int64 {
 	return x
 }
 
-// Evaluate polynomial
-// f(x) = coef[0] + coef[0]x + coef[0]x^2 + ...
-func evalPolynimialL(coef []int64, x int64) int64 {
-	fx := big.NewInt(0)
-	bigX := big.NewInt(x)
+// Votes are shared in Z_field
+var votingField = makeVotingField()
 
-	for exp, c := range coef {
-		var monomial big.Int
-		monomial = *monomial.Exp(bigX, big.NewInt(int64(exp)), big.NewInt(0)) // x^exp
-		monomial.Mul(&monomial, big.NewInt(c))
-		fx.Add(fx, &monomial)
+func makeVotingField() *shamir.Field {
+	f, err := shamir.NewField(big.NewInt(field))
+	if err != nil {
+		log.Fatalf("voting field: %v", err)
 	}
+	return f
+}
 
-	fx.Mod(fx, big.NewInt(field))
-	return fx.Int64()
+// a + b in Z_field
+func fieldAdd(a, b int64) int64 {
+	return votingField.Add(big.NewInt(a), big.NewInt(b)).Int64()
 }
 
 type CountVoteArgs struct {
-	VoterId int64
-	Vote    int64
+	ElectionId  string
+	VoterId     int64
+	Sealed      SealedShare // one share and one blinding share per candidate
+	Commitments [][]int64   // commitments[candidate][coefficient]
+	Proof       BallotProof
+	Signature   []byte // by the voter, over all of the above and the election id
 }
 
 type CountVoteReply struct {
 	Success bool
+	Err     Err // why the ballot was rejected, if it was
 }
 
 type Voter struct {
-	mu   sync.Mutex
-	dead int32
+	mu     sync.Mutex
+	dead   int32
+	ctx    context.Context    // of our RPCs, done once killed
+	cancel context.CancelFunc // called by Kill()
 
 	voterId           int64
+	credential        Credential // issued by the registry
 	persister         Persister
-	committeeMembers  []*labrpc.ClientEnd
+	committeeMembers  []Endpoint
+	counterKeys       []*ecdh.PublicKey // to seal each counter's shares with
 	submissionSuccess map[int]bool
-
-	vote      int
-	shares    []int64
-	threshold int
+	registered        map[int]bool // whether each counter took our registration
+
+	candidates  []string
+	vote        int
+	shares      [][]int64     // shares[counter][candidate]
+	blinds      [][]int64     // blinds[counter][candidate]
+	sealed      []SealedShare // sealed[counter], nil until first sent
+	commitments [][]int64     // commitments[candidate][coefficient]
+	proof       BallotProof
+	threshold   int
+
+	counterResults map[int]Result // results announced by each counter
+	result         *Result        // accepted once threshold counters agree
 }
 
 type Persister interface {
@@ -74,16 +94,23 @@ type Persister interface {
 //
 // main/voter.go calls this function.
 //
-func MakeVoter(committeeMembers []*labrpc.ClientEnd, vote, threshold int, persister Persister) *Voter {
+func MakeVoter(committeeMembers []Endpoint, counterKeys []*ecdh.PublicKey, credential Credential, candidates []string, vote, threshold int, persister Persister) *Voter {
 	vt := &Voter{}
+	vt.ctx, vt.cancel = context.WithCancel(context.Background())
 
-	vt.voterId = nrand(0)
+	vt.voterId = credential.VoterId
+	vt.credential = credential
 	vt.persister = persister
 	vt.committeeMembers = committeeMembers
+	vt.counterKeys = counterKeys
 	vt.submissionSuccess = make(map[int]bool)
+	vt.registered = make(map[int]bool)
+	vt.counterResults = make(map[int]Result)
 
+	vt.candidates = candidates
 	vt.vote = vote
-	vt.shares = make([]int64, len(committeeMembers))
+	vt.shares = make([][]int64, len(committeeMembers))
+	vt.blinds = make([][]int64, len(committeeMembers))
 	vt.threshold = threshold
 
 	if !vt.readPersist() {
@@ -103,15 +130,27 @@ func (vt *Voter) readPersist() bool {
 
 	r := bytes.NewBuffer(data)
 	d := labgob.NewDecoder(r)
+	var voterId int64
 	var vote int
-	var shares []int64
-
-	if d.Decode(&vote) != nil || d.Decode(&shares) != nil {
+	var shares [][]int64
+	var blinds [][]int64
+	var commitments [][]int64
+	var proof BallotProof
+	var sealed []SealedShare
+
+	if d.Decode(&voterId) != nil || d.Decode(&vote) != nil ||
+		d.Decode(&shares) != nil || d.Decode(&blinds) != nil ||
+		d.Decode(&commitments) != nil || d.Decode(&proof) != nil ||
+		d.Decode(&sealed) != nil {
 		panic("Error decoding persist data")
-	} else if vt.vote != vote {
+	} else if vt.vote != vote || vt.voterId != voterId {
 		panic("Error decoding persist data")
 	} else {
 		vt.shares = shares
+		vt.blinds = blinds
+		vt.commitments = commitments
+		vt.proof = proof
+		vt.sealed = sealed
 	}
 
 	return true
@@ -120,36 +159,180 @@ func (vt *Voter) readPersist() bool {
 func (vt *Voter) persist() {
 	w := new(bytes.Buffer)
 	e := labgob.NewEncoder(w)
+	e.Encode(vt.voterId)
 	e.Encode(vt.vote)
 	e.Encode(vt.shares)
+	e.Encode(vt.blinds)
+	e.Encode(vt.commitments)
+	e.Encode(vt.proof)
+	e.Encode(vt.sealed)
 	data := w.Bytes()
 	vt.persister.writePersistState(data)
 }
 
 //
 // Function to create Shamir Shares
-// - Polynomial of degree nShares over Z_field
-// - len(vt.committeeMembers) shares
+// - The vote is a one-hot vector over the candidates, and each
+//   entry gets its own polynomial of degree threshold-1 over Z_field
+// - len(vt.committeeMembers) shares, each with one value per candidate
+// - A random blinding polynomial per candidate, and commitments
+//   to both, so that counters can verify their shares
+// - A proof that the vote is one-hot
 //
 func (vt *Voter) makeShares() {
-	// Polynomial of degree nShares-1 with coefficients in field Z_field
-	coefficients := make([]int64, vt.threshold)
+	if !vt.validVote() {
+		// Vote() refuses it, rather than cast a ballot for no one
+		return
+	}
+
+	secrets := make([]int64, len(vt.candidates))
+	secrets[vt.vote] = 1
+	vt.shareSecrets(secrets)
+}
+
+func (vt *Voter) validVote() bool {
+	return vt.vote >= 0 && vt.vote < len(vt.candidates)
+}
 
-	coefficients[0] = int64(vt.vote)
-	for i := 1; i < vt.threshold; i++ {
-		val, _ := rand.Int(rand.Reader, big.NewInt(field))
-		coefficients[i] = val.Int64()
+func (vt *Voter) shareSecrets(secrets []int64) {
+	for i := range vt.shares {
+		vt.shares[i] = make([]int64, len(secrets))
+		vt.blinds[i] = make([]int64, len(secrets))
 	}
+	vt.commitments = make([][]int64, len(secrets))
+	openings := make([]int64, len(secrets))
+
+	for c := range secrets {
+		// Polynomials of degree threshold-1 with coefficients in field Z_field
+		coefficients, _ := votingField.RandomPolynomial(big.NewInt(secrets[c]), vt.threshold, rand.Reader)
+		blind, _ := votingField.Random(rand.Reader)
+		blinding, _ := votingField.RandomPolynomial(blind, vt.threshold, rand.Reader)
+
+		vt.commitments[c] = make([]int64, vt.threshold)
+		for i := 0; i < vt.threshold; i++ {
+			vt.commitments[c][i] = commit(coefficients[i].Int64(), blinding[i].Int64())
+		}
 
-	// Compute shares. For each committe member i, evaluate polynomial
-	// at x = i + 1
+		// Compute shares. For each committe member i, evaluate polynomial
+		// at x = i + 1
+		for i := range vt.shares {
+			vt.shares[i][c] = votingField.Eval(coefficients, i+1).Int64()
+			vt.blinds[i][c] = votingField.Eval(blinding, i+1).Int64()
+		}
+		openings[c] = blinding[0].Int64()
+	}
+
+	vt.proof = proveBallot(vt.voterId, secrets, openings, vt.commitments)
+	vt.sealed = nil
+}
+
+//
+// Seal every counter's shares with its public key, once, so
+// that retries send the very same ballot
+//
+func (vt *Voter) seal() {
+	if vt.sealed != nil {
+		return
+	}
+
+	sealed := make([]SealedShare, len(vt.shares))
 	for i := range vt.shares {
-		vt.shares[i] = evalPolynimialL(coefficients, int64(i+1))
+		s, err := sealShare(vt.counterKeys[i], vt.voterId, i+1, vt.shares[i], vt.blinds[i])
+		if err != nil {
+			log.Fatalf("seal shares for counter %v: %v", i, err)
+		}
+		sealed[i] = s
+	}
+
+	vt.sealed = sealed
+	vt.persist()
+}
+
+//
+// The signed ballot for a counter
+//
+func (vt *Voter) ballot(counter int) CountVoteArgs {
+	vt.seal()
+
+	args := CountVoteArgs{vt.credential.ElectionId, vt.voterId, vt.sealed[counter], vt.commitments, vt.proof, nil}
+	vt.credential.sign(&args)
+	return args
+}
+
+//
+// Enroll with every counter, for an election that has a
+// registration window. Vote() may be called right away, since
+// counters don't take ballots until the roll is final.
+//
+func (vt *Voter) Register() {
+	go vt.registerLoop()
+}
+
+func (vt *Voter) registerLoop() {
+	vt.mu.Lock()
+	defer vt.mu.Unlock()
+
+	args := vt.credential.registration()
+	for !vt.killed() && len(vt.registered) < len(vt.committeeMembers) {
+		for i := 0; i < len(vt.committeeMembers); i++ {
+			if _, done := vt.registered[i]; !done {
+				go func(counter int) {
+					reply := RegisterReply{}
+					vt.sendRegister(counter, &args, &reply)
+				}(i)
+			}
+		}
+
+		vt.mu.Unlock()
+		time.Sleep(time.Duration(voterTimeout) * time.Millisecond)
+		vt.mu.Lock()
 	}
 }
 
-func (vt *Voter) Vote() {
+func (vt *Voter) sendRegister(counter int, args *RegisterArgs, reply *RegisterReply) {
+	ok := vt.committeeMembers[counter].CallContext(vt.ctx, "VoteCounter.Register", args, reply) == nil
+
+	if ok && reply.Success {
+		vt.mu.Lock()
+		vt.registered[counter] = true
+		vt.mu.Unlock()
+	} else if ok && (reply.Err == ErrRegistrationClosed || reply.Err == ErrAlreadyRegistered ||
+		reply.Err == ErrInvalidSignature || reply.Err == ErrNotEligible) {
+		// This server won't take our registration, stop sending to it
+		vt.mu.Lock()
+		vt.registered[counter] = false
+		vt.mu.Unlock()
+	}
+}
+
+//
+// Returns whether every counter has either taken our registration
+// or closed its registration, and how many took it
+//
+func (vt *Voter) Registered() (bool, int) {
+	vt.mu.Lock()
+	defer vt.mu.Unlock()
+
+	n := 0
+	for _, ok := range vt.registered {
+		if ok {
+			n++
+		}
+	}
+	return len(vt.registered) == len(vt.committeeMembers), n
+}
+
+//
+// Cast our ballot, unless our vote isn't for one of the candidates
+//
+func (vt *Voter) Vote() Err {
+	if !vt.validVote() {
+		return ErrInvalidVote
+	}
+
 	go vt.voteLoop()
+	go vt.resultLoop()
+	return OK
 }
 
 //
@@ -162,13 +345,12 @@ func (vt *Voter) voteLoop() {
 	for !vt.killed() && len(vt.submissionSuccess) < len(vt.shares) {
 		// Send CountVote RPCs to everyone
 		for i := 0; i < len(vt.committeeMembers); i++ {
-			if !vt.submissionSuccess[i] {
-				go func(id int64, vote int64, counter int) {
-					args := CountVoteArgs{id, vote}
+			if _, submitted := vt.submissionSuccess[i]; !submitted {
+				go func(args CountVoteArgs, counter int) {
 					reply := CountVoteReply{}
 					vt.sendCountVote(counter, &args, &reply)
 
-				}(vt.voterId, vt.shares[i], i)
+				}(vt.ballot(i), i)
 			}
 		}
 
@@ -182,18 +364,98 @@ func (vt *Voter) voteLoop() {
 //  Send Count Votes RPC
 //
 func (vt *Voter) sendCountVote(counter int, args *CountVoteArgs, reply *CountVoteReply) {
-	ok := vt.committeeMembers[counter].Call("VoteCounter.CountVote", args, reply)
+	ok := vt.committeeMembers[counter].CallContext(vt.ctx, "VoteCounter.CountVote", args, reply) == nil
 
 	if ok && reply.Success {
 		// Update submissionSuccess as done for this server
 		vt.mu.Lock()
 		vt.submissionSuccess[counter] = true
 		vt.mu.Unlock()
+	} else if ok && (reply.Err == ErrVotingClosed || reply.Err == ErrInvalidShare ||
+		reply.Err == ErrInvalidProof || reply.Err == ErrUnknownVoter ||
+		reply.Err == ErrInvalidSignature || reply.Err == ErrConflictingShare) {
+		// This server won't take our shares, stop sending to it
+		vt.mu.Lock()
+		vt.submissionSuccess[counter] = false
+		vt.mu.Unlock()
 	}
 }
 
+//
+// Ask the vote counters for the result until threshold
+// of them announce the same one
+//
+func (vt *Voter) resultLoop() {
+	vt.mu.Lock()
+	defer vt.mu.Unlock()
+
+	for !vt.killed() && vt.result == nil {
+		for i := 0; i < len(vt.committeeMembers); i++ {
+			if _, announced := vt.counterResults[i]; !announced {
+				go func(id int64, counter int) {
+					args := GetResultArgs{vt.credential.ElectionId, id}
+					reply := GetResultReply{}
+					vt.sendGetResult(counter, &args, &reply)
+				}(vt.voterId, i)
+			}
+		}
+
+		vt.mu.Unlock()
+		time.Sleep(time.Duration(voterTimeout) * time.Millisecond)
+		vt.mu.Lock()
+	}
+}
+
+//
+//  Send Get Result RPC
+//
+func (vt *Voter) sendGetResult(counter int, args *GetResultArgs, reply *GetResultReply) {
+	ok := vt.committeeMembers[counter].CallContext(vt.ctx, "VoteCounter.GetResult", args, reply) == nil
+
+	if ok && reply.Done {
+		vt.mu.Lock()
+		defer vt.mu.Unlock()
+
+		vt.counterResults[counter] = reply.Result
+
+		agreeing := 0
+		for _, result := range vt.counterResults {
+			if result.sameOutcome(reply.Result) {
+				agreeing++
+			}
+		}
+
+		if agreeing >= vt.threshold && vt.result == nil {
+			result := reply.Result
+			vt.result = &result
+		}
+	}
+}
+
+//
+// Returns whether threshold counters agreed on a result and,
+// if they did, the result of the election
+//
+func (vt *Voter) Result() (bool, Result) {
+	vt.mu.Lock()
+	defer vt.mu.Unlock()
+
+	if vt.result == nil {
+		return false, Result{Winner: NoWinner}
+	}
+
+	result := *vt.result
+	result.Tally = append([]int64(nil), vt.result.Tally...)
+	result.Chosen = append([]int(nil), vt.result.Chosen...)
+	result.Counters = append([]int(nil), vt.result.Counters...)
+	result.Faulty = append([]int(nil), vt.result.Faulty...)
+
+	return true, result
+}
+
 func (vt *Voter) Kill() {
 	atomic.StoreInt32(&vt.dead, 1)
+	vt.cancel()
 }
 
 func (vt *Voter) killed() bool {
@@ -201,6 +463,10 @@ func (vt *Voter) killed() bool {
 	return z == 1
 }
 
+//
+// Returns whether every counter has either accepted our
+// shares or closed its voting
+//
 func (vt *Voter) Done() bool {
 	vt.mu.Lock()
 	defer vt.mu.Unlock()
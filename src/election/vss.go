@@ -0,0 +1,98 @@
+package election
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"math/big"
+)
+
+//
+// Verifiable secret sharing over the order-field subgroup of Z_groupP*.
+//
+// Feldman commitments g^a_j to the coefficients a_j of a polynomial
+// would let every counter try g^0 and g^1 against the commitment to
+// the vote. So each coefficient is committed to as g^a_j h^b_j with a
+// random blinding polynomial b (Pedersen), and every counter gets the
+// pair (f(x), b(x)), which it checks with Feldman's equation:
+//
+//   g^f(x) h^b(x) = prod_j C_j^(x^j)
+//
+// The group is only as big as the int64 field, so it shows the
+// protocol rather than providing real-world security.
+//
+
+// groupP = 20 * field + 1 is prime
+const groupP int64 = 22092754123610141
+const groupCofactor int64 = 20
+
+var bigP = big.NewInt(groupP)
+var bigField = big.NewInt(field)
+
+// g = 2^20 has order field
+var groupG = big.NewInt(1 << groupCofactor)
+
+// nobody knows log_g(h), since it is derived from a hash
+var groupH = hashToGroup("distributed-evoting/h")
+
+func hashToGroup(seed string) *big.Int {
+	sum := sha256.Sum256([]byte(seed))
+	x := new(big.Int).SetBytes(sum[:])
+	x.Mod(x, bigP)
+	return x.Exp(x, big.NewInt(groupCofactor), bigP)
+}
+
+//
+// Pedersen commitment g^a h^b mod groupP
+//
+func commit(a, b int64) int64 {
+	ga := new(big.Int).Exp(groupG, big.NewInt(a), bigP)
+	hb := new(big.Int).Exp(groupH, big.NewInt(b), bigP)
+	ga.Mul(ga, hb)
+	ga.Mod(ga, bigP)
+	return ga.Int64()
+}
+
+//
+// Check that (share, blind) is the evaluation at x of the
+// polynomials committed to in commitments
+//
+func verifyShare(commitments []int64, x, share, blind int64) bool {
+	if len(commitments) == 0 {
+		return false
+	}
+
+	expected := big.NewInt(1)
+	bigX := big.NewInt(x)
+	for exp, c := range commitments {
+		// outside the subgroup, whether c^(x^exp) matches would
+		// depend on x, and not only on the polynomials
+		if !inGroup(c) {
+			return false
+		}
+		power := new(big.Int).Exp(bigX, big.NewInt(int64(exp)), bigField) // x^exp
+		term := new(big.Int).Exp(big.NewInt(c), power, bigP)
+		expected.Mul(expected, term)
+		expected.Mod(expected, bigP)
+	}
+
+	return expected.Int64() == commit(share, blind)
+}
+
+//
+// Digest of a voter's commitments, so that counters can cheaply
+// check that a voter gave all of them the same polynomials
+//
+func commitmentDigest(commitments [][]int64) string {
+	h := sha256.New()
+	buf := make([]byte, 8)
+	for _, candidate := range commitments {
+		binary.BigEndian.PutUint64(buf, uint64(len(candidate)))
+		h.Write(buf)
+		for _, c := range candidate {
+			binary.BigEndian.PutUint64(buf, uint64(c))
+			h.Write(buf)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,158 @@
+package labrpc
+
+//
+// the time a Network delays and times out requests by.
+//
+// by default, a Network uses the wall clock. a test that wants
+// the network's delays to be reproducible gives it a VirtualClock
+// instead, whose time only moves on when the test calls Advance():
+//
+// clock := MakeVirtualClock()
+// net.SetClock(clock)
+// clock.Advance(100 * time.Millisecond) -- fire what's due by then, in order.
+//
+// only the network's own delays follow the clock; the servers'
+// handlers, and their callers, still run in real time.
+//
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	After(d time.Duration) (<-chan time.Time, Timer)
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// a timer of a Clock, like *time.Timer. Stop() returns false if
+// the timer had already fired or been stopped.
+type Timer interface {
+	Stop() bool
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+func (realClock) After(d time.Duration) (<-chan time.Time, Timer) {
+	t := time.NewTimer(d)
+	return t.C, t
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+type virtualTimer struct {
+	vc *VirtualClock
+	at time.Time
+	n  int // order of creation, to break ties
+	f  func()
+}
+
+type VirtualClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	n      int
+	timers []*virtualTimer
+}
+
+func MakeVirtualClock() *VirtualClock {
+	vc := &VirtualClock{}
+	vc.now = time.Unix(0, 0)
+	return vc
+}
+
+func (vc *VirtualClock) Now() time.Time {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+
+	return vc.now
+}
+
+func (vc *VirtualClock) AfterFunc(d time.Duration, f func()) Timer {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+
+	vc.n++
+	timer := &virtualTimer{vc, vc.now.Add(d), vc.n, f}
+	vc.timers = append(vc.timers, timer)
+	return timer
+}
+
+func (vc *VirtualClock) After(d time.Duration) (<-chan time.Time, Timer) {
+	ch := make(chan time.Time, 1)
+	timer := vc.AfterFunc(d, func() {
+		ch <- vc.Now()
+	})
+	return ch, timer
+}
+
+func (vc *VirtualClock) Sleep(d time.Duration) {
+	ch, _ := vc.After(d)
+	<-ch
+}
+
+// take the timer off its clock, if it hasn't fired yet.
+func (t *virtualTimer) Stop() bool {
+	vc := t.vc
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+
+	for i, timer := range vc.timers {
+		if timer == t {
+			vc.timers = append(vc.timers[:i], vc.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// the number of timers that haven't fired or been stopped yet,
+// e.g. to wait until a request is being delayed before advancing
+// the clock.
+func (vc *VirtualClock) Pending() int {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+
+	return len(vc.timers)
+}
+
+// move time on by d, firing every timer due by then, earliest
+// first, each at its own time.
+func (vc *VirtualClock) Advance(d time.Duration) {
+	vc.mu.Lock()
+	end := vc.now.Add(d)
+	vc.mu.Unlock()
+
+	for {
+		vc.mu.Lock()
+		sort.Slice(vc.timers, func(i, j int) bool {
+			if !vc.timers[i].at.Equal(vc.timers[j].at) {
+				return vc.timers[i].at.Before(vc.timers[j].at)
+			}
+			return vc.timers[i].n < vc.timers[j].n
+		})
+		if len(vc.timers) == 0 || vc.timers[0].at.After(end) {
+			vc.now = end
+			vc.mu.Unlock()
+			return
+		}
+		timer := vc.timers[0]
+		vc.timers = vc.timers[1:]
+		vc.now = timer.at
+		vc.mu.Unlock()
+
+		timer.f()
+	}
+}
@@ -22,8 +22,20 @@ package labrpc
 // net.Connect(endname, servername) -- connect a client to a server.
 // net.Enable(endname, enabled) -- enable/disable a client.
 // net.Reliable(bool) -- false means drop/delay messages
+// net.Tap(f) -- f(endname, svcMeth, args) sees every request as sent
+// net.SetOwner(endname, node) -- the end's requests come from node, e.g. a servername.
+// net.Partition(groups...) -- nodes in different groups can't reach each other.
+// net.Cut(from, to) -- requests from node from to server to are lost.
+// net.Heal() -- undo all Partition()s and Cut()s.
+//
+// net := MakeSeededNetwork(seed) -- a network whose random drops, delays
+//   and reorderings are those of seed, given the same requests on each end;
+//   net.Seed() -- the seed of any network, to print and replay failures.
+// net.SetClock(clock) -- delay by clock instead of the wall clock (see clock.go).
 //
 // end.Call("Raft.AppendEntries", &args, &reply) -- send an RPC, wait for reply.
+// end.CallContext(ctx, "Raft.AppendEntries", &args, &reply) -- the same,
+//   giving up when ctx is done, and returning why it failed, if it did.
 // the "Raft" is the name of the server struct to be called.
 // the "AppendEntries" is the name of the method to be called.
 // Call() returns true to indicate that the server executed the request
@@ -42,20 +54,26 @@ package labrpc
 //
 // srv := MakeServer()
 // srv.AddService(svc) -- a server can have multiple services, e.g. Raft and k/v
-//   pass srv to net.AddServer()
+//   pass srv to net.AddServer(), or to ListenTCP() (see tcp.go)
 //
 // svc := MakeService(receiverObject) -- obj's methods will handle RPCs
 //   much like Go's rpcs.Register()
 //   pass svc to srv.AddService()
 //
+// a handler that needs to know who called it declares a Caller
+// before its args, e.g. Method(caller labrpc.Caller, args *Args, reply *Reply).
+//
 
 import "6.824/labgob"
 import "bytes"
+import "context"
+import "errors"
+import "fmt"
+import "hash/fnv"
 import "reflect"
 import "sync"
 import "log"
 import "strings"
-import "math/rand"
 import "time"
 import "sync/atomic"
 
@@ -65,8 +83,18 @@ type reqMsg struct {
 	argsType reflect.Type
 	args     []byte
 	replyCh  chan replyMsg
+	n        int32  // the request's number on its end
+	caller   Caller // who sent it, as far as the server can tell
 }
 
+// who sent an RPC: on a Network, the node that owns the sending
+// end (see SetOwner()); over mutual TLS, the identity in the
+// client's certificate (see tls.go). nil if no one vouches for
+// the caller, e.g. over plain TCP.
+type Caller interface{}
+
+var callerType = reflect.TypeOf((*Caller)(nil)).Elem()
+
 type replyMsg struct {
 	ok    bool
 	reply []byte
@@ -74,19 +102,55 @@ type replyMsg struct {
 
 type ClientEnd struct {
 	endname interface{}   // this end-point's name
+	count   int32         // requests sent, to number them
 	ch      chan reqMsg   // copy of Network.endCh
 	done    chan struct{} // closed when Network is cleaned up
+	tcp     *tcpClient    // instead of ch, for an end made with MakeTCPEnd()
+}
+
+// errors from CallContext().
+var (
+	ErrTimeout          = errors.New("labrpc: deadline passed before the reply")
+	ErrCanceled         = errors.New("labrpc: call canceled")
+	ErrServerDead       = errors.New("labrpc: no reply from the server")
+	ErrNetworkDestroyed = errors.New("labrpc: network destroyed")
+)
+
+// the reply came back, but didn't decode into the caller's reply.
+type DecodeError struct {
+	SvcMeth string
+	Err     error
+}
+
+func (de *DecodeError) Error() string {
+	return fmt.Sprintf("labrpc: decode reply of %v: %v", de.SvcMeth, de.Err)
+}
+
+func (de *DecodeError) Unwrap() error {
+	return de.Err
 }
 
 // send an RPC, wait for the reply.
 // the return value indicates success; false means that
-// no reply was received from the server.
+// no reply was received from the server, or that it didn't
+// decode. see CallContext() for why.
 func (e *ClientEnd) Call(svcMeth string, args interface{}, reply interface{}) bool {
+	return e.CallContext(context.Background(), svcMeth, args, reply) == nil
+}
+
+// send an RPC, wait for the reply until ctx is done.
+// returns nil if the server executed the request and the reply
+// is valid, ErrTimeout or ErrCanceled if ctx was done first,
+// ErrServerDead if the network lost the request or reply or the
+// server is down, ErrNetworkDestroyed if the Network has been
+// cleaned up, and a *DecodeError if the reply didn't decode.
+// a call abandoned because of ctx may still be executed.
+func (e *ClientEnd) CallContext(ctx context.Context, svcMeth string, args interface{}, reply interface{}) error {
 	req := reqMsg{}
 	req.endname = e.endname
 	req.svcMeth = svcMeth
 	req.argsType = reflect.TypeOf(args)
-	req.replyCh = make(chan replyMsg)
+	req.replyCh = make(chan replyMsg, 1) // the reply may come after we gave up
 
 	qb := new(bytes.Buffer)
 	qe := labgob.NewEncoder(qb)
@@ -95,31 +159,56 @@ func (e *ClientEnd) Call(svcMeth string, args interface{}, reply interface{}) bo
 	}
 	req.args = qb.Bytes()
 
-	//
-	// send the request.
-	//
-	select {
-	case e.ch <- req:
-		// the request has been sent.
-	case <-e.done:
-		// entire Network has been destroyed.
-		return false
-	}
+	var rep replyMsg
+	if e.tcp != nil {
+		var err error
+		if rep, err = e.tcp.call(ctx, svcMeth, req.args); err != nil {
+			return err
+		}
+	} else {
+		req.n = atomic.AddInt32(&e.count, 1)
+
+		//
+		// send the request.
+		//
+		select {
+		case e.ch <- req:
+			// the request has been sent.
+		case <-e.done:
+			// entire Network has been destroyed.
+			return ErrNetworkDestroyed
+		case <-ctx.Done():
+			return contextError(ctx)
+		}
 
-	//
-	// wait for the reply.
-	//
-	rep := <-req.replyCh
+		//
+		// wait for the reply.
+		//
+		select {
+		case rep = <-req.replyCh:
+		case <-e.done:
+			return ErrNetworkDestroyed
+		case <-ctx.Done():
+			return contextError(ctx)
+		}
+	}
 	if rep.ok {
 		rb := bytes.NewBuffer(rep.reply)
 		rd := labgob.NewDecoder(rb)
 		if err := rd.Decode(reply); err != nil {
-			log.Fatalf("ClientEnd.Call(): decode reply: %v\n", err)
+			return &DecodeError{svcMeth, err}
 		}
-		return true
+		return nil
 	} else {
-		return false
+		return ErrServerDead
+	}
+}
+
+func contextError(ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return ErrTimeout
 	}
+	return ErrCanceled
 }
 
 type Network struct {
@@ -131,19 +220,32 @@ type Network struct {
 	enabled        map[interface{}]bool        // by end name
 	servers        map[interface{}]*Server     // servers, by name
 	connections    map[interface{}]interface{} // endname -> servername
+	owners         map[interface{}]interface{} // endname -> node it sends for
+	cuts           map[link]bool               // links that lose every request
 	endCh          chan reqMsg
 	done           chan struct{} // closed when Network is cleaned up
-	count          int32         // total RPC count, for statistics
-	bytes          int64         // total bytes send, for statistics
+	tap            func(endname interface{}, svcMeth string, args []byte)
+	count          int32 // total RPC count, for statistics
+	bytes          int64 // total bytes send, for statistics
+	seed           int64 // of every request's random choices
+	clock          Clock
 }
 
 func MakeNetwork() *Network {
+	return MakeSeededNetwork(time.Now().UnixNano())
+}
+
+func MakeSeededNetwork(seed int64) *Network {
 	rn := &Network{}
+	rn.seed = seed
+	rn.clock = realClock{}
 	rn.reliable = true
 	rn.ends = map[interface{}]*ClientEnd{}
 	rn.enabled = map[interface{}]bool{}
 	rn.servers = map[interface{}]*Server{}
 	rn.connections = map[interface{}](interface{}){}
+	rn.owners = map[interface{}](interface{}){}
+	rn.cuts = map[link]bool{}
 	rn.endCh = make(chan reqMsg)
 	rn.done = make(chan struct{})
 
@@ -164,6 +266,49 @@ func MakeNetwork() *Network {
 	return rn
 }
 
+func (rn *Network) Seed() int64 {
+	return rn.seed
+}
+
+func (rn *Network) SetClock(clock Clock) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.clock = clock
+}
+
+func (rn *Network) readClock() Clock {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	return rn.clock
+}
+
+//
+// the random choices of one request, from the network's seed, the
+// end's name and the request's number on the end, so that they
+// don't depend on how the requests of different ends interleave
+// (splitmix64).
+//
+type requestRand struct {
+	x uint64
+}
+
+func (rn *Network) requestRand(endname interface{}, n int32) *requestRand {
+	h := fnv.New64a()
+	fmt.Fprint(h, endname)
+	return &requestRand{uint64(rn.seed) ^ h.Sum64() ^ uint64(n)*0xd1b54a32d192ed03}
+}
+
+func (r *requestRand) Intn(n int) int {
+	r.x += 0x9e3779b97f4a7c15
+	z := r.x
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	z = z ^ (z >> 31)
+	return int(z % uint64(n))
+}
+
 func (rn *Network) Cleanup() {
 	close(rn.done)
 }
@@ -189,13 +334,29 @@ func (rn *Network) LongDelays(yes bool) {
 	rn.longDelays = yes
 }
 
+// f is called with the encoded args of every request that is sent,
+// like an eavesdropper on the wire would see them. nil stops it.
+func (rn *Network) Tap(f func(endname interface{}, svcMeth string, args []byte)) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.tap = f
+}
+
+func (rn *Network) readTap() func(endname interface{}, svcMeth string, args []byte) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	return rn.tap
+}
+
 func (rn *Network) readEndnameInfo(endname interface{}) (enabled bool,
 	servername interface{}, server *Server, reliable bool, longreordering bool,
 ) {
 	rn.mu.Lock()
 	defer rn.mu.Unlock()
 
-	enabled = rn.enabled[endname]
+	enabled = rn.enabled[endname] && !rn.isCut(endname)
 	servername = rn.connections[endname]
 	if servername != nil {
 		server = rn.servers[servername]
@@ -209,23 +370,30 @@ func (rn *Network) isServerDead(endname interface{}, servername interface{}, ser
 	rn.mu.Lock()
 	defer rn.mu.Unlock()
 
-	if rn.enabled[endname] == false || rn.servers[servername] != server {
+	if rn.enabled[endname] == false || rn.isCut(endname) || rn.servers[servername] != server {
 		return true
 	}
 	return false
 }
 
 func (rn *Network) processReq(req reqMsg) {
+	if tap := rn.readTap(); tap != nil {
+		tap(req.endname, req.svcMeth, req.args)
+	}
+
 	enabled, servername, server, reliable, longreordering := rn.readEndnameInfo(req.endname)
+	clock := rn.readClock()
+	rand := rn.requestRand(req.endname, req.n)
+	req.caller = rn.readOwner(req.endname)
 
 	if enabled && servername != nil && server != nil {
 		if reliable == false {
 			// short delay
-			ms := (rand.Int() % 27)
-			time.Sleep(time.Duration(ms) * time.Millisecond)
+			ms := rand.Intn(27)
+			clock.Sleep(time.Duration(ms) * time.Millisecond)
 		}
 
-		if reliable == false && (rand.Int()%1000) < 100 {
+		if reliable == false && rand.Intn(1000) < 100 {
 			// drop the request, return as if timeout
 			req.replyCh <- replyMsg{false, nil}
 			return
@@ -248,10 +416,12 @@ func (rn *Network) processReq(req reqMsg) {
 		replyOK := false
 		serverDead := false
 		for replyOK == false && serverDead == false {
+			timeout, timer := clock.After(100 * time.Millisecond)
 			select {
 			case reply = <-ech:
+				timer.Stop()
 				replyOK = true
-			case <-time.After(100 * time.Millisecond):
+			case <-timeout:
 				serverDead = rn.isServerDead(req.endname, servername, server)
 				if serverDead {
 					go func() {
@@ -272,7 +442,7 @@ func (rn *Network) processReq(req reqMsg) {
 		if replyOK == false || serverDead == true {
 			// server was killed while we were waiting; return error.
 			req.replyCh <- replyMsg{false, nil}
-		} else if reliable == false && (rand.Int()%1000) < 100 {
+		} else if reliable == false && rand.Intn(1000) < 100 {
 			// drop the reply, return as if timeout
 			req.replyCh <- replyMsg{false, nil}
 		} else if longreordering == true && rand.Intn(900) < 600 {
@@ -281,7 +451,7 @@ func (rn *Network) processReq(req reqMsg) {
 			// Russ points out that this timer arrangement will decrease
 			// the number of goroutines, so that the race
 			// detector is less likely to get upset.
-			time.AfterFunc(time.Duration(ms)*time.Millisecond, func() {
+			clock.AfterFunc(time.Duration(ms)*time.Millisecond, func() {
 				atomic.AddInt64(&rn.bytes, int64(len(reply.reply)))
 				req.replyCh <- reply
 			})
@@ -295,13 +465,13 @@ func (rn *Network) processReq(req reqMsg) {
 		if rn.longDelays {
 			// let Raft tests check that leader doesn't send
 			// RPCs synchronously.
-			ms = (rand.Int() % 7000)
+			ms = rand.Intn(7000)
 		} else {
 			// many kv tests require the client to try each
 			// server in fairly rapid succession.
-			ms = (rand.Int() % 100)
+			ms = rand.Intn(100)
 		}
-		time.AfterFunc(time.Duration(ms)*time.Millisecond, func() {
+		clock.AfterFunc(time.Duration(ms)*time.Millisecond, func() {
 			req.replyCh <- replyMsg{false, nil}
 		})
 	}
@@ -352,6 +522,80 @@ func (rn *Network) Connect(endname interface{}, servername interface{}) {
 	rn.connections[endname] = servername
 }
 
+// the requests of endname are sent by node, so that they are
+// lost when node is cut off from the end's server. node may be
+// a servername, or the name of any other client, e.g. "voter-3".
+func (rn *Network) SetOwner(endname interface{}, node interface{}) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.owners[endname] = node
+}
+
+func (rn *Network) readOwner(endname interface{}) interface{} {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	return rn.owners[endname]
+}
+
+// a one-way link, from a node to a server.
+type link struct {
+	from interface{}
+	to   interface{}
+}
+
+// whether the requests of endname are lost to a cut.
+// the caller holds rn.mu.
+func (rn *Network) isCut(endname interface{}) bool {
+	owner, ok := rn.owners[endname]
+	if !ok {
+		return false
+	}
+	return rn.cuts[link{owner, rn.connections[endname]}]
+}
+
+// split the network: every node of a group can no longer reach
+// the nodes of the other groups, or be reached by them, but nodes
+// in no group still reach, and are reached by, everyone. replaces
+// any earlier Partition() and Cut().
+func (rn *Network) Partition(groups ...[]interface{}) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.cuts = map[link]bool{}
+	for i, group := range groups {
+		for j, other := range groups {
+			if i == j {
+				continue
+			}
+			for _, from := range group {
+				for _, to := range other {
+					rn.cuts[link{from, to}] = true
+				}
+			}
+		}
+	}
+}
+
+// cut the link from node from to server to, one way: from's
+// requests to to are lost, but to's requests to from, and their
+// replies, still go through.
+func (rn *Network) Cut(from interface{}, to interface{}) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.cuts[link{from, to}] = true
+}
+
+// undo every Partition() and Cut().
+func (rn *Network) Heal() {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.cuts = map[link]bool{}
+}
+
 // enable/disable a ClientEnd.
 func (rn *Network) Enable(endname interface{}, enabled bool) {
 	rn.mu.Lock()
@@ -460,9 +704,9 @@ func MakeService(rcvr interface{}) *Service {
 		//	mname, method.PkgPath, mtype.NumIn(), mtype.In(1).Kind(), mtype.In(2).Kind(), mtype.NumOut())
 
 		if method.PkgPath != "" || // capitalized?
-			mtype.NumIn() != 3 ||
+			mtype.NumIn() != 3 && !(mtype.NumIn() == 4 && mtype.In(1) == callerType) ||
 			//mtype.In(1).Kind() != reflect.Ptr ||
-			mtype.In(2).Kind() != reflect.Ptr ||
+			mtype.In(mtype.NumIn()-1).Kind() != reflect.Ptr ||
 			mtype.NumOut() != 0 {
 			// the method is not suitable for a handler
 			//fmt.Printf("bad method: %v\n", mname)
@@ -475,25 +719,42 @@ func MakeService(rcvr interface{}) *Service {
 	return svc
 }
 
+// the index of a handler's args among its method's arguments,
+// after the receiver, and the Caller if it takes one.
+func argsIn(mtype reflect.Type) int {
+	return mtype.NumIn() - 2
+}
+
 func (svc *Service) dispatch(methname string, req reqMsg) replyMsg {
 	if method, ok := svc.methods[methname]; ok {
 		// prepare space into which to read the argument.
 		// the Value's type will be a pointer to req.argsType.
 		args := reflect.New(req.argsType)
 
-		// decode the argument.
+		// decode the argument. the handler never sees arguments
+		// that don't decode, e.g. of another type from a remote client.
 		ab := bytes.NewBuffer(req.args)
 		ad := labgob.NewDecoder(ab)
-		ad.Decode(args.Interface())
+		if err := ad.Decode(args.Interface()); err != nil {
+			return replyMsg{false, nil}
+		}
 
 		// allocate space for the reply.
-		replyType := method.Type.In(2)
+		replyType := method.Type.In(method.Type.NumIn() - 1)
 		replyType = replyType.Elem()
 		replyv := reflect.New(replyType)
 
 		// call the method.
 		function := method.Func
-		function.Call([]reflect.Value{svc.rcvr, args.Elem(), replyv})
+		in := []reflect.Value{svc.rcvr}
+		if method.Type.NumIn() == 4 {
+			callerv := reflect.New(callerType).Elem()
+			if req.caller != nil {
+				callerv.Set(reflect.ValueOf(req.caller))
+			}
+			in = append(in, callerv)
+		}
+		function.Call(append(in, args.Elem(), replyv))
 
 		// encode the reply.
 		rb := new(bytes.Buffer)
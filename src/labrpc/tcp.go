@@ -0,0 +1,345 @@
+package labrpc
+
+//
+// RPC over TCP, for servers and clients in separate processes.
+//
+// the calls of a ClientEnd made with MakeTCPEnd() go to the
+// Server listening at its address, labgob-encoded as on a
+// Network, and with the same contract: Call() returns true if
+// the server executed the request and the reply is valid, and
+// false if the connection failed, or no reply came back in time;
+// CallContext() says which, with ErrServerDead or ErrTimeout.
+//
+// end := MakeTCPEnd("localhost:7000") -- a client end-point.
+// l, err := ListenTCP(srv, "localhost:7000") -- serve srv's services.
+// l.Addr() -- the address it listens on, e.g. for "localhost:0".
+// l.Close() -- stop serving, and drop every connection.
+//
+// a ClientEnd keeps one connection open, shared by all of its
+// calls, and dials again after a failure.
+//
+// for mutual TLS, see tls.go.
+//
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"6.824/labgob"
+)
+
+const tcpDialTimeout = 1 * time.Second
+const tcpCallTimeout = 10 * time.Second
+
+type tcpRequest struct {
+	Seq     uint64
+	SvcMeth string
+	Args    []byte
+}
+
+type tcpReply struct {
+	Seq   uint64
+	Ok    bool
+	Reply []byte
+}
+
+type tcpClient struct {
+	mu      sync.Mutex
+	addr    string
+	tls     *tls.Config // nil for plain TCP
+	seq     uint64
+	conn    net.Conn // nil until dialed, and after a failure
+	enc     *labgob.LabEncoder
+	pending map[uint64]chan tcpReply // calls waiting for a reply, by Seq
+}
+
+// create a client end-point to the server at addr.
+func MakeTCPEnd(addr string) *ClientEnd {
+	e := &ClientEnd{}
+	e.endname = addr
+	e.tcp = &tcpClient{addr: addr, pending: make(map[uint64]chan tcpReply)}
+	return e
+}
+
+func (c *tcpClient) call(ctx context.Context, svcMeth string, args []byte) (replyMsg, error) {
+	if err := c.connect(ctx); err != nil {
+		return replyMsg{}, err
+	}
+
+	c.mu.Lock()
+	if c.conn == nil {
+		// failed since we connected
+		c.mu.Unlock()
+		return replyMsg{}, ErrServerDead
+	}
+
+	c.seq++
+	seq := c.seq
+	ch := make(chan tcpReply, 1)
+	c.pending[seq] = ch
+
+	conn := c.conn
+	conn.SetWriteDeadline(time.Now().Add(tcpCallTimeout))
+	if err := c.enc.Encode(tcpRequest{seq, svcMeth, args}); err != nil {
+		c.fail(conn)
+		c.mu.Unlock()
+		return replyMsg{}, ErrServerDead
+	}
+	c.mu.Unlock()
+
+	timer := time.NewTimer(tcpCallTimeout)
+	defer timer.Stop()
+
+	select {
+	case rep := <-ch:
+		return replyMsg{rep.Ok, rep.Reply}, nil
+	case <-timer.C:
+		c.forget(seq)
+		return replyMsg{}, ErrTimeout
+	case <-ctx.Done():
+		c.forget(seq)
+		return replyMsg{}, contextError(ctx)
+	}
+}
+
+func (c *tcpClient) forget(seq uint64) {
+	c.mu.Lock()
+	delete(c.pending, seq)
+	c.mu.Unlock()
+}
+
+// dial the server, unless already connected. the dial doesn't
+// hold c.mu, so that the replies to calls on a live connection
+// don't wait for it.
+func (c *tcpClient) connect(ctx context.Context) error {
+	c.mu.Lock()
+	connected := c.conn != nil
+	c.mu.Unlock()
+	if connected {
+		return nil
+	}
+
+	conn, err := c.dial(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return contextError(ctx)
+		}
+		return ErrServerDead
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn != nil {
+		// another call dialed first
+		conn.Close()
+		return nil
+	}
+	c.conn = conn
+	c.enc = labgob.NewEncoder(conn)
+	go c.readReplies(conn)
+	return nil
+}
+
+func (c *tcpClient) dial(ctx context.Context) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: tcpDialTimeout}
+	if c.tls == nil {
+		return dialer.DialContext(ctx, "tcp", c.addr)
+	}
+	tlsDialer := &tls.Dialer{NetDialer: dialer, Config: c.tls}
+	return tlsDialer.DialContext(ctx, "tcp", c.addr)
+}
+
+// hand every reply on conn to the call waiting for it.
+func (c *tcpClient) readReplies(conn net.Conn) {
+	dec := labgob.NewDecoder(conn)
+	for {
+		rep := tcpReply{}
+		if err := dec.Decode(&rep); err != nil {
+			c.mu.Lock()
+			c.fail(conn)
+			c.mu.Unlock()
+			return
+		}
+
+		c.mu.Lock()
+		if ch, ok := c.pending[rep.Seq]; ok {
+			ch <- rep
+			delete(c.pending, rep.Seq)
+		}
+		c.mu.Unlock()
+	}
+}
+
+// give up on conn, and on the calls waiting on it.
+// the caller holds c.mu.
+func (c *tcpClient) fail(conn net.Conn) {
+	conn.Close()
+	if c.conn != conn {
+		return
+	}
+
+	c.conn = nil
+	c.enc = nil
+	for seq, ch := range c.pending {
+		ch <- tcpReply{Seq: seq, Ok: false}
+		delete(c.pending, seq)
+	}
+}
+
+type TCPListener struct {
+	mu        sync.Mutex
+	rs        *Server
+	ln        net.Listener
+	tls       bool       // whether ln is a TLS listener
+	authorize Authorizer // who may call what, with TLS
+	conns     map[net.Conn]bool
+	closed    bool
+}
+
+// serve rs's services on a TCP address, e.g. "localhost:7000".
+func ListenTCP(rs *Server, addr string) (*TCPListener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	tl := makeListener(rs, ln)
+
+	go tl.serve()
+
+	return tl, nil
+}
+
+func makeListener(rs *Server, ln net.Listener) *TCPListener {
+	tl := &TCPListener{}
+	tl.rs = rs
+	tl.ln = ln
+	tl.conns = map[net.Conn]bool{}
+	return tl
+}
+
+func (tl *TCPListener) Addr() string {
+	return tl.ln.Addr().String()
+}
+
+func (tl *TCPListener) Close() {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+
+	tl.closed = true
+	tl.ln.Close()
+	for conn := range tl.conns {
+		conn.Close()
+	}
+}
+
+func (tl *TCPListener) serve() {
+	for {
+		conn, err := tl.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		tl.mu.Lock()
+		if tl.closed {
+			tl.mu.Unlock()
+			conn.Close()
+			return
+		}
+		tl.conns[conn] = true
+		tl.mu.Unlock()
+
+		go tl.serveConn(conn)
+	}
+}
+
+// execute every request on conn, each in its own thread, as a
+// Network would, and send the replies back as they are ready.
+func (tl *TCPListener) serveConn(conn net.Conn) {
+	var mu sync.Mutex // serializes writes
+	enc := labgob.NewEncoder(conn)
+	dec := labgob.NewDecoder(conn)
+	endname := conn.RemoteAddr().String()
+	var caller Caller // no one vouches for a plain TCP client
+
+	if tl.tls {
+		// known by the identity of its certificate instead
+		tconn := conn.(*tls.Conn)
+		tconn.SetDeadline(time.Now().Add(tcpDialTimeout))
+		if err := tconn.Handshake(); err != nil {
+			tl.drop(conn)
+			return
+		}
+		tconn.SetDeadline(time.Time{})
+		endname = peerIdentity(tconn.ConnectionState())
+		caller = endname
+	}
+
+	for {
+		req := tcpRequest{}
+		if err := dec.Decode(&req); err != nil {
+			break
+		}
+
+		go func(req tcpRequest) {
+			rep := tcpReply{req.Seq, false, nil}
+			if !tl.tls || tl.authorize == nil || tl.authorize(endname, req.SvcMeth) {
+				rep = tl.rs.dispatchTCP(endname, caller, req)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			conn.SetWriteDeadline(time.Now().Add(tcpCallTimeout))
+			if enc.Encode(rep) != nil {
+				conn.Close()
+			}
+		}(req)
+	}
+
+	tl.drop(conn)
+}
+
+func (tl *TCPListener) drop(conn net.Conn) {
+	conn.Close()
+	tl.mu.Lock()
+	delete(tl.conns, conn)
+	tl.mu.Unlock()
+}
+
+// like dispatch(), but a request for a service or method that
+// the server doesn't have fails, since a remote client may ask
+// for anything.
+func (rs *Server) dispatchTCP(endname string, caller Caller, req tcpRequest) tcpReply {
+	dot := strings.LastIndex(req.SvcMeth, ".")
+	if dot < 0 {
+		return tcpReply{req.Seq, false, nil}
+	}
+
+	rs.mu.Lock()
+	service, ok := rs.services[req.SvcMeth[:dot]]
+	rs.mu.Unlock()
+	if !ok {
+		return tcpReply{req.Seq, false, nil}
+	}
+	method, ok := service.methods[req.SvcMeth[dot+1:]]
+	if !ok {
+		return tcpReply{req.Seq, false, nil}
+	}
+
+	// the handler's own argument type, since a type can't
+	// be sent over the wire
+	msg := reqMsg{}
+	msg.endname = endname
+	msg.svcMeth = req.SvcMeth
+	msg.argsType = method.Type.In(argsIn(method.Type))
+	msg.args = req.Args
+	msg.caller = caller
+
+	rep := rs.dispatch(msg)
+	return tcpReply{req.Seq, rep.ok, rep.reply}
+}
@@ -1,11 +1,14 @@
 package labrpc
 
 import "testing"
+import "context"
+import "errors"
 import "strconv"
 import "sync"
 import "runtime"
 import "time"
 import "fmt"
+import "reflect"
 
 type JunkArgs struct {
 	X int
@@ -66,6 +69,10 @@ func (js *JunkServer) Handler7(args int, reply *string) {
 	}
 }
 
+func (js *JunkServer) Handler8(caller Caller, args int, reply *string) {
+	*reply = fmt.Sprintf("%v-%v", caller, args)
+}
+
 func TestBasic(t *testing.T) {
 	runtime.GOMAXPROCS(4)
 
@@ -595,3 +602,688 @@ func TestBenchmark(t *testing.T) {
 	fmt.Printf("%v for %v\n", time.Since(t0), n)
 	// march 2016, rtm laptop, 22 microseconds per RPC
 }
+
+func TestTCPBasic(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	js := &JunkServer{}
+	svc := MakeService(js)
+
+	rs := MakeServer()
+	rs.AddService(svc)
+
+	l, err := ListenTCP(rs, "localhost:0")
+	if err != nil {
+		t.Fatalf("ListenTCP: %v", err)
+	}
+	defer l.Close()
+
+	e := MakeTCPEnd(l.Addr())
+
+	{
+		reply := ""
+		e.Call("JunkServer.Handler2", 111, &reply)
+		if reply != "handler2-111" {
+			t.Fatalf("wrong reply from Handler2")
+		}
+	}
+
+	{
+		var reply JunkReply
+		e.Call("JunkServer.Handler4", &JunkArgs{4}, &reply)
+		if reply.X != "pointer" {
+			t.Fatalf("wrong reply from Handler4")
+		}
+	}
+
+	{
+		var reply JunkReply
+		e.Call("JunkServer.Handler5", JunkArgs{5}, &reply)
+		if reply.X != "no pointer" {
+			t.Fatalf("wrong reply from Handler5")
+		}
+	}
+
+	{
+		reply := 0
+		if e.Call("JunkServer.Handler99", 99, &reply) {
+			t.Fatalf("unknown method succeeded")
+		}
+		if e.Call("NoServer.Handler1", "99", &reply) {
+			t.Fatalf("unknown service succeeded")
+		}
+	}
+
+	{
+		// arguments that don't decode never reach the handler
+		reply := ""
+		if e.Call("JunkServer.Handler2", "junk", &reply) {
+			t.Fatalf("call with wrong argument type succeeded")
+		}
+		js.mu.Lock()
+		n := len(js.log2)
+		js.mu.Unlock()
+		if n != 1 {
+			t.Fatalf("Handler2 ran %v times, expected 1", n)
+		}
+	}
+
+	if rs.GetCount() != 4 {
+		t.Fatalf("wrong GetCount() %v, expected 4\n", rs.GetCount())
+	}
+}
+
+func TestTCPConcurrent(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	js := &JunkServer{}
+	svc := MakeService(js)
+
+	rs := MakeServer()
+	rs.AddService(svc)
+
+	l, err := ListenTCP(rs, "localhost:0")
+	if err != nil {
+		t.Fatalf("ListenTCP: %v", err)
+	}
+	defer l.Close()
+
+	e := MakeTCPEnd(l.Addr())
+
+	nrpcs := 100
+	ch := make(chan bool)
+	for i := 0; i < nrpcs; i++ {
+		go func(i int) {
+			reply := ""
+			ok := e.Call("JunkServer.Handler2", i, &reply)
+			ch <- ok && reply == "handler2-"+strconv.Itoa(i)
+		}(i)
+	}
+
+	for i := 0; i < nrpcs; i++ {
+		if !<-ch {
+			t.Fatalf("wrong reply from Handler2")
+		}
+	}
+}
+
+func TestTCPKilled(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	js := &JunkServer{}
+	svc := MakeService(js)
+
+	rs := MakeServer()
+	rs.AddService(svc)
+
+	l, err := ListenTCP(rs, "localhost:0")
+	if err != nil {
+		t.Fatalf("ListenTCP: %v", err)
+	}
+	addr := l.Addr()
+
+	e := MakeTCPEnd(addr)
+
+	doneCh := make(chan bool)
+	go func() {
+		reply := 0
+		ok := e.Call("JunkServer.Handler3", 99, &reply)
+		doneCh <- ok
+	}()
+
+	time.Sleep(1000 * time.Millisecond)
+
+	select {
+	case <-doneCh:
+		t.Fatalf("Handler3 should not have returned yet")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	l.Close()
+
+	select {
+	case x := <-doneCh:
+		if x != false {
+			t.Fatalf("Handler3 returned successfully despite Close()")
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Fatalf("Handler3 should return after Close()")
+	}
+
+	{
+		reply := ""
+		if e.Call("JunkServer.Handler2", 111, &reply) {
+			t.Fatalf("Handler2 succeeded after Close()")
+		}
+	}
+
+	// the end dials again once a server is back, with a new
+	// JunkServer since Handler3 still holds the old one's lock
+	rs = MakeServer()
+	rs.AddService(MakeService(&JunkServer{}))
+	l, err = ListenTCP(rs, addr)
+	if err != nil {
+		t.Fatalf("ListenTCP: %v", err)
+	}
+	defer l.Close()
+
+	{
+		reply := ""
+		e.Call("JunkServer.Handler2", 111, &reply)
+		if reply != "handler2-111" {
+			t.Fatalf("wrong reply from Handler2 after restart")
+		}
+	}
+}
+
+func TestTLS(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	ca, err := MakeCA("test-ca")
+	if err != nil {
+		t.Fatalf("MakeCA: %v", err)
+	}
+	serverConfig, _ := ca.Config("server-0")
+	clientConfig, _ := ca.Config("client-0")
+	otherConfig, _ := ca.Config("client-1")
+
+	js := &JunkServer{}
+	svc := MakeService(js)
+
+	rs := MakeServer()
+	rs.AddService(svc)
+
+	// only client-0 may call Handler1
+	authorize := func(identity string, svcMeth string) bool {
+		return svcMeth != "JunkServer.Handler1" || identity == "client-0"
+	}
+	l, err := ListenTLS(rs, "localhost:0", serverConfig, authorize)
+	if err != nil {
+		t.Fatalf("ListenTLS: %v", err)
+	}
+	defer l.Close()
+
+	e := MakeTLSEnd(l.Addr(), "server-0", clientConfig)
+	other := MakeTLSEnd(l.Addr(), "server-0", otherConfig)
+
+	{
+		reply := ""
+		e.Call("JunkServer.Handler2", 111, &reply)
+		if reply != "handler2-111" {
+			t.Fatalf("wrong reply from Handler2")
+		}
+	}
+
+	{
+		reply := 0
+		e.Call("JunkServer.Handler1", "9099", &reply)
+		if reply != 9099 {
+			t.Fatalf("wrong reply from Handler1")
+		}
+	}
+
+	{
+		reply := ""
+		other.Call("JunkServer.Handler2", 112, &reply)
+		if reply != "handler2-112" {
+			t.Fatalf("wrong reply from Handler2 to client-1")
+		}
+	}
+
+	{
+		reply := 0
+		if other.Call("JunkServer.Handler1", "9099", &reply) || reply != 0 {
+			t.Fatalf("client-1 called Handler1 without authorization")
+		}
+	}
+
+	if rs.GetCount() != 3 {
+		t.Fatalf("wrong GetCount() %v, expected 3\n", rs.GetCount())
+	}
+}
+
+func TestTLSIdentity(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	ca, err := MakeCA("test-ca")
+	if err != nil {
+		t.Fatalf("MakeCA: %v", err)
+	}
+	otherCA, err := MakeCA("other-ca")
+	if err != nil {
+		t.Fatalf("MakeCA: %v", err)
+	}
+	serverConfig, _ := ca.Config("server-0")
+	clientConfig, _ := ca.Config("client-0")
+	strangerConfig, _ := otherCA.Config("client-0")
+
+	js := &JunkServer{}
+	svc := MakeService(js)
+
+	rs := MakeServer()
+	rs.AddService(svc)
+
+	l, err := ListenTLS(rs, "localhost:0", serverConfig, nil)
+	if err != nil {
+		t.Fatalf("ListenTLS: %v", err)
+	}
+	defer l.Close()
+
+	// a server that isn't the one we expect
+	{
+		e := MakeTLSEnd(l.Addr(), "server-1", clientConfig)
+		reply := ""
+		if e.Call("JunkServer.Handler2", 111, &reply) {
+			t.Fatalf("call succeeded to a server with the wrong identity")
+		}
+	}
+
+	// a client with a certificate from another CA
+	{
+		e := MakeTLSEnd(l.Addr(), "server-0", strangerConfig)
+		reply := ""
+		if e.Call("JunkServer.Handler2", 111, &reply) {
+			t.Fatalf("call succeeded from a client of another CA")
+		}
+	}
+
+	// a client without TLS
+	{
+		e := MakeTCPEnd(l.Addr())
+		reply := ""
+		if e.Call("JunkServer.Handler2", 111, &reply) {
+			t.Fatalf("call succeeded without TLS")
+		}
+	}
+
+	if rs.GetCount() != 0 {
+		t.Fatalf("wrong GetCount() %v, expected 0\n", rs.GetCount())
+	}
+}
+
+func TestCaller(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+	defer rn.Cleanup()
+
+	js := &JunkServer{}
+	svc := MakeService(js)
+
+	rs := MakeServer()
+	rs.AddService(svc)
+	rn.AddServer("server99", rs)
+
+	// a Network's caller is the node that owns the end
+	{
+		e := rn.MakeEnd("end1-99")
+		rn.Connect("end1-99", "server99")
+		rn.Enable("end1-99", true)
+		rn.SetOwner("end1-99", "node1")
+
+		reply := ""
+		e.Call("JunkServer.Handler8", 111, &reply)
+		if reply != "node1-111" {
+			t.Fatalf("wrong reply %v from Handler8 on a Network", reply)
+		}
+	}
+
+	// and no one, for an end without an owner
+	{
+		e := rn.MakeEnd("end2-99")
+		rn.Connect("end2-99", "server99")
+		rn.Enable("end2-99", true)
+
+		reply := ""
+		e.Call("JunkServer.Handler8", 111, &reply)
+		if reply != "<nil>-111" {
+			t.Fatalf("wrong reply %v from Handler8 without an owner", reply)
+		}
+	}
+
+	// the identity in the certificate, over mutual TLS
+	{
+		ca, _ := MakeCA("test-ca")
+		serverConfig, _ := ca.Config("server-0")
+		clientConfig, _ := ca.Config("client-7")
+
+		l, err := ListenTLS(rs, "localhost:0", serverConfig, nil)
+		if err != nil {
+			t.Fatalf("ListenTLS: %v", err)
+		}
+		defer l.Close()
+
+		e := MakeTLSEnd(l.Addr(), "server-0", clientConfig)
+		reply := ""
+		e.Call("JunkServer.Handler8", 111, &reply)
+		if reply != "client-7-111" {
+			t.Fatalf("wrong reply %v from Handler8 over TLS", reply)
+		}
+	}
+
+	// no one vouches for a plain TCP client
+	{
+		l, err := ListenTCP(rs, "localhost:0")
+		if err != nil {
+			t.Fatalf("ListenTCP: %v", err)
+		}
+		defer l.Close()
+
+		e := MakeTCPEnd(l.Addr())
+		reply := ""
+		e.Call("JunkServer.Handler8", 111, &reply)
+		if reply != "<nil>-111" {
+			t.Fatalf("wrong reply %v from Handler8 over TCP", reply)
+		}
+	}
+}
+
+func TestCallContext(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+
+	e := rn.MakeEnd("end1-99")
+
+	js := &JunkServer{}
+	svc := MakeService(js)
+
+	rs := MakeServer()
+	rs.AddService(svc)
+	rn.AddServer("server99", rs)
+
+	rn.Connect("end1-99", "server99")
+	rn.Enable("end1-99", true)
+
+	{
+		reply := ""
+		if err := e.CallContext(context.Background(), "JunkServer.Handler2", 111, &reply); err != nil || reply != "handler2-111" {
+			t.Fatalf("wrong reply from Handler2: %v", err)
+		}
+	}
+
+	// a reply of the wrong type
+	{
+		reply := 0
+		err := e.CallContext(context.Background(), "JunkServer.Handler2", 111, &reply)
+		var de *DecodeError
+		if !errors.As(err, &de) || de.SvcMeth != "JunkServer.Handler2" {
+			t.Fatalf("expected a DecodeError, got %v", err)
+		}
+	}
+
+	// a server that's gone
+	{
+		rn.Enable("end1-99", false)
+		reply := ""
+		if err := e.CallContext(context.Background(), "JunkServer.Handler2", 111, &reply); err != ErrServerDead {
+			t.Fatalf("expected ErrServerDead, got %v", err)
+		}
+		rn.Enable("end1-99", true)
+	}
+
+	// Handler3 takes 20 seconds
+	{
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		t0 := time.Now()
+		reply := 0
+		if err := e.CallContext(ctx, "JunkServer.Handler3", 99, &reply); err != ErrTimeout {
+			t.Fatalf("expected ErrTimeout, got %v", err)
+		}
+		if time.Since(t0) > time.Second {
+			t.Fatalf("CallContext didn't give up at the deadline")
+		}
+	}
+
+	{
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			cancel()
+		}()
+		reply := 0
+		if err := e.CallContext(ctx, "JunkServer.Handler3", 99, &reply); err != ErrCanceled {
+			t.Fatalf("expected ErrCanceled, got %v", err)
+		}
+	}
+
+	{
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			rn.Cleanup()
+		}()
+		reply := 0
+		if err := e.CallContext(context.Background(), "JunkServer.Handler3", 99, &reply); err != ErrNetworkDestroyed {
+			t.Fatalf("expected ErrNetworkDestroyed, got %v", err)
+		}
+		if err := e.CallContext(context.Background(), "JunkServer.Handler3", 99, &reply); err != ErrNetworkDestroyed {
+			t.Fatalf("expected ErrNetworkDestroyed, got %v", err)
+		}
+	}
+}
+
+func TestTCPCallContext(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	js := &JunkServer{}
+	svc := MakeService(js)
+
+	rs := MakeServer()
+	rs.AddService(svc)
+
+	l, err := ListenTCP(rs, "localhost:0")
+	if err != nil {
+		t.Fatalf("ListenTCP: %v", err)
+	}
+
+	e := MakeTCPEnd(l.Addr())
+
+	{
+		reply := 0
+		err := e.CallContext(context.Background(), "JunkServer.Handler2", 111, &reply)
+		var de *DecodeError
+		if !errors.As(err, &de) {
+			t.Fatalf("expected a DecodeError, got %v", err)
+		}
+	}
+
+	{
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		reply := 0
+		if err := e.CallContext(ctx, "JunkServer.Handler3", 99, &reply); err != ErrTimeout {
+			t.Fatalf("expected ErrTimeout, got %v", err)
+		}
+	}
+
+	l.Close()
+
+	{
+		reply := ""
+		if err := e.CallContext(context.Background(), "JunkServer.Handler2", 111, &reply); err != ErrServerDead {
+			t.Fatalf("expected ErrServerDead, got %v", err)
+		}
+	}
+}
+
+func TestPartition(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+	defer rn.Cleanup()
+
+	servers := []interface{}{"server0", "server1", "server2"}
+	for _, servername := range servers {
+		rs := MakeServer()
+		rs.AddService(MakeService(&JunkServer{}))
+		rn.AddServer(servername, rs)
+	}
+
+	// an end from each server, and from a client, to every server
+	nodes := append([]interface{}{"client"}, servers...)
+	ends := map[interface{}]map[interface{}]*ClientEnd{}
+	for _, from := range nodes {
+		ends[from] = map[interface{}]*ClientEnd{}
+		for _, to := range servers {
+			endname := fmt.Sprintf("%v-%v", from, to)
+			ends[from][to] = rn.MakeEnd(endname)
+			rn.Connect(endname, to)
+			rn.Enable(endname, true)
+			rn.SetOwner(endname, from)
+		}
+	}
+
+	check := func(from interface{}, to interface{}, expected bool) {
+		reply := ""
+		if ok := ends[from][to].Call("JunkServer.Handler2", 111, &reply); ok != expected {
+			t.Fatalf("call from %v to %v returned %v, expected %v", from, to, ok, expected)
+		}
+	}
+
+	// the client is in no group, and sees everyone
+	rn.Partition([]interface{}{"server0"}, []interface{}{"server1", "server2"})
+	check("server0", "server1", false)
+	check("server1", "server0", false)
+	check("server2", "server0", false)
+	check("server1", "server2", true)
+	check("server0", "server0", true)
+	check("client", "server0", true)
+	check("client", "server2", true)
+
+	// a new partition replaces the old one
+	rn.Partition([]interface{}{"client", "server0", "server1"}, []interface{}{"server2"})
+	check("server0", "server1", true)
+	check("client", "server2", false)
+	check("server2", "server1", false)
+
+	rn.Heal()
+	rn.Cut("client", "server1")
+	check("client", "server1", false)
+	check("client", "server0", true)
+	check("server1", "server0", true)
+	check("server0", "server1", true)
+
+	rn.Heal()
+	for _, from := range nodes {
+		for _, to := range servers {
+			check(from, to, true)
+		}
+	}
+}
+
+func TestSeededNetwork(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	// which of n calls on each of two ends, over an unreliable
+	// network with seed, succeed. the ends call at the same time, so
+	// their requests interleave differently on every run.
+	run := func(seed int64, n int) []bool {
+		rn := MakeSeededNetwork(seed)
+		defer rn.Cleanup()
+
+		rs := MakeServer()
+		rs.AddService(MakeService(&JunkServer{}))
+		rn.AddServer("server99", rs)
+		rn.Reliable(false)
+
+		oks := make([]bool, 2*n)
+		var wg sync.WaitGroup
+		for j := 0; j < 2; j++ {
+			endname := fmt.Sprintf("end%v-99", j+1)
+			e := rn.MakeEnd(endname)
+			rn.Connect(endname, "server99")
+			rn.Enable(endname, true)
+
+			wg.Add(1)
+			go func(j int) {
+				defer wg.Done()
+				for i := 0; i < n; i++ {
+					reply := ""
+					oks[j*n+i] = e.Call("JunkServer.Handler2", i, &reply)
+				}
+			}(j)
+		}
+		wg.Wait()
+		return oks
+	}
+
+	seed := MakeNetwork().Seed()
+	fmt.Printf("seed %v\n", seed)
+
+	oks := run(seed, 100)
+	failed := 0
+	for _, ok := range oks {
+		if !ok {
+			failed++
+		}
+	}
+	if failed == 0 || failed > 100 {
+		t.Fatalf("%v of 200 calls failed on an unreliable network", failed)
+	}
+
+	if again := run(seed, 100); !reflect.DeepEqual(oks, again) {
+		t.Fatalf("same seed, different calls failed:\n%v\n%v", oks, again)
+	}
+}
+
+func TestVirtualClock(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+	defer rn.Cleanup()
+
+	clock := MakeVirtualClock()
+	rn.SetClock(clock)
+
+	e := rn.MakeEnd("end1-99")
+	rs := MakeServer()
+	rs.AddService(MakeService(&JunkServer{}))
+	rn.AddServer("server99", rs)
+	rn.Connect("end1-99", "server99")
+	rn.Enable("end1-99", true)
+
+	{
+		reply := ""
+		if !e.Call("JunkServer.Handler2", 111, &reply) || reply != "handler2-111" {
+			t.Fatalf("wrong reply from Handler2")
+		}
+	}
+
+	// the answered call leaves no timer behind
+	if n := clock.Pending(); n != 0 {
+		t.Fatalf("%v timers pending after the reply", n)
+	}
+
+	// a call on a disabled end fails within 100ms, by the clock
+	rn.Enable("end1-99", false)
+	doneCh := make(chan bool)
+	go func() {
+		reply := ""
+		doneCh <- e.Call("JunkServer.Handler2", 111, &reply)
+	}()
+
+	for clock.Pending() == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	select {
+	case <-doneCh:
+		t.Fatalf("call returned before the clock moved")
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	clock.Advance(100 * time.Millisecond)
+
+	select {
+	case ok := <-doneCh:
+		if ok {
+			t.Fatalf("call on a disabled end succeeded")
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Fatalf("call didn't return once the clock moved")
+	}
+	if clock.Now() != time.Unix(0, 0).Add(100*time.Millisecond) {
+		t.Fatalf("wrong time %v", clock.Now())
+	}
+}
@@ -0,0 +1,191 @@
+package labrpc
+
+//
+// mutual TLS for the TCP transport (see tcp.go).
+//
+// both sides present a certificate issued by a CA that the other
+// trusts, and are known by their identity, the first DNS name of
+// their certificate, e.g. "counter-2". a client end checks that
+// the server it reaches has the identity it expects, and a server
+// asks an Authorizer whether a client's identity may call a method.
+//
+// end := MakeTLSEnd("localhost:7000", "counter-0", config)
+// l, err := ListenTLS(srv, "localhost:7000", config, authorize)
+//
+// config holds this side's certificate, and the CA's in both
+// RootCAs and ClientCAs; see LoadTLSConfig(), or CA.Config() for
+// a CA made on the spot by MakeCA(), e.g. in tests.
+//
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"time"
+)
+
+// whether the client known as identity may call svcMeth.
+type Authorizer func(identity string, svcMeth string) bool
+
+// create a client end-point to the server at addr, which must
+// present a certificate for identity.
+func MakeTLSEnd(addr string, identity string, config *tls.Config) *ClientEnd {
+	e := MakeTCPEnd(addr)
+	e.tcp.tls = config.Clone()
+	e.tcp.tls.ServerName = identity
+	return e
+}
+
+// serve rs's services on a TCP address, to clients with a
+// certificate only, and only the methods that authorize allows
+// them, or any if authorize is nil.
+func ListenTLS(rs *Server, addr string, config *tls.Config, authorize Authorizer) (*TCPListener, error) {
+	config = config.Clone()
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+
+	ln, err := tls.Listen("tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+
+	tl := makeListener(rs, ln)
+	tl.tls = true
+	tl.authorize = authorize
+
+	go tl.serve()
+
+	return tl, nil
+}
+
+// the identity of the other side of a connection.
+func peerIdentity(state tls.ConnectionState) string {
+	if len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	cert := state.PeerCertificates[0]
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+	return cert.Subject.CommonName
+}
+
+// a TLS config from PEM files: the CA's certificate, and this
+// side's certificate and key.
+func LoadTLSConfig(caFile string, certFile string, keyFile string) (*tls.Config, error) {
+	caPEM, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, errors.New("labrpc: no certificate in " + caFile)
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return makeTLSConfig(cert, pool), nil
+}
+
+func makeTLSConfig(cert tls.Certificate, pool *x509.CertPool) *tls.Config {
+	config := &tls.Config{}
+	config.Certificates = []tls.Certificate{cert}
+	config.RootCAs = pool
+	config.ClientCAs = pool
+	config.MinVersion = tls.VersionTLS13
+	return config
+}
+
+//
+// a certificate authority, for tests and local deployments, that
+// issues certificates for identities.
+//
+type CA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func MakeCA(name string) (*CA, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	ca := &CA{}
+	ca.cert = cert
+	ca.key = key
+	ca.pool = x509.NewCertPool()
+	ca.pool.AddCert(cert)
+	return ca, nil
+}
+
+// the CA's certificate, PEM-encoded.
+func (ca *CA) CertPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+}
+
+// issue a certificate for identity, usable by both clients and
+// servers.
+func (ca *CA) Issue(identity string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 62))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: identity},
+		DNSNames:     []string{identity},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     ca.cert.NotAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// a TLS config with a new certificate for identity.
+func (ca *CA) Config(identity string) (*tls.Config, error) {
+	cert, err := ca.Issue(identity)
+	if err != nil {
+		return nil, err
+	}
+	return makeTLSConfig(cert, ca.pool), nil
+}
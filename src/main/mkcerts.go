@@ -0,0 +1,77 @@
+//go:build ignore
+// +build ignore
+
+package main
+
+//
+// make a CA, and a certificate from it for every counter and
+// voter, for running votecounter.go and voter.go over mutual TLS
+//
+// go run mkcerts.go -dir /tmp/ev-certs -counters 3 -voters 5
+//
+// writes the CA's certificate to dir/ca.pem, and each identity's
+// certificate and key to dir/<identity>.pem and dir/<identity>.key,
+// e.g. dir/counter-0.pem; the voters' ids are 0 to voters-1.
+//
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"6.824/election"
+	"6.824/labrpc"
+)
+
+func main() {
+	dir := flag.String("dir", ".", "directory for the certificates")
+	counters := flag.Int("counters", 0, "number of counters")
+	voters := flag.Int("voters", 0, "number of voters")
+	flag.Parse()
+
+	ca, err := labrpc.MakeCA("election-ca")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mkcerts: %v\n", err)
+		os.Exit(1)
+	}
+	if err := os.WriteFile(filepath.Join(*dir, "ca.pem"), ca.CertPEM(), 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "mkcerts: %v\n", err)
+		os.Exit(1)
+	}
+
+	var identities []string
+	for i := 0; i < *counters; i++ {
+		identities = append(identities, election.CounterIdentity(i))
+	}
+	for i := 0; i < *voters; i++ {
+		identities = append(identities, election.VoterIdentity(int64(i)))
+	}
+
+	for _, identity := range identities {
+		if err := issue(ca, *dir, identity); err != nil {
+			fmt.Fprintf(os.Stderr, "mkcerts: %v\n", err)
+			os.Exit(1)
+		}
+	}
+}
+
+func issue(ca *labrpc.CA, dir string, identity string) error {
+	cert, err := ca.Issue(identity)
+	if err != nil {
+		return err
+	}
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		return err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	if err := os.WriteFile(filepath.Join(dir, identity+".pem"), certPEM, 0644); err != nil {
+		return err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key})
+	return os.WriteFile(filepath.Join(dir, identity+".key"), keyPEM, 0600)
+}
@@ -1,10 +1,159 @@
 #!/usr/bin/env bash
 
 #
-# basic distributed-evoting test
+# basic distributed-evoting test: vote counters and voters, each
+# in its own process, talking over TCP on localhost
 #
 
 #RACE=
 
 # comment this to run the tests without the Go race detector.
 RACE=-race
+
+# run the test in a fresh sub-directory.
+rm -rf ev-tmp
+mkdir ev-tmp || exit 1
+cd ev-tmp || exit 1
+
+# make sure software is freshly built.
+(cd .. && go build $RACE -o ev-tmp/votecounter votecounter.go) || exit 1
+(cd .. && go build $RACE -o ev-tmp/voter voter.go) || exit 1
+(cd .. && go build $RACE -o ev-tmp/mkcerts mkcerts.go) || exit 1
+
+TIMEOUT=timeout
+if ! timeout 2s sleep 1 2> /dev/null
+then
+  TIMEOUT=
+else
+  TIMEOUT="timeout -k 2s 120s"
+fi
+
+failed_any=0
+
+# three counters on random ports, any two of which can count
+PORT=$(( (RANDOM % 20000) + 20000 ))
+ADDRS="localhost:$PORT,localhost:$((PORT+1)),localhost:$((PORT+2))"
+CANDIDATES=alice,bob
+VOTES="0 1 0 0 1"
+EXPECTED="winner alice tally [3 2] ballots 5 roll 5"
+CERTS=
+
+# start counter $1 of election $2, keeping its files in $3
+start_counter() {
+  $TIMEOUT ./votecounter -me $1 -addrs $ADDRS -dir $3 -election $2 \
+    -candidates $CANDIDATES -threshold 2 -voters 0,1,2,3,4 \
+    -registration 3s -voting 3s -exchange 2s $CERTS \
+    > $3/counter-$1.out 2> $3/counter-$1.err &
+  pids[$1]=$!
+}
+
+# start every voter of election $1, keeping their files in $2
+start_voters() {
+  i=0
+  for vote in $VOTES
+  do
+    $TIMEOUT ./voter -id $i -addrs $ADDRS -dir $2 -election $1 \
+      -candidates $CANDIDATES -threshold 2 $CERTS $vote \
+      > $2/voter-$i.out 2> $2/voter-$i.err &
+    i=$((i+1))
+  done
+}
+
+# check that every process in $1 announced the expected result
+check_results() {
+  ok=1
+  for f in $1/*.out
+  do
+    if [ "$(cat $f)" != "$EXPECTED" ]
+    then
+      echo "$f: got '$(cat $f)', expected '$EXPECTED'"
+      ok=0
+    fi
+  done
+  return $((1-ok))
+}
+
+#########################################################
+echo '***' Starting basic election test.
+
+mkdir basic
+for i in 0 1 2
+do
+  start_counter $i basic basic
+done
+start_voters basic basic
+
+wait
+
+if check_results basic
+then
+  echo '---' basic election test: PASS
+else
+  echo '---' basic election test: FAIL
+  failed_any=1
+fi
+
+#########################################################
+echo '***' Starting counter crash test.
+
+PORT=$((PORT+3))
+ADDRS="localhost:$PORT,localhost:$((PORT+1)),localhost:$((PORT+2))"
+
+mkdir crash
+for i in 0 1 2
+do
+  start_counter $i crash crash
+done
+start_voters crash crash
+
+# kill counter 2 while the voting is open, and restart it from
+# its persisted state
+sleep 4
+kill ${pids[2]}
+wait ${pids[2]} 2> /dev/null
+start_counter 2 crash crash
+
+wait
+
+if check_results crash
+then
+  echo '---' counter crash test: PASS
+else
+  echo '---' counter crash test: FAIL
+  failed_any=1
+fi
+
+#########################################################
+echo '***' Starting mutual TLS test.
+
+PORT=$((PORT+3))
+ADDRS="localhost:$PORT,localhost:$((PORT+1)),localhost:$((PORT+2))"
+
+mkdir -p tls/certs
+./mkcerts -dir tls/certs -counters 3 -voters 5 || exit 1
+CERTS="-certs tls/certs"
+
+for i in 0 1 2
+do
+  start_counter $i tls tls
+done
+start_voters tls tls
+
+wait
+
+if check_results tls
+then
+  echo '---' mutual TLS test: PASS
+else
+  echo '---' mutual TLS test: FAIL
+  failed_any=1
+fi
+
+#########################################################
+if [ $failed_any -eq 0 ]; then
+    echo '***' PASSED ALL TESTS
+    cd .. && rm -rf ev-tmp
+else
+    echo '***' FAILED SOME TESTS
+    exit 1
+fi
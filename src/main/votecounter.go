@@ -1,38 +1,196 @@
+//go:build ignore
+// +build ignore
+
 package main
 
 //
-// start a vote counting process, passing the number of
-// committee members (vote counters) for the election as an argument
+// start a vote counting process, one member of the committee
+// of vote counters, serving the other counters and the voters
+// over TCP. me is this counter's index in addrs.
+//
+// go run votecounter.go -me 0 -addrs localhost:7000,localhost:7001,localhost:7002 \
+//     -dir /tmp/ev -election e1 -candidates alice,bob -threshold 2 -voters 0,1,2
+//
+// only the voter ids in -voters may register for the election.
 //
-// go run votecounter.go 3
+// the counter keeps its key in dir/counter-<me>.key, and its
+// state in dir/counter-<me>.state, so that it picks up where it
+// left off if restarted; its public key goes to dir/counter-<me>.pub,
+// where the other counters and the voters look for it.
 //
+// with -certs, counters and voters talk over mutual TLS, with the
+// certificates that mkcerts.go made in that directory.
+//
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"6.824/election"
+	"6.824/labrpc"
+)
+
+func main() {
+	me := flag.Int("me", -1, "index of this counter in -addrs")
+	addrs := flag.String("addrs", "", "comma-separated addresses of every counter")
+	dir := flag.String("dir", ".", "directory for keys and state")
+	electionId := flag.String("election", "election", "election id")
+	candidates := flag.String("candidates", "", "comma-separated candidates")
+	threshold := flag.Int("threshold", 0, "counters needed to reconstruct the result")
+	registration := flag.Duration("registration", 5*time.Second, "how long registration stays open")
+	voting := flag.Duration("voting", 5*time.Second, "how long voting stays open")
+	exchange := flag.Duration("exchange", 2*time.Second, "how long to wait for the other counters")
+	linger := flag.Duration("linger", 5*time.Second, "how long to keep serving once the result is known")
+	certs := flag.String("certs", "", "directory of certificates, for mutual TLS")
+	voters := flag.String("voters", "", "comma-separated ids of the voters who may register")
+	flag.Parse()
+
+	members := strings.Split(*addrs, ",")
+	if *me < 0 || *me >= len(members) || *candidates == "" || *threshold < 1 {
+		fmt.Fprintf(os.Stderr, "Usage: votecounter -me i -addrs a0,a1,... -candidates c0,c1,... -threshold t\n")
+		os.Exit(1)
+	}
+
+	key, err := loadCounterKey(*dir, *me)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "votecounter: %v\n", err)
+		os.Exit(1)
+	}
+	counterKeys := waitCounterKeys(*dir, len(members))
+
+	var config *tls.Config
+	if *certs != "" {
+		identity := election.CounterIdentity(*me)
+		config, err = labrpc.LoadTLSConfig(filepath.Join(*certs, "ca.pem"),
+			filepath.Join(*certs, identity+".pem"), filepath.Join(*certs, identity+".key"))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "votecounter: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	ends := make([]election.Endpoint, len(members))
+	for i, addr := range members {
+		if config != nil {
+			ends[i] = labrpc.MakeTLSEnd(addr, election.CounterIdentity(i), config)
+		} else {
+			ends[i] = labrpc.MakeTCPEnd(addr)
+		}
+	}
 
-// import (
-// 	"fmt"
-// 	"os"
-// 	"strconv"
-// 	"time"
+	persister := election.MakeFilePersister(filepath.Join(*dir, fmt.Sprintf("counter-%d.state", *me)))
+	vc := election.MakeVoteCounter(ends, *me, key, counterKeys, persister)
 
-// 	"6.824/election"
-// 	"6.824/labrpc"
-// )
+	srv := labrpc.MakeServer()
+	srv.AddService(labrpc.MakeService(vc))
+	var l *labrpc.TCPListener
+	if config != nil {
+		l, err = labrpc.ListenTLS(srv, members[*me], config, election.CommitteeAuthorizer(len(members)))
+	} else {
+		l, err = labrpc.ListenTCP(srv, members[*me])
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "votecounter: %v\n", err)
+		os.Exit(1)
+	}
 
-// func main() {
-// 	if len(os.Args) < 2 {
-// 		fmt.Fprintf(os.Stderr, "Usage: votecounter args...\n")
-// 		os.Exit(1)
-// 	}
+	// a restarted counter already has its election
+	deadlines := election.Deadlines{Registration: *registration, Voting: *voting, Exchange: *exchange}
+	registry := election.MakeRegistry(*electionId)
+	if *voters != "" {
+		for _, v := range strings.Split(*voters, ",") {
+			id, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "votecounter: voter id %q: %v\n", v, err)
+				os.Exit(1)
+			}
+			registry.Allow(id)
+		}
+	}
+	vc.CreateElection(registry, strings.Split(*candidates, ","), *threshold, deadlines)
 
-// 	nVoters, err := strconv.Atoi(os.Args[1])
-// 	if err != nil {
-// 		fmt.Fprintf(os.Stderr, "Usage: votecounter arg must be an int...\n")
-// 		os.Exit(1)
-// 	}
+	for {
+		status, _ := vc.QueryElection(*electionId)
+		if status.Done {
+			printResult(status)
+			break
+		}
+		time.Sleep(time.Second)
+	}
 
-// 	vc := election.MakeVoteCounter(make([]*labrpc.ClientEnd, 1), 0, nVoters)
-// 	for vc.Done() == false {
-// 		time.Sleep(time.Second)
-// 	}
+	// let the voters and the other counters get the result
+	time.Sleep(*linger)
+	l.Close()
+	vc.Kill()
+}
 
-// 	time.Sleep(time.Second)
-// }
+func printResult(status election.ElectionStatus) {
+	result := status.Result
+	winner := "none"
+	if result.Winner != election.NoWinner {
+		winner = status.Candidates[result.Winner]
+	}
+	fmt.Printf("winner %v tally %v ballots %v roll %v\n", winner, result.Tally, result.Ballots, result.Roll)
+}
+
+//
+// load this counter's key, making one on the first run
+//
+func loadCounterKey(dir string, me int) (*ecdh.PrivateKey, error) {
+	path := filepath.Join(dir, fmt.Sprintf("counter-%d.key", me))
+	if data, err := os.ReadFile(path); err == nil {
+		return ecdh.X25519().NewPrivateKey(data)
+	}
+
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFile(path, key.Bytes(), 0600); err != nil {
+		return nil, err
+	}
+	pub := filepath.Join(dir, fmt.Sprintf("counter-%d.pub", me))
+	if err := writeFile(pub, key.PublicKey().Bytes(), 0644); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+//
+// wait until every counter has published its public key
+//
+func waitCounterKeys(dir string, n int) []*ecdh.PublicKey {
+	keys := make([]*ecdh.PublicKey, n)
+	for i := 0; i < n; {
+		data, err := os.ReadFile(filepath.Join(dir, fmt.Sprintf("counter-%d.pub", i)))
+		if err != nil {
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		if keys[i], err = ecdh.X25519().NewPublicKey(data); err != nil {
+			fmt.Fprintf(os.Stderr, "votecounter: counter %v's key: %v\n", i, err)
+			os.Exit(1)
+		}
+		i++
+	}
+	return keys
+}
+
+//
+// write a file whole, so that no other process reads half of it
+//
+func writeFile(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -1,37 +1,161 @@
+//go:build ignore
+// +build ignore
+
 package main
 
 //
-// start the a voter, passing your vote as an argument
+// start a voter, passing your vote (the index of a candidate)
+// as an argument. the voter registers with the committee of
+// vote counters at addrs, votes once the registration has
+// closed, and prints the result.
+//
+// go run voter.go -id 1 -addrs localhost:7000,localhost:7001,localhost:7002 \
+//     -dir /tmp/ev -election e1 -candidates alice,bob -threshold 2 0
 //
-// go run voter.go 1
+// the voter keeps its key in dir/voter-<id>.key and its state
+// in dir/voter-<id>.state, so that a restarted voter sends the
+// same ballot again; it reads the counters' public keys from
+// dir/counter-<i>.pub.
 //
+// with -certs, the voter talks to the counters over mutual TLS,
+// with the certificates that mkcerts.go made in that directory.
+//
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"6.824/election"
+	"6.824/labrpc"
+)
+
+func main() {
+	id := flag.Int64("id", 0, "voter id")
+	addrs := flag.String("addrs", "", "comma-separated addresses of every counter")
+	dir := flag.String("dir", ".", "directory for keys and state")
+	electionId := flag.String("election", "election", "election id")
+	candidates := flag.String("candidates", "", "comma-separated candidates")
+	threshold := flag.Int("threshold", 0, "counters needed to reconstruct the result")
+	certs := flag.String("certs", "", "directory of certificates, for mutual TLS")
+	flag.Parse()
+
+	if flag.NArg() < 1 || *addrs == "" || *candidates == "" || *threshold < 1 {
+		fmt.Fprintf(os.Stderr, "Usage: voter -id i -addrs a0,a1,... -candidates c0,c1,... -threshold t vote\n")
+		os.Exit(1)
+	}
+
+	vote, err := strconv.Atoi(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Usage: voter vote must be an int...\n")
+		os.Exit(1)
+	}
 
-// import (
-// 	"fmt"
-// 	"os"
-// 	"strconv"
-// 	"time"
+	credential, err := loadCredential(*dir, *electionId, *id)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "voter: %v\n", err)
+		os.Exit(1)
+	}
 
-// 	"6.824/election"
-// 	"6.824/labrpc"
-// )
+	var config *tls.Config
+	if *certs != "" {
+		identity := election.VoterIdentity(*id)
+		config, err = labrpc.LoadTLSConfig(filepath.Join(*certs, "ca.pem"),
+			filepath.Join(*certs, identity+".pem"), filepath.Join(*certs, identity+".key"))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "voter: %v\n", err)
+			os.Exit(1)
+		}
+	}
 
-// func main() {
-// 	if len(os.Args) < 2 {
-// 		fmt.Fprintf(os.Stderr, "Usage: voter args...\n")
-// 		os.Exit(1)
-// 	}
+	members := strings.Split(*addrs, ",")
+	counterKeys := waitCounterKeys(*dir, len(members))
+	ends := make([]election.Endpoint, len(members))
+	for i, addr := range members {
+		if config != nil {
+			ends[i] = labrpc.MakeTLSEnd(addr, election.CounterIdentity(i), config)
+		} else {
+			ends[i] = labrpc.MakeTCPEnd(addr)
+		}
+	}
 
-// 	vote, err := strconv.Atoi(os.Args[1])
-// 	if err != nil {
-// 		fmt.Fprintf(os.Stderr, "Usage: voter arg must be an int...\n")
-// 		os.Exit(1)
-// 	}
+	persister := election.MakeFilePersister(filepath.Join(*dir, fmt.Sprintf("voter-%d.state", *id)))
+	vt := election.MakeVoter(ends, counterKeys, credential, strings.Split(*candidates, ","), vote, *threshold, persister)
 
-// 	vt := election.MakeVoter(make([]*labrpc.ClientEnd, 1), vote, 3, 7)
-// 	for vt.Done() == false {
-// 		time.Sleep(time.Second)
-// 	}
+	vt.Register()
+	for {
+		if done, _ := vt.Registered(); done {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if _, n := vt.Registered(); n < *threshold {
+		fmt.Fprintf(os.Stderr, "voter: only %v counters took our registration\n", n)
+		os.Exit(1)
+	}
 
-// 	time.Sleep(time.Second)
-// }
+	if err := vt.Vote(); err != election.OK {
+		fmt.Fprintf(os.Stderr, "voter: vote %v: %v\n", vote, err)
+		os.Exit(1)
+	}
+	for {
+		if ok, result := vt.Result(); ok {
+			winner := "none"
+			if result.Winner != election.NoWinner {
+				winner = strings.Split(*candidates, ",")[result.Winner]
+			}
+			fmt.Printf("winner %v tally %v ballots %v roll %v\n", winner, result.Tally, result.Ballots, result.Roll)
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	vt.Kill()
+}
+
+//
+// load this voter's credential, making one on the first run
+//
+func loadCredential(dir string, electionId string, id int64) (election.Credential, error) {
+	path := filepath.Join(dir, fmt.Sprintf("voter-%d.key", id))
+	if data, err := os.ReadFile(path); err == nil && len(data) == ed25519.PrivateKeySize {
+		return election.Credential{ElectionId: electionId, VoterId: id, Key: ed25519.PrivateKey(data)}, nil
+	}
+
+	credential, err := election.MakeCredential(electionId, id)
+	if err != nil {
+		return credential, err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, credential.Key, 0600); err != nil {
+		return credential, err
+	}
+	return credential, os.Rename(tmp, path)
+}
+
+//
+// wait until every counter has published its public key
+//
+func waitCounterKeys(dir string, n int) []*ecdh.PublicKey {
+	keys := make([]*ecdh.PublicKey, n)
+	for i := 0; i < n; {
+		data, err := os.ReadFile(filepath.Join(dir, fmt.Sprintf("counter-%d.pub", i)))
+		if err != nil {
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		if keys[i], err = ecdh.X25519().NewPublicKey(data); err != nil {
+			fmt.Fprintf(os.Stderr, "voter: counter %v's key: %v\n", i, err)
+			os.Exit(1)
+		}
+		i++
+	}
+	return keys
+}
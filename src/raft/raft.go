@@ -0,0 +1,687 @@
+package raft
+
+//
+// A compact Raft, over labrpc, for replicating a state machine
+// within a small group of peers. Leader election, log replication,
+// persistence, and log compaction by snapshots.
+//
+// rf = Make(...)
+//   create a new Raft server.
+// rf.Start(command interface{}) (index, term, isleader)
+//   start agreement on a new log entry
+// rf.GetState() (term, isLeader)
+//   ask a Raft for its current term, and whether it thinks it is leader
+// rf.Snapshot(index int, snapshot []byte)
+//   the service's state up to index is in snapshot, so the log
+//   before it can go
+// ApplyMsg
+//   each time a new entry is committed to the log, each Raft peer
+//   sends an ApplyMsg to the service (or tester) in the same server.
+//   A peer that restarts, or falls behind the leader's snapshot,
+//   sends the snapshot instead, with SnapshotValid set.
+//
+// Commands go through labgob, so their concrete types must be
+// registered with labgob.Register.
+//
+
+import (
+	"bytes"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"6.824/labgob"
+	"6.824/labrpc"
+)
+
+const heartbeatTimeout int32 = 100
+const electionTimeoutMin int32 = 300
+const electionTimeoutMax int32 = 600
+
+//
+// as each Raft peer becomes aware that successive log entries are
+// committed, the peer should send an ApplyMsg to the service (or
+// tester) on the same server, via the applyCh passed to Make().
+//
+type ApplyMsg struct {
+	CommandValid bool
+	Command      interface{}
+	CommandIndex int
+
+	SnapshotValid bool
+	Snapshot      []byte
+	SnapshotTerm  int
+	SnapshotIndex int
+}
+
+type LogEntry struct {
+	Term    int
+	Command interface{}
+}
+
+type State int
+
+const (
+	Follower State = iota
+	Candidate
+	Leader
+)
+
+type Raft struct {
+	mu        sync.Mutex
+	peers     []*labrpc.ClientEnd
+	persister *Persister
+	me        int   // this peer's index into peers[]
+	dead      int32 // set by Kill()
+
+	applyCh   chan ApplyMsg
+	applyCond *sync.Cond
+
+	// persistent state
+	currentTerm   int
+	votedFor      int
+	log           []LogEntry // log[0] stands for the snapshot, so log[i] is entry snapshotIndex+i
+	snapshotIndex int        // the last entry in the snapshot, 0 for none
+
+	// volatile state
+	state       State
+	commitIndex int
+	lastApplied int
+	nextIndex   []int
+	matchIndex  []int
+
+	electionDeadline time.Time
+}
+
+//
+// return currentTerm and whether this server
+// believes it is the leader.
+//
+func (rf *Raft) GetState() (int, bool) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	return rf.currentTerm, rf.state == Leader
+}
+
+//
+// save Raft's persistent state to stable storage,
+// where it can later be retrieved after a crash and restart.
+//
+func (rf *Raft) persist() {
+	rf.persister.SaveRaftState(rf.encodeState())
+}
+
+func (rf *Raft) encodeState() []byte {
+	w := new(bytes.Buffer)
+	e := labgob.NewEncoder(w)
+	e.Encode(rf.currentTerm)
+	e.Encode(rf.votedFor)
+	e.Encode(rf.log)
+	e.Encode(rf.snapshotIndex)
+	return w.Bytes()
+}
+
+//
+// restore previously persisted state.
+//
+func (rf *Raft) readPersist(data []byte) {
+	if data == nil || len(data) < 1 { // bootstrap without any state?
+		return
+	}
+
+	r := bytes.NewBuffer(data)
+	d := labgob.NewDecoder(r)
+	var currentTerm int
+	var votedFor int
+	var log []LogEntry
+	var snapshotIndex int
+	if d.Decode(&currentTerm) != nil || d.Decode(&votedFor) != nil ||
+		d.Decode(&log) != nil || d.Decode(&snapshotIndex) != nil {
+		panic("Error decoding persist data")
+	}
+
+	rf.currentTerm = currentTerm
+	rf.votedFor = votedFor
+	rf.log = log
+	rf.snapshotIndex = snapshotIndex
+}
+
+func (rf *Raft) lastLogIndex() int {
+	return rf.snapshotIndex + len(rf.log) - 1
+}
+
+func (rf *Raft) lastLogTerm() int {
+	return rf.log[len(rf.log)-1].Term
+}
+
+// the term of entry index, which must be in the log or the last
+// one in the snapshot
+func (rf *Raft) term(index int) int {
+	return rf.log[index-rf.snapshotIndex].Term
+}
+
+func (rf *Raft) resetElectionTimer() {
+	spread := electionTimeoutMax - electionTimeoutMin
+	timeout := electionTimeoutMin + rand.Int31n(spread)
+	rf.electionDeadline = time.Now().Add(time.Duration(timeout) * time.Millisecond)
+}
+
+//
+// Step down to follower of a newer term
+//
+func (rf *Raft) becomeFollower(term int) {
+	rf.state = Follower
+	rf.currentTerm = term
+	rf.votedFor = -1
+	rf.persist()
+}
+
+type RequestVoteArgs struct {
+	Term         int
+	CandidateId  int
+	LastLogIndex int
+	LastLogTerm  int
+}
+
+type RequestVoteReply struct {
+	Term        int
+	VoteGranted bool
+}
+
+func (rf *Raft) RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if args.Term > rf.currentTerm {
+		rf.becomeFollower(args.Term)
+	}
+
+	reply.Term = rf.currentTerm
+	reply.VoteGranted = false
+	if args.Term < rf.currentTerm {
+		return
+	}
+
+	upToDate := args.LastLogTerm > rf.lastLogTerm() ||
+		(args.LastLogTerm == rf.lastLogTerm() && args.LastLogIndex >= rf.lastLogIndex())
+	if (rf.votedFor == -1 || rf.votedFor == args.CandidateId) && upToDate {
+		rf.votedFor = args.CandidateId
+		rf.persist()
+		rf.resetElectionTimer()
+		reply.VoteGranted = true
+	}
+}
+
+type AppendEntriesArgs struct {
+	Term         int
+	LeaderId     int
+	PrevLogIndex int
+	PrevLogTerm  int
+	Entries      []LogEntry
+	LeaderCommit int
+}
+
+type AppendEntriesReply struct {
+	Term          int
+	Success       bool
+	ConflictIndex int // where the leader should back up to on failure
+}
+
+func (rf *Raft) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if args.Term > rf.currentTerm {
+		rf.becomeFollower(args.Term)
+	}
+
+	reply.Term = rf.currentTerm
+	reply.Success = false
+	if args.Term < rf.currentTerm {
+		return
+	}
+
+	rf.state = Follower
+	rf.resetElectionTimer()
+
+	if args.PrevLogIndex < rf.snapshotIndex {
+		// the entries up to our snapshot are committed already
+		skip := rf.snapshotIndex - args.PrevLogIndex
+		if skip > len(args.Entries) {
+			skip = len(args.Entries)
+		}
+		args.PrevLogIndex += skip
+		args.Entries = args.Entries[skip:]
+		if args.PrevLogIndex < rf.snapshotIndex {
+			reply.Success = true
+			return
+		}
+		args.PrevLogTerm = rf.term(args.PrevLogIndex)
+	}
+
+	if args.PrevLogIndex > rf.lastLogIndex() {
+		reply.ConflictIndex = rf.lastLogIndex() + 1
+		return
+	}
+	if rf.term(args.PrevLogIndex) != args.PrevLogTerm {
+		// skip back over the whole conflicting term
+		term := rf.term(args.PrevLogIndex)
+		index := args.PrevLogIndex
+		for index > rf.snapshotIndex+1 && rf.term(index-1) == term {
+			index--
+		}
+		reply.ConflictIndex = index
+		return
+	}
+
+	// only truncate on a real conflict, since the RPC may be stale
+	for i, entry := range args.Entries {
+		index := args.PrevLogIndex + 1 + i
+		if index > rf.lastLogIndex() || rf.term(index) != entry.Term {
+			rf.log = append(rf.log[:index-rf.snapshotIndex], args.Entries[i:]...)
+			rf.persist()
+			break
+		}
+	}
+
+	if args.LeaderCommit > rf.commitIndex {
+		last := args.PrevLogIndex + len(args.Entries)
+		rf.commitIndex = args.LeaderCommit
+		if last < rf.commitIndex {
+			rf.commitIndex = last
+		}
+		rf.applyCond.Broadcast()
+	}
+
+	reply.Success = true
+}
+
+type InstallSnapshotArgs struct {
+	Term              int
+	LeaderId          int
+	LastIncludedIndex int
+	LastIncludedTerm  int
+	Data              []byte
+}
+
+type InstallSnapshotReply struct {
+	Term int
+}
+
+//
+// Take the leader's snapshot, when it has compacted away the
+// entries we are missing
+//
+func (rf *Raft) InstallSnapshot(args *InstallSnapshotArgs, reply *InstallSnapshotReply) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if args.Term > rf.currentTerm {
+		rf.becomeFollower(args.Term)
+	}
+
+	reply.Term = rf.currentTerm
+	if args.Term < rf.currentTerm {
+		return
+	}
+
+	rf.state = Follower
+	rf.resetElectionTimer()
+
+	if args.LastIncludedIndex <= rf.commitIndex {
+		// we have it all already
+		return
+	}
+
+	// keep whatever follows the snapshot, if we have it right
+	if args.LastIncludedIndex < rf.lastLogIndex() && rf.term(args.LastIncludedIndex) == args.LastIncludedTerm {
+		rf.log = append([]LogEntry{{args.LastIncludedTerm, nil}}, rf.log[args.LastIncludedIndex-rf.snapshotIndex+1:]...)
+	} else {
+		rf.log = []LogEntry{{args.LastIncludedTerm, nil}}
+	}
+	rf.snapshotIndex = args.LastIncludedIndex
+	rf.commitIndex = args.LastIncludedIndex
+	rf.persister.SaveStateAndSnapshot(rf.encodeState(), args.Data)
+
+	// the applier hands the snapshot to the service
+	rf.applyCond.Broadcast()
+}
+
+//
+// the service has a snapshot of its state up to and including
+// index, so Raft no longer needs the log through that index.
+//
+func (rf *Raft) Snapshot(index int, snapshot []byte) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if index <= rf.snapshotIndex || index > rf.lastApplied {
+		return
+	}
+
+	rf.log = append([]LogEntry{{rf.term(index), nil}}, rf.log[index-rf.snapshotIndex+1:]...)
+	rf.snapshotIndex = index
+	rf.persister.SaveStateAndSnapshot(rf.encodeState(), snapshot)
+}
+
+//
+// Ask every other peer for its vote in a new term
+//
+func (rf *Raft) startElection() {
+	rf.state = Candidate
+	rf.currentTerm++
+	rf.votedFor = rf.me
+	rf.persist()
+	rf.resetElectionTimer()
+
+	args := RequestVoteArgs{rf.currentTerm, rf.me, rf.lastLogIndex(), rf.lastLogTerm()}
+	votes := 1
+	for i := range rf.peers {
+		if i == rf.me {
+			continue
+		}
+		go func(peer int) {
+			reply := RequestVoteReply{}
+			if !rf.peers[peer].Call("Raft.RequestVote", &args, &reply) {
+				return
+			}
+
+			rf.mu.Lock()
+			defer rf.mu.Unlock()
+
+			if reply.Term > rf.currentTerm {
+				rf.becomeFollower(reply.Term)
+				return
+			}
+			if rf.state != Candidate || rf.currentTerm != args.Term || !reply.VoteGranted {
+				return
+			}
+
+			votes++
+			if votes > len(rf.peers)/2 {
+				rf.becomeLeader()
+			}
+		}(i)
+	}
+}
+
+func (rf *Raft) becomeLeader() {
+	rf.state = Leader
+	for i := range rf.peers {
+		rf.nextIndex[i] = rf.lastLogIndex() + 1
+		rf.matchIndex[i] = 0
+	}
+	rf.matchIndex[rf.me] = rf.lastLogIndex()
+	rf.broadcastAppendEntries()
+}
+
+//
+// Send every follower the entries it is missing, or a heartbeat
+//
+func (rf *Raft) broadcastAppendEntries() {
+	for i := range rf.peers {
+		if i != rf.me {
+			go rf.sendAppendEntries(i)
+		}
+	}
+}
+
+func (rf *Raft) sendAppendEntries(peer int) {
+	rf.mu.Lock()
+	if rf.state != Leader {
+		rf.mu.Unlock()
+		return
+	}
+	if rf.nextIndex[peer] <= rf.snapshotIndex {
+		// the entries it needs are in our snapshot
+		rf.mu.Unlock()
+		rf.sendInstallSnapshot(peer)
+		return
+	}
+	prev := rf.nextIndex[peer] - 1
+	args := AppendEntriesArgs{
+		Term:         rf.currentTerm,
+		LeaderId:     rf.me,
+		PrevLogIndex: prev,
+		PrevLogTerm:  rf.term(prev),
+		Entries:      append([]LogEntry(nil), rf.log[prev-rf.snapshotIndex+1:]...),
+		LeaderCommit: rf.commitIndex,
+	}
+	rf.mu.Unlock()
+
+	reply := AppendEntriesReply{}
+	if !rf.peers[peer].Call("Raft.AppendEntries", &args, &reply) {
+		return
+	}
+
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if reply.Term > rf.currentTerm {
+		rf.becomeFollower(reply.Term)
+		return
+	}
+	if rf.state != Leader || rf.currentTerm != args.Term {
+		return
+	}
+
+	if reply.Success {
+		match := args.PrevLogIndex + len(args.Entries)
+		if match > rf.matchIndex[peer] {
+			rf.matchIndex[peer] = match
+			rf.nextIndex[peer] = match + 1
+			rf.advanceCommitIndex()
+		}
+	} else if reply.ConflictIndex >= 1 && reply.ConflictIndex < rf.nextIndex[peer] {
+		rf.nextIndex[peer] = reply.ConflictIndex
+		go rf.sendAppendEntries(peer)
+	}
+}
+
+func (rf *Raft) sendInstallSnapshot(peer int) {
+	rf.mu.Lock()
+	if rf.state != Leader {
+		rf.mu.Unlock()
+		return
+	}
+	args := InstallSnapshotArgs{
+		Term:              rf.currentTerm,
+		LeaderId:          rf.me,
+		LastIncludedIndex: rf.snapshotIndex,
+		LastIncludedTerm:  rf.log[0].Term,
+		Data:              rf.persister.ReadSnapshot(),
+	}
+	rf.mu.Unlock()
+
+	reply := InstallSnapshotReply{}
+	if !rf.peers[peer].Call("Raft.InstallSnapshot", &args, &reply) {
+		return
+	}
+
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if reply.Term > rf.currentTerm {
+		rf.becomeFollower(reply.Term)
+		return
+	}
+	if rf.state != Leader || rf.currentTerm != args.Term {
+		return
+	}
+
+	if args.LastIncludedIndex > rf.matchIndex[peer] {
+		rf.matchIndex[peer] = args.LastIncludedIndex
+		rf.nextIndex[peer] = args.LastIncludedIndex + 1
+		rf.advanceCommitIndex()
+	}
+}
+
+//
+// Commit the entries of our term that a majority holds, and with
+// them every entry before
+//
+func (rf *Raft) advanceCommitIndex() {
+	for n := rf.lastLogIndex(); n > rf.commitIndex && rf.term(n) == rf.currentTerm; n-- {
+		count := 0
+		for i := range rf.peers {
+			if rf.matchIndex[i] >= n {
+				count++
+			}
+		}
+		if count > len(rf.peers)/2 {
+			rf.commitIndex = n
+			rf.applyCond.Broadcast()
+			return
+		}
+	}
+}
+
+//
+// the service using Raft (e.g. a k/v server) wants to start
+// agreement on the next command to be appended to Raft's log. if this
+// server isn't the leader, returns false. otherwise start the
+// agreement and return immediately. there is no guarantee that this
+// command will ever be committed to the Raft log, since the leader
+// may fail or lose an election.
+//
+// the first return value is the index that the command will appear at
+// if it's ever committed. the second return value is the current
+// term. the third return value is true if this server believes it is
+// the leader.
+//
+func (rf *Raft) Start(command interface{}) (int, int, bool) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.state != Leader || rf.killed() {
+		return -1, rf.currentTerm, false
+	}
+
+	rf.log = append(rf.log, LogEntry{rf.currentTerm, command})
+	rf.persist()
+	rf.matchIndex[rf.me] = rf.lastLogIndex()
+	if len(rf.peers) == 1 {
+		rf.advanceCommitIndex()
+	}
+	rf.broadcastAppendEntries()
+
+	return rf.lastLogIndex(), rf.currentTerm, true
+}
+
+//
+// the tester doesn't halt goroutines created by Raft after each test,
+// but it does call the Kill() method. The use of atomic avoids the
+// need for a lock.
+//
+func (rf *Raft) Kill() {
+	atomic.StoreInt32(&rf.dead, 1)
+
+	rf.mu.Lock()
+	rf.applyCond.Broadcast()
+	rf.mu.Unlock()
+}
+
+func (rf *Raft) killed() bool {
+	z := atomic.LoadInt32(&rf.dead)
+	return z == 1
+}
+
+//
+// Start elections when the leader goes quiet, and send heartbeats
+// while we are the leader
+//
+func (rf *Raft) ticker() {
+	for !rf.killed() {
+		rf.mu.Lock()
+		if rf.state == Leader {
+			rf.broadcastAppendEntries()
+		} else if time.Now().After(rf.electionDeadline) {
+			if len(rf.peers) == 1 {
+				rf.currentTerm++
+				rf.votedFor = rf.me
+				rf.persist()
+				rf.becomeLeader()
+			} else {
+				rf.startElection()
+			}
+		}
+		leader := rf.state == Leader
+		rf.mu.Unlock()
+
+		if leader {
+			time.Sleep(time.Duration(heartbeatTimeout) * time.Millisecond)
+		} else {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+//
+// Hand the committed entries to the service, in order, starting
+// from our snapshot if the service hasn't got it
+//
+func (rf *Raft) applier() {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	for !rf.killed() {
+		var msg ApplyMsg
+		if rf.lastApplied < rf.snapshotIndex {
+			msg.SnapshotValid = true
+			msg.Snapshot = rf.persister.ReadSnapshot()
+			msg.SnapshotTerm = rf.log[0].Term
+			msg.SnapshotIndex = rf.snapshotIndex
+			rf.lastApplied = rf.snapshotIndex
+		} else if rf.lastApplied < rf.commitIndex {
+			rf.lastApplied++
+			msg.CommandValid = true
+			msg.Command = rf.log[rf.lastApplied-rf.snapshotIndex].Command
+			msg.CommandIndex = rf.lastApplied
+		} else {
+			rf.applyCond.Wait()
+			continue
+		}
+
+		rf.mu.Unlock()
+		rf.applyCh <- msg
+		rf.mu.Lock()
+	}
+}
+
+//
+// the service or tester wants to create a Raft server. the ports
+// of all the Raft servers (including this one) are in peers[]. this
+// server's port is peers[me]. all the servers' peers[] arrays
+// have the same order. persister is a place for this server to
+// save its persistent state, and also initially holds the most
+// recent saved state, if any. applyCh is a channel on which the
+// tester or service expects Raft to send ApplyMsg messages.
+// Make() must return quickly, so it should start goroutines
+// for any long-running work.
+//
+func Make(peers []*labrpc.ClientEnd, me int, persister *Persister, applyCh chan ApplyMsg) *Raft {
+	rf := &Raft{}
+	rf.peers = peers
+	rf.persister = persister
+	rf.me = me
+
+	rf.applyCh = applyCh
+	rf.applyCond = sync.NewCond(&rf.mu)
+
+	rf.votedFor = -1
+	rf.log = []LogEntry{{0, nil}}
+	rf.nextIndex = make([]int, len(peers))
+	rf.matchIndex = make([]int, len(peers))
+
+	// initialize from state persisted before a crash
+	rf.readPersist(persister.ReadRaftState())
+	rf.commitIndex = rf.snapshotIndex
+	rf.resetElectionTimer()
+
+	go rf.ticker()
+	go rf.applier()
+
+	return rf
+}
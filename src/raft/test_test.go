@@ -0,0 +1,248 @@
+package raft
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestInitialElection(t *testing.T) {
+	servers := 3
+	cfg := makeConfig(t, servers, false, false)
+	defer cfg.cleanup()
+
+	fmt.Println("Test: initial election ...")
+
+	leader1 := cfg.checkOneLeader()
+
+	// does the leader keep its term when there's no failure?
+	term1, _ := cfg.rafts[leader1].GetState()
+	time.Sleep(2 * time.Duration(electionTimeoutMax) * time.Millisecond)
+	term2, _ := cfg.rafts[leader1].GetState()
+	if term1 != term2 {
+		fmt.Printf("warning: term changed even though there were no failures")
+	}
+
+	cfg.checkOneLeader()
+
+	fmt.Println("  ... Passed")
+}
+
+func TestReElection(t *testing.T) {
+	servers := 3
+	cfg := makeConfig(t, servers, false, false)
+	defer cfg.cleanup()
+
+	fmt.Println("Test: election after network failure ...")
+
+	leader1 := cfg.checkOneLeader()
+
+	// if the leader disconnects, a new one should be elected.
+	cfg.disconnect(leader1)
+	leader2 := cfg.checkOneLeader()
+	if leader2 == leader1 {
+		t.Fatalf("expecting a new leader once %v is gone", leader1)
+	}
+
+	// if the old leader rejoins, that shouldn't
+	// disturb the new leader.
+	cfg.connect(leader1)
+	cfg.checkOneLeader()
+
+	fmt.Println("  ... Passed")
+}
+
+func TestBasicAgree(t *testing.T) {
+	servers := 3
+	cfg := makeConfig(t, servers, false, false)
+	defer cfg.cleanup()
+
+	fmt.Println("Test: basic agreement ...")
+
+	for index := 1; index < 4; index++ {
+		nd, _ := cfg.nCommitted(index)
+		if nd > 0 {
+			t.Fatalf("some have committed before Start()")
+		}
+
+		xindex := cfg.one(index*100, servers)
+		if xindex != index {
+			t.Fatalf("got index %v but expected %v", xindex, index)
+		}
+	}
+
+	fmt.Println("  ... Passed")
+}
+
+func TestFailAgree(t *testing.T) {
+	servers := 3
+	cfg := makeConfig(t, servers, false, false)
+	defer cfg.cleanup()
+
+	fmt.Println("Test: agreement despite follower disconnection ...")
+
+	cfg.one(101, servers)
+
+	// disconnect one follower from the network.
+	leader := cfg.checkOneLeader()
+	cfg.disconnect((leader + 1) % servers)
+
+	// the leader and remaining follower should be
+	// able to agree despite the disconnected follower.
+	cfg.one(102, servers-1)
+	cfg.one(103, servers-1)
+
+	// re-connect
+	cfg.connect((leader + 1) % servers)
+
+	// the full set of servers should preserve
+	// previous agreements, and be able to agree
+	// on new commands.
+	cfg.one(104, servers)
+	cfg.one(105, servers)
+
+	fmt.Println("  ... Passed")
+}
+
+func TestFailNoAgree(t *testing.T) {
+	servers := 5
+	cfg := makeConfig(t, servers, false, false)
+	defer cfg.cleanup()
+
+	fmt.Println("Test: no agreement if too many followers disconnect ...")
+
+	cfg.one(10, servers)
+
+	// 3 of 5 followers disconnect
+	leader := cfg.checkOneLeader()
+	cfg.disconnect((leader + 1) % servers)
+	cfg.disconnect((leader + 2) % servers)
+	cfg.disconnect((leader + 3) % servers)
+
+	index, _, ok := cfg.rafts[leader].Start(20)
+	if ok != true {
+		t.Fatalf("leader rejected Start()")
+	}
+	if index != 2 {
+		t.Fatalf("expected index 2, got %v", index)
+	}
+
+	time.Sleep(2 * time.Duration(electionTimeoutMax) * time.Millisecond)
+
+	n, _ := cfg.nCommitted(index)
+	if n > 0 {
+		t.Fatalf("%v committed but no majority", n)
+	}
+
+	// repair
+	cfg.connect((leader + 1) % servers)
+	cfg.connect((leader + 2) % servers)
+	cfg.connect((leader + 3) % servers)
+
+	// the disconnected majority may have chosen a leader from
+	// among their own ranks, forgetting index 2.
+	cfg.checkOneLeader()
+	cfg.one(30, servers)
+
+	fmt.Println("  ... Passed")
+}
+
+func TestPersist(t *testing.T) {
+	servers := 3
+	cfg := makeConfig(t, servers, false, false)
+	defer cfg.cleanup()
+
+	fmt.Println("Test: basic persistence ...")
+
+	cfg.one(11, servers)
+
+	// crash and re-start all
+	for i := 0; i < servers; i++ {
+		cfg.start1(i)
+	}
+	for i := 0; i < servers; i++ {
+		cfg.disconnect(i)
+		cfg.connect(i)
+	}
+
+	cfg.one(12, servers)
+
+	leader1 := cfg.checkOneLeader()
+	cfg.disconnect(leader1)
+	cfg.start1(leader1)
+	cfg.connect(leader1)
+
+	cfg.one(13, servers)
+
+	leader2 := cfg.checkOneLeader()
+	cfg.disconnect(leader2)
+	cfg.one(14, servers-1)
+	cfg.start1(leader2)
+	cfg.connect(leader2)
+
+	cfg.one(15, servers)
+
+	fmt.Println("  ... Passed")
+}
+
+func TestUnreliableAgree(t *testing.T) {
+	servers := 5
+	cfg := makeConfig(t, servers, true, false)
+	defer cfg.cleanup()
+
+	fmt.Println("Test: unreliable agreement ...")
+
+	for iters := 1; iters < 30; iters++ {
+		cfg.one(iters, 1)
+	}
+
+	cfg.setunreliable(false)
+	cfg.one(100, servers)
+
+	fmt.Println("  ... Passed")
+}
+
+func TestSnapshot(t *testing.T) {
+	servers := 3
+	cfg := makeConfig(t, servers, false, true)
+	defer cfg.cleanup()
+
+	fmt.Println("Test: snapshots ...")
+
+	for index := 1; index < 30; index++ {
+		cfg.one(index, servers)
+	}
+
+	// the follower falls behind the leader's snapshot, and has to
+	// be sent it
+	leader := cfg.checkOneLeader()
+	follower := (leader + 1) % servers
+	cfg.disconnect(follower)
+	for index := 30; index < 60; index++ {
+		cfg.one(index, servers-1)
+	}
+	cfg.connect(follower)
+	cfg.one(60, servers)
+
+	// the logs don't keep what is in the snapshots
+	for i := 0; i < servers; i++ {
+		if size := cfg.saved[i].RaftStateSize(); size > 1000 {
+			t.Fatalf("server %v's log takes %v bytes, expected it to be compacted", i, size)
+		}
+		if cfg.saved[i].SnapshotSize() == 0 {
+			t.Fatalf("server %v has no snapshot", i)
+		}
+	}
+
+	// crash and re-start all, from the snapshots
+	for i := 0; i < servers; i++ {
+		cfg.start1(i)
+	}
+	for i := 0; i < servers; i++ {
+		cfg.disconnect(i)
+		cfg.connect(i)
+	}
+	cfg.one(61, servers)
+
+	fmt.Println("  ... Passed")
+}
@@ -0,0 +1,431 @@
+package shamir
+
+//
+// Shamir secret sharing over a prime field Z_p, for any size of p.
+//
+// f := shamir.NewField(p) -- the field Z_p, p must be prime
+// poly, _ := f.RandomPolynomial(secret, threshold, rand.Reader)
+// shares, _ := f.Split(secret, threshold, n, rand.Reader)
+//   -- n < p shares (x, f(x)) at x = 1..n, any threshold of which
+//      give back the secret
+// secret, _ := f.Combine(shares) -- Lagrange interpolation at 0
+// l, _ := f.LagrangeAt(xs, x) -- f(x) = sum_i l[i] f(xs[i])
+// secret, bad, _ := f.RobustCombine(shares, threshold)
+//   -- Berlekamp-Welch decoding, tolerating wrong shares
+// sum, _ := f.AddShares(a, b, ...) -- shares of a + b + ... at x
+// prod := f.ScalarMul(k, share) -- share of k * secret at x
+// sum := f.Add(a, b) -- a + b in the field
+//
+
+import (
+	crand "crypto/rand"
+	"errors"
+	"io"
+	"math/big"
+	"sort"
+)
+
+var ErrNotPrime = errors.New("shamir: field modulus is not prime")
+var ErrThreshold = errors.New("shamir: threshold must be between 1 and the number of shares")
+var ErrTooFewShares = errors.New("shamir: fewer shares than the threshold")
+var ErrDuplicateShare = errors.New("shamir: two shares with the same x (mod p)")
+var ErrZeroShare = errors.New("shamir: a share at x = 0 (mod p), where the secret is")
+var ErrTooManyShares = errors.New("shamir: as many shares as the field has elements")
+var ErrMismatchedShares = errors.New("shamir: shares are not at the same x")
+var ErrUndecodable = errors.New("shamir: too many wrong shares to decode")
+
+type Field struct {
+	p *big.Int
+}
+
+//
+// A share (x, f(x)). x = 0 is where the secret is, so it is never
+// a share. x is a field element, so x and x + p are the same point.
+//
+type Share struct {
+	X int
+	Y *big.Int
+}
+
+//
+// Polynomial with coefficients in the field, lowest degree first
+//
+type Polynomial []*big.Int
+
+func NewField(p *big.Int) (*Field, error) {
+	if p.Sign() <= 0 || !p.ProbablyPrime(32) {
+		return nil, ErrNotPrime
+	}
+	return &Field{new(big.Int).Set(p)}, nil
+}
+
+func (f *Field) Prime() *big.Int {
+	return new(big.Int).Set(f.p)
+}
+
+func (f *Field) mod(x *big.Int) *big.Int {
+	return x.Mod(x, f.p)
+}
+
+//
+// Reduce x into [0, p)
+//
+func (f *Field) Reduce(x *big.Int) *big.Int {
+	return f.mod(new(big.Int).Set(x))
+}
+
+//
+// a + b in the field
+//
+func (f *Field) Add(a, b *big.Int) *big.Int {
+	return f.mod(new(big.Int).Add(a, b))
+}
+
+//
+// Uniformly random field element
+//
+func (f *Field) Random(rand io.Reader) (*big.Int, error) {
+	return crand.Int(rand, f.p)
+}
+
+//
+// Random polynomial of degree threshold-1 with f(0) = secret
+//
+func (f *Field) RandomPolynomial(secret *big.Int, threshold int, rand io.Reader) (Polynomial, error) {
+	if threshold < 1 {
+		return nil, ErrThreshold
+	}
+
+	poly := make(Polynomial, threshold)
+	poly[0] = f.Reduce(secret)
+	for i := 1; i < threshold; i++ {
+		c, err := f.Random(rand)
+		if err != nil {
+			return nil, err
+		}
+		poly[i] = c
+	}
+
+	return poly, nil
+}
+
+func (f *Field) Eval(poly Polynomial, x int) *big.Int {
+	fx := big.NewInt(0)
+	bigX := big.NewInt(int64(x))
+	for i := len(poly) - 1; i >= 0; i-- {
+		fx.Mul(fx, bigX)
+		fx.Add(fx, poly[i])
+		f.mod(fx)
+	}
+	return fx
+}
+
+//
+// Split the secret into n shares at x = 1..n, any threshold of
+// which reconstruct it. n must be less than p, or a share would
+// be at x = p, i.e. at 0.
+//
+func (f *Field) Split(secret *big.Int, threshold, n int, rand io.Reader) ([]Share, error) {
+	if threshold < 1 || threshold > n {
+		return nil, ErrThreshold
+	}
+	if big.NewInt(int64(n)).Cmp(f.p) >= 0 {
+		return nil, ErrTooManyShares
+	}
+
+	poly, err := f.RandomPolynomial(secret, threshold, rand)
+	if err != nil {
+		return nil, err
+	}
+
+	shares := make([]Share, n)
+	for i := range shares {
+		shares[i] = Share{i + 1, f.Eval(poly, i+1)}
+	}
+
+	return shares, nil
+}
+
+//
+// Check that xs are distinct nonzero points of the field
+//
+func (f *Field) checkDistinct(xs []int) error {
+	seen := make(map[string]bool)
+	for _, x := range xs {
+		point := f.mod(big.NewInt(int64(x)))
+		if point.Sign() == 0 {
+			return ErrZeroShare
+		}
+		if seen[point.String()] {
+			return ErrDuplicateShare
+		}
+		seen[point.String()] = true
+	}
+	return nil
+}
+
+func xsOf(shares []Share) []int {
+	xs := make([]int, len(shares))
+	for i, s := range shares {
+		xs[i] = s.X
+	}
+	return xs
+}
+
+//
+// The Lagrange coefficients l_i such that f(at) = sum_i l_i f(xs[i])
+// for every polynomial f of degree less than len(xs). With them,
+// shares at xs can be turned into a share at another x without
+// reconstructing the secret. xs must be distinct nonzero points.
+//
+func (f *Field) LagrangeAt(xs []int, at int) ([]*big.Int, error) {
+	if err := f.checkDistinct(xs); err != nil {
+		return nil, err
+	}
+
+	coefficients := make([]*big.Int, len(xs))
+	for i, xi := range xs {
+		l := big.NewInt(1)
+		for j, xj := range xs {
+			if i != j {
+				// (at - x_j) / (x_i - x_j)
+				den := f.mod(big.NewInt(int64(xi - xj)))
+				inv := new(big.Int).ModInverse(den, f.p)
+				l.Mul(l, big.NewInt(int64(at-xj)))
+				l.Mul(l, inv)
+				f.mod(l)
+			}
+		}
+		coefficients[i] = l
+	}
+
+	return coefficients, nil
+}
+
+//
+// Reconstruct the secret from the shares, with Lagrange
+// interpolation at x = 0. Every share is used, so they must all
+// be right; see RobustCombine otherwise.
+//
+func (f *Field) Combine(shares []Share) (*big.Int, error) {
+	if len(shares) == 0 {
+		return nil, ErrTooFewShares
+	}
+	coefficients, err := f.LagrangeAt(xsOf(shares), 0)
+	if err != nil {
+		return nil, err
+	}
+
+	total := big.NewInt(0)
+	for i, s := range shares {
+		total.Add(total, new(big.Int).Mul(coefficients[i], s.Y))
+		f.mod(total)
+	}
+
+	return total, nil
+}
+
+//
+// Add shares of different secrets, all at the same x, into a
+// share of the sum of the secrets
+//
+func (f *Field) AddShares(shares ...Share) (Share, error) {
+	if len(shares) == 0 {
+		return Share{}, ErrTooFewShares
+	}
+
+	sum := Share{shares[0].X, big.NewInt(0)}
+	for _, s := range shares {
+		if s.X != sum.X {
+			return Share{}, ErrMismatchedShares
+		}
+		sum.Y.Add(sum.Y, s.Y)
+		f.mod(sum.Y)
+	}
+
+	return sum, nil
+}
+
+//
+// Multiply a share by a public constant k, into a share of
+// k times the secret
+//
+func (f *Field) ScalarMul(k *big.Int, share Share) Share {
+	y := new(big.Int).Mul(k, share.Y)
+	return Share{share.X, f.mod(y)}
+}
+
+//
+// Reconstruct the secret from shares of a polynomial of degree
+// threshold-1, up to (len(shares) - threshold) / 2 of which may be
+// wrong. Returns the secret and the x's of the wrong shares, or
+// ErrUndecodable if no polynomial fits enough of the shares.
+//
+func (f *Field) RobustCombine(shares []Share, threshold int) (*big.Int, []int, error) {
+	if threshold < 1 {
+		return nil, nil, ErrThreshold
+	}
+	if len(shares) < threshold {
+		return nil, nil, ErrTooFewShares
+	}
+	if err := f.checkDistinct(xsOf(shares)); err != nil {
+		return nil, nil, err
+	}
+
+	maxErrors := (len(shares) - threshold) / 2
+	poly, ok := f.berlekampWelch(shares, threshold, maxErrors)
+	if !ok {
+		return nil, nil, ErrUndecodable
+	}
+
+	bad := make([]int, 0)
+	for _, s := range shares {
+		if f.Eval(poly, s.X).Cmp(f.Reduce(s.Y)) != 0 {
+			bad = append(bad, s.X)
+		}
+	}
+	sort.Ints(bad)
+
+	if len(bad) > maxErrors {
+		return nil, nil, ErrUndecodable
+	}
+
+	return f.Eval(poly, 0), bad, nil
+}
+
+//
+// Find the polynomial of degree < threshold that goes through
+// all but at most maxErrors of the shares
+//
+func (f *Field) berlekampWelch(shares []Share, threshold, maxErrors int) (Polynomial, bool) {
+	// unknowns: E = e_0 + ... + e_{k-1} x^{k-1} + x^k (monic) and
+	// Q = q_0 + ... + q_{threshold-1+k} x^{threshold-1+k}, such that
+	// Q(x_i) = y_i E(x_i) for every share
+	k := maxErrors
+	nQ := threshold + k
+	nUnknowns := nQ + k
+
+	rows := make([][]*big.Int, 0, len(shares))
+	for _, s := range shares {
+		row := make([]*big.Int, nUnknowns+1)
+		bigX := big.NewInt(int64(s.X))
+
+		power := big.NewInt(1)
+		for j := 0; j < nQ; j++ {
+			row[j] = new(big.Int).Set(power)
+			if j < k {
+				// - y_i x_i^j e_j
+				row[nQ+j] = f.mod(new(big.Int).Neg(new(big.Int).Mul(s.Y, power)))
+			}
+			if j == k {
+				// y_i x_i^k, the monic term, goes to the right side
+				row[nUnknowns] = f.mod(new(big.Int).Mul(s.Y, power))
+			}
+			f.mod(power.Mul(power, bigX))
+		}
+		rows = append(rows, row)
+	}
+
+	sol, ok := f.solveLinear(rows, nUnknowns)
+	if !ok {
+		return nil, false
+	}
+
+	e := append(append(Polynomial(nil), sol[nQ:]...), big.NewInt(1))
+	poly, ok := f.divide(sol[:nQ], e)
+	if !ok || len(poly) > threshold {
+		return nil, false
+	}
+
+	return poly, true
+}
+
+//
+// Solve a linear system over the field, where the last column of
+// each row is the right hand side. Returns any solution, or false
+// if there is none.
+//
+func (f *Field) solveLinear(rows [][]*big.Int, nUnknowns int) ([]*big.Int, bool) {
+	pivotCol := make([]int, 0, nUnknowns)
+	r := 0
+	for c := 0; c < nUnknowns && r < len(rows); c++ {
+		pivot := -1
+		for i := r; i < len(rows); i++ {
+			if rows[i][c].Sign() != 0 {
+				pivot = i
+				break
+			}
+		}
+		if pivot == -1 {
+			continue
+		}
+		rows[r], rows[pivot] = rows[pivot], rows[r]
+
+		inv := new(big.Int).ModInverse(rows[r][c], f.p)
+		for j := c; j <= nUnknowns; j++ {
+			f.mod(rows[r][j].Mul(rows[r][j], inv))
+		}
+
+		for i := range rows {
+			if i != r && rows[i][c].Sign() != 0 {
+				factor := new(big.Int).Set(rows[i][c])
+				for j := c; j <= nUnknowns; j++ {
+					term := new(big.Int).Mul(factor, rows[r][j])
+					f.mod(rows[i][j].Sub(rows[i][j], term))
+				}
+			}
+		}
+
+		pivotCol = append(pivotCol, c)
+		r++
+	}
+
+	// a row 0 = b with b != 0 means no solution
+	for i := r; i < len(rows); i++ {
+		if rows[i][nUnknowns].Sign() != 0 {
+			return nil, false
+		}
+	}
+
+	sol := make([]*big.Int, nUnknowns)
+	for c := range sol {
+		sol[c] = big.NewInt(0)
+	}
+	for i, c := range pivotCol {
+		sol[c] = new(big.Int).Set(rows[i][nUnknowns])
+	}
+
+	return sol, true
+}
+
+//
+// Divide num by the monic polynomial den, returning the quotient
+// and whether the remainder is zero
+//
+func (f *Field) divide(num, den Polynomial) (Polynomial, bool) {
+	rem := make(Polynomial, len(num))
+	for i := range num {
+		rem[i] = new(big.Int).Set(num[i])
+	}
+
+	quot := Polynomial{}
+	if len(num) >= len(den) {
+		quot = make(Polynomial, len(num)-len(den)+1)
+		for i := len(quot) - 1; i >= 0; i-- {
+			q := new(big.Int).Set(rem[i+len(den)-1])
+			quot[i] = q
+			for j := range den {
+				term := new(big.Int).Mul(q, den[j])
+				f.mod(rem[i+j].Sub(rem[i+j], term))
+			}
+		}
+	}
+
+	for _, c := range rem {
+		if c.Sign() != 0 {
+			return nil, false
+		}
+	}
+
+	return quot, true
+}
@@ -0,0 +1,298 @@
+package shamir
+
+import (
+	"crypto/rand"
+	"math/big"
+	mrand "math/rand"
+	"reflect"
+	"testing"
+	"testing/quick"
+)
+
+// 2^127 - 1, a Mersenne prime much larger than an int64
+var bigPrime = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 127), big.NewInt(1))
+
+// the election package's field
+var smallPrime = big.NewInt(1104637706180507)
+
+func fields(t *testing.T) []*Field {
+	fs := []*Field{}
+	for _, p := range []*big.Int{smallPrime, bigPrime} {
+		f, err := NewField(p)
+		if err != nil {
+			t.Fatalf("NewField(%v): %v", p, err)
+		}
+		fs = append(fs, f)
+	}
+	return fs
+}
+
+// threshold and share count from quick's random bytes
+func sizes(a, b uint8) (int, int) {
+	n := 1 + int(a%9)
+	threshold := 1 + int(b)%n
+	return threshold, n
+}
+
+// a random subset of k of the shares
+func pick(r *mrand.Rand, shares []Share, k int) []Share {
+	perm := r.Perm(len(shares))
+	subset := make([]Share, k)
+	for i := 0; i < k; i++ {
+		subset[i] = shares[perm[i]]
+	}
+	return subset
+}
+
+func TestNewField(t *testing.T) {
+	if _, err := NewField(big.NewInt(1104637706180509)); err != ErrNotPrime {
+		t.Fatalf("expecting %v for a composite modulus, but got %v", ErrNotPrime, err)
+	}
+	if _, err := NewField(big.NewInt(-7)); err != ErrNotPrime {
+		t.Fatalf("expecting %v for a negative modulus, but got %v", ErrNotPrime, err)
+	}
+}
+
+// any threshold shares give back the secret
+func TestSplitCombine(t *testing.T) {
+	for _, f := range fields(t) {
+		prop := func(seed int64, a, b uint8) bool {
+			r := mrand.New(mrand.NewSource(seed))
+			secret := new(big.Int).Rand(r, f.Prime())
+			threshold, n := sizes(a, b)
+
+			shares, err := f.Split(secret, threshold, n, rand.Reader)
+			if err != nil || len(shares) != n {
+				return false
+			}
+
+			k := threshold + r.Intn(n-threshold+1)
+			got, err := f.Combine(pick(r, shares, k))
+			return err == nil && got.Cmp(secret) == 0
+		}
+		if err := quick.Check(prop, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// in a field with few elements, x's are taken mod p: there are
+// at most p-1 shares, and x's that are the same mod p, or 0, are
+// refused rather than divided by
+func TestSmallPrime(t *testing.T) {
+	for _, p := range []int64{2, 3, 5, 7, 11, 13} {
+		f, err := NewField(big.NewInt(p))
+		if err != nil {
+			t.Fatalf("NewField(%v): %v", p, err)
+		}
+
+		prop := func(seed int64, a, b uint8) bool {
+			r := mrand.New(mrand.NewSource(seed))
+			secret := new(big.Int).Rand(r, f.Prime())
+			threshold, n := sizes(a, b)
+
+			shares, err := f.Split(secret, threshold, n, rand.Reader)
+			if int64(n) >= p {
+				return err == ErrTooManyShares
+			}
+			if err != nil {
+				return false
+			}
+			k := threshold + r.Intn(n-threshold+1)
+			got, err := f.Combine(pick(r, shares, k))
+			if err != nil || got.Cmp(secret) != 0 {
+				return false
+			}
+
+			// a share moved by p is at the same point
+			i := r.Intn(n)
+			moved := append([]Share{{shares[i].X + int(p), shares[i].Y}}, shares...)
+			if _, err := f.Combine(moved); err != ErrDuplicateShare {
+				return false
+			}
+			if _, err := f.LagrangeAt(xsOf(moved), 0); err != ErrDuplicateShare {
+				return false
+			}
+			if _, _, err := f.RobustCombine(moved, threshold); err != ErrDuplicateShare {
+				return false
+			}
+
+			// and one at p is at 0
+			zero := append([]Share{{int(p), shares[i].Y}}, shares...)
+			if _, err := f.Combine(zero); err != ErrZeroShare {
+				return false
+			}
+			_, err = f.LagrangeAt([]int{int(p)}, 1)
+			return err == ErrZeroShare
+		}
+		if err := quick.Check(prop, nil); err != nil {
+			t.Fatalf("p = %v: %v", p, err)
+		}
+	}
+}
+
+// shares at threshold x's give the share at any other x
+func TestLagrangeAt(t *testing.T) {
+	for _, f := range fields(t) {
+		prop := func(seed int64, a, b uint8, at uint16) bool {
+			r := mrand.New(mrand.NewSource(seed))
+			secret := new(big.Int).Rand(r, f.Prime())
+			threshold, n := sizes(a, b)
+
+			poly, err := f.RandomPolynomial(secret, threshold, rand.Reader)
+			if err != nil {
+				return false
+			}
+
+			subset := make([]Share, threshold)
+			xs := make([]int, threshold)
+			for i, x := range r.Perm(n)[:threshold] {
+				xs[i] = x + 1
+				subset[i] = Share{x + 1, f.Eval(poly, x+1)}
+			}
+
+			coefficients, err := f.LagrangeAt(xs, int(at))
+			if err != nil {
+				return false
+			}
+			fx := big.NewInt(0)
+			for i, s := range subset {
+				fx.Add(fx, new(big.Int).Mul(coefficients[i], s.Y))
+			}
+			return f.Reduce(fx).Cmp(f.Eval(poly, int(at))) == 0
+		}
+		if err := quick.Check(prop, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// the sum of shares is a share of the sum
+func TestAddShares(t *testing.T) {
+	for _, f := range fields(t) {
+		prop := func(seed int64, a, b uint8) bool {
+			r := mrand.New(mrand.NewSource(seed))
+			x := new(big.Int).Rand(r, f.Prime())
+			y := new(big.Int).Rand(r, f.Prime())
+			threshold, n := sizes(a, b)
+
+			xs, _ := f.Split(x, threshold, n, rand.Reader)
+			ys, _ := f.Split(y, threshold, n, rand.Reader)
+			sums := make([]Share, n)
+			for i := range sums {
+				sum, err := f.AddShares(xs[i], ys[i])
+				if err != nil {
+					return false
+				}
+				sums[i] = sum
+			}
+
+			got, err := f.Combine(pick(r, sums, threshold))
+			want := f.Reduce(new(big.Int).Add(x, y))
+			return err == nil && got.Cmp(want) == 0
+		}
+		if err := quick.Check(prop, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f := fields(t)[0]
+	if _, err := f.AddShares(Share{1, big.NewInt(1)}, Share{2, big.NewInt(1)}); err != ErrMismatchedShares {
+		t.Fatalf("expecting %v, but got %v", ErrMismatchedShares, err)
+	}
+
+	last := new(big.Int).Sub(f.Prime(), big.NewInt(1))
+	if sum := f.Add(last, big.NewInt(2)); sum.Cmp(big.NewInt(1)) != 0 {
+		t.Fatalf("expecting (p-1) + 2 = 1, but got %v", sum)
+	}
+}
+
+// k times a share is a share of k times the secret
+func TestScalarMul(t *testing.T) {
+	for _, f := range fields(t) {
+		prop := func(seed int64, a, b uint8) bool {
+			r := mrand.New(mrand.NewSource(seed))
+			secret := new(big.Int).Rand(r, f.Prime())
+			k := new(big.Int).Rand(r, f.Prime())
+			threshold, n := sizes(a, b)
+
+			shares, _ := f.Split(secret, threshold, n, rand.Reader)
+			for i := range shares {
+				shares[i] = f.ScalarMul(k, shares[i])
+			}
+
+			got, err := f.Combine(pick(r, shares, threshold))
+			want := f.Reduce(new(big.Int).Mul(k, secret))
+			return err == nil && got.Cmp(want) == 0
+		}
+		if err := quick.Check(prop, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// up to (n - threshold) / 2 wrong shares are found and corrected,
+// and more than that are never silently accepted
+func TestRobustCombine(t *testing.T) {
+	for _, f := range fields(t) {
+		prop := func(seed int64, a, b uint8) bool {
+			r := mrand.New(mrand.NewSource(seed))
+			secret := new(big.Int).Rand(r, f.Prime())
+			threshold, n := sizes(a, b)
+
+			shares, _ := f.Split(secret, threshold, n, rand.Reader)
+			maxErrors := (n - threshold) / 2
+
+			nBad := r.Intn(maxErrors + 1)
+			wrong := []int{}
+			for _, i := range r.Perm(n)[:nBad] {
+				delta := new(big.Int).Rand(r, new(big.Int).Sub(f.Prime(), big.NewInt(1)))
+				shares[i].Y = f.Reduce(delta.Add(delta, big.NewInt(1)).Add(delta, shares[i].Y))
+				wrong = append(wrong, shares[i].X)
+			}
+
+			got, bad, err := f.RobustCombine(shares, threshold)
+			if err != nil || got.Cmp(secret) != 0 || len(bad) != nBad {
+				return false
+			}
+			for _, x := range wrong {
+				found := false
+				for _, y := range bad {
+					found = found || x == y
+				}
+				if !found {
+					return false
+				}
+			}
+			return true
+		}
+		if err := quick.Check(prop, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRobustCombineFailsClosed(t *testing.T) {
+	f := fields(t)[0]
+	secret := big.NewInt(42)
+
+	for iters := 0; iters < 20; iters++ {
+		shares, _ := f.Split(secret, 3, 7, rand.Reader)
+
+		_, bad, err := f.RobustCombine(shares, 3)
+		if err != nil || !reflect.DeepEqual(bad, []int{}) {
+			t.Fatalf("expecting no bad shares, but got %v %v", bad, err)
+		}
+
+		for _, i := range []int{1, 3, 5} {
+			shares[i].Y = f.Reduce(new(big.Int).Add(shares[i].Y, big.NewInt(int64(1+iters))))
+		}
+		if _, _, err := f.RobustCombine(shares, 3); err != ErrUndecodable {
+			t.Fatalf("expecting %v with 3 wrong shares out of 7, but got %v", ErrUndecodable, err)
+		}
+
+		if _, _, err := f.RobustCombine(shares[:2], 3); err != ErrTooFewShares {
+			t.Fatalf("expecting %v, but got %v", ErrTooFewShares, err)
+		}
+	}
+}